@@ -0,0 +1,298 @@
+/*
+ * Assembler front-end shared by the VMs
+ *
+ * Each VM supplies its Syntax and an Encoder for its instructions and
+ * this package does the rest.
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package asm
+
+import (
+	"bufio"
+	"io"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// Segment identifies where assembled words are placed
+type Segment int
+
+const (
+	CodeSegment Segment = iota // Code, or all memory for single memory VMs
+	DataSegment                // Data for VMs with separate code and data
+)
+
+func (s Segment) String() string {
+	if s == DataSegment {
+		return "data"
+	}
+	return "code"
+}
+
+// Sizer returns the number of words that stmt occupies in seg
+type Sizer interface {
+	Size(seg Segment, stmt *Stmt) int64
+}
+
+// Encoder is supplied by each VM to turn statements into words
+type Encoder interface {
+	Sizer
+	// Encode returns the words for stmt, which is located at addr in seg.
+	// It should return Size words even if there is an error.
+	Encode(seg Segment, addr int64, stmt *Stmt, syms *Symbols) ([]*big.Int, error)
+}
+
+// Finisher may be implemented by an Encoder to alter or check a routine
+// once all of its statements have been encoded
+type Finisher interface {
+	Finish(routine *vm.Routine) error
+}
+
+// Words returns ns as words for an Encoder to return
+func Words(ns ...int64) []*big.Int {
+	words := make([]*big.Int, len(ns))
+	for i, n := range ns {
+		words[i] = big.NewInt(n)
+	}
+	return words
+}
+
+// Symbols holds the address of each label in each segment
+type Symbols struct {
+	Code map[string]int64
+	Data map[string]int64
+}
+
+// Lookup returns the address of name looking in Code and then Data
+func (s *Symbols) Lookup(name string) (int64, bool) {
+	if addr, ok := s.Code[name]; ok {
+		return addr, true
+	}
+	addr, ok := s.Data[name]
+	return addr, ok
+}
+
+// Eval returns the value of a Literal, Symbol or Binary expression
+func (s *Symbols) Eval(e *Expr) (*big.Int, error) {
+	switch e.Kind {
+	case Literal:
+		return new(big.Int).Set(e.Value), nil
+	case Symbol:
+		addr, ok := s.Lookup(e.Name)
+		if !ok {
+			return nil, vm.NewAsmError(e.Pos, e.Name, "unknown symbol")
+		}
+		return big.NewInt(addr), nil
+	case Binary:
+		x, err := s.Eval(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := s.Eval(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == '-' {
+			return x.Sub(x, y), nil
+		}
+		return x.Add(x, y), nil
+	}
+	return nil, vm.NewAsmError(e.Pos, e.Text, "unsupported expression")
+}
+
+// EvalInt64 returns the value of an expression as Eval but checks that
+// it will fit into an int64
+func (s *Symbols) EvalInt64(e *Expr) (int64, error) {
+	n, err := s.Eval(e)
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsInt64() {
+		return 0, vm.NewAsmError(e.Pos, e.Text, "value out of range")
+	}
+	return n.Int64(), nil
+}
+
+// ReadLines returns the lines read from r
+func ReadLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	sc := bufio.NewScanner(r)
+
+	// Read through 'tokens' until an EOF is encountered.
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	if err := sc.Err(); err != nil {
+		return []string{}, err
+	}
+	return lines, nil
+}
+
+// Assemble parses the source read from r and uses enc to encode it.
+// If opts.Listing is set a listing is written to it.
+func Assemble(r io.Reader, opts vm.AsmOptions, syntax *Syntax, enc Encoder) (*vm.Routine, error) {
+	srcLines, err := ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+	lines, errs := Parse(opts.Filename, srcLines, syntax)
+	syms, pass1Errs := Pass1(opts.Filename, lines, syntax, enc)
+	errs = append(errs, pass1Errs...)
+	routine, pass2Errs := pass2(opts.Filename, srcLines, lines, syntax, syms, enc)
+	errs = append(errs, pass2Errs...)
+	if len(errs) > 0 {
+		errs.Sort()
+		return nil, errs
+	}
+	if f, ok := enc.(Finisher); ok {
+		if err := f.Finish(routine); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Listing != nil {
+		if err := WriteListing(opts.Listing, routine); err != nil {
+			return nil, err
+		}
+	}
+	return routine, nil
+}
+
+// Pass1 builds the symbol table using sizer to find the size of each
+// statement.  A label may only be defined once, in either segment, and
+// an error is returned for each later definition.
+func Pass1(filename string, lines []*Line, syntax *Syntax, sizer Sizer) (*Symbols, vm.AsmErrors) {
+	syms := &Symbols{
+		Code: make(map[string]int64, 0),
+		Data: make(map[string]int64, 0),
+	}
+	errs := vm.AsmErrors{}
+	seg := CodeSegment
+	pos := map[Segment]int64{CodeSegment: 0, DataSegment: 0}
+	for _, line := range lines {
+		if line.Directive != nil {
+			if s, ok := directiveSegment(syntax, line.Directive); ok {
+				seg = s
+			}
+		}
+		if _, ok := syms.Lookup(line.Label); ok {
+			errs.Add(vm.NewAsmError(line.LabelPos, line.Label, "duplicate label"), filename, line.Num)
+		} else if line.Label != "" {
+			if seg == CodeSegment {
+				syms.Code[line.Label] = pos[seg]
+			} else {
+				syms.Data[line.Label] = pos[seg]
+			}
+		}
+		if line.Stmt != nil {
+			pos[seg] += sizer.Size(seg, line.Stmt)
+		}
+	}
+	return syms, errs
+}
+
+// directiveSegment returns the segment selected by d if it selects one
+func directiveSegment(syntax *Syntax, d *Directive) (Segment, bool) {
+	if d.Name == "data" && syntax.SplitData {
+		return DataSegment, true
+	}
+	return CodeSegment, false
+}
+
+func pass2(filename string, srcLines []string, lines []*Line, syntax *Syntax, syms *Symbols, enc Encoder) (*vm.Routine, vm.AsmErrors) {
+	sourceMap := &vm.SourceMap{
+		Filename: filename,
+		Lines:    srcLines,
+		Symbols:  SymbolRefs(lines),
+	}
+	code := make([]int64, 0)
+	data := make([]*big.Int, 0)
+	errs := vm.AsmErrors{}
+	seg := CodeSegment
+	for _, line := range lines {
+		if d := line.Directive; d != nil {
+			if s, ok := directiveSegment(syntax, d); ok {
+				seg = s
+				if len(d.Args) > 0 {
+					errs.Add(vm.NewAsmError(d.Args[0].Pos, d.Args[0].Text, "too many operands"), filename, line.Num)
+				}
+			} else {
+				errs.Add(vm.NewAsmError(d.Pos, d.Name, "unknown directive"), filename, line.Num)
+			}
+		}
+		if line.Stmt != nil {
+			addr := int64(len(code))
+			if seg == DataSegment {
+				addr = int64(len(data))
+			}
+			words, err := enc.Encode(seg, addr, line.Stmt, syms)
+			if err != nil {
+				errs.Add(err, filename, line.Num)
+			}
+			// Keep the addresses the same as in pass1
+			size := enc.Size(seg, line.Stmt)
+			for int64(len(words)) < size {
+				words = append(words, big.NewInt(0))
+			}
+			words = words[:size]
+
+			if seg == DataSegment {
+				data = append(data, words...)
+			} else {
+				for _, w := range words {
+					if !w.IsInt64() {
+						errs.Add(vm.NewAsmError(line.Stmt.Pos, w.String(), "value out of range"), filename, line.Num)
+					}
+					code = append(code, w.Int64())
+				}
+			}
+		}
+		sourceMap.Record(line.Num, len(code), len(data))
+	}
+
+	routine := &vm.Routine{Code: code, CodeSymbols: syms.Code, SourceMap: sourceMap,
+		SingleMem: !syntax.SplitData}
+	if syntax.SplitData {
+		routine.Data = data
+		routine.DataSymbols = syms.Data
+	}
+	return routine, errs
+}
+
+// SymbolRefs returns where each label is defined and used in lines
+func SymbolRefs(lines []*Line) map[string]*vm.SymbolRefs {
+	refs := make(map[string]*vm.SymbolRefs)
+	get := func(name string) *vm.SymbolRefs {
+		r, ok := refs[name]
+		if !ok {
+			r = &vm.SymbolRefs{}
+			refs[name] = r
+		}
+		return r
+	}
+	for _, line := range lines {
+		if line.Label != "" {
+			get(line.Label).Defined = line.Num
+		}
+		var exprs []*Expr
+		if line.Directive != nil {
+			exprs = line.Directive.Args
+		} else if line.Stmt != nil {
+			exprs = line.Stmt.Operands
+		}
+		for _, e := range exprs {
+			for _, name := range e.SymbolNames() {
+				r := get(name)
+				if n := len(r.Used); n == 0 || r.Used[n-1] != line.Num {
+					r.Used = append(r.Used, line.Num)
+				}
+			}
+		}
+	}
+	return refs
+}
@@ -0,0 +1,274 @@
+package asm
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+var testSyntax = &Syntax{
+	IsMnemonic: func(s string) bool { return s == "LDA" || s == "HLT" },
+	AddrModes:  []string{"I", "II"},
+	SplitData:  true,
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		src        string
+		wantLabel  string
+		wantDir    string
+		wantMnem   string
+		wantMode   string
+		wantOprnds []string
+	}{
+		{"loop:  LDA  I  val  ; comment", "loop", "", "LDA", "I", []string{"val"}},
+		{"       LDA  I", "", "", "LDA", "", []string{"I"}},
+		{"       HLT", "", "", "HLT", "", []string{}},
+		{"       FOO  x", "", "", "FOO", "", []string{"x"}},
+		{"val:   -5", "val", "", "", "", []string{"-5"}},
+		{"       val", "", "", "", "", []string{"val"}},
+		{"       LDA II base,idx", "", "", "LDA", "II", []string{"base,idx"}},
+		{".data", "", "data", "", "", nil},
+		{"// A comment", "", "", "", "", nil},
+	}
+	for _, c := range cases {
+		lines, errs := Parse("t.asm", []string{c.src}, testSyntax)
+		if len(errs) > 0 {
+			t.Errorf("Parse(%q) err: %v", c.src, errs)
+			continue
+		}
+		line := lines[0]
+		if line.Label != c.wantLabel {
+			t.Errorf("Parse(%q) Label got: %q, want: %q", c.src, line.Label, c.wantLabel)
+		}
+		if c.wantDir != "" {
+			if line.Directive == nil || line.Directive.Name != c.wantDir {
+				t.Errorf("Parse(%q) Directive got: %v, want: %s", c.src, line.Directive, c.wantDir)
+			}
+			continue
+		}
+		if c.wantOprnds == nil {
+			if line.Stmt != nil {
+				t.Errorf("Parse(%q) Stmt got: %v, want: nil", c.src, line.Stmt)
+			}
+			continue
+		}
+		if line.Stmt == nil {
+			t.Errorf("Parse(%q) Stmt got: nil", c.src)
+			continue
+		}
+		gotOprnds := []string{}
+		for _, o := range line.Stmt.Operands {
+			gotOprnds = append(gotOprnds, o.Text)
+		}
+		if line.Stmt.Mnemonic != c.wantMnem || line.Stmt.AddrMode != c.wantMode ||
+			!reflect.DeepEqual(gotOprnds, c.wantOprnds) {
+			t.Errorf("Parse(%q) got: %s %s %v, want: %s %s %v", c.src,
+				line.Stmt.Mnemonic, line.Stmt.AddrMode, gotOprnds,
+				c.wantMnem, c.wantMode, c.wantOprnds)
+		}
+	}
+}
+
+func TestParsePos(t *testing.T) {
+	src := "lda:\tLDA II  ld,x+1 ; ld"
+	lines, errs := Parse("t.asm", []string{src}, testSyntax)
+	if len(errs) > 0 {
+		t.Fatalf("Parse(%q) err: %v", src, errs)
+	}
+	line := lines[0]
+	stmt := line.Stmt
+	operand := stmt.Operands[0]
+	cases := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"LabelPos", line.LabelPos, 0},
+		{"Stmt.Pos", stmt.Pos, 5},
+		{"MnemonicPos", stmt.MnemonicPos, 5},
+		{"AddrModePos", stmt.AddrModePos, 9},
+		{"Operand Pos", operand.Pos, 13},
+		{"Index X Pos", operand.X.Pos, 13},
+		{"Index Y Pos", operand.Y.Pos, 16},
+		{"Binary Y Pos", operand.Y.Y.Pos, 18},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("Parse(%q) %s got: %d, want: %d", src, c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	cases := []struct {
+		s        string
+		wantKind ExprKind
+	}{
+		{"12", Literal},
+		{"-12", Literal},
+		{"loop", Symbol},
+		{"sret+2", Binary},
+		{"0-done", Binary},
+		{"a-b+1", Binary},
+		{"[caseLoc]", Indirect},
+		{"[a+1]", Indirect},
+		{"memBase,pc", Index},
+		{"!program", AddrOf},
+	}
+	for _, c := range cases {
+		e, err := ParseExpr(c.s)
+		if err != nil {
+			t.Errorf("ParseExpr(%q) err: %v", c.s, err)
+			continue
+		}
+		if e.Kind != c.wantKind || e.Text != c.s {
+			t.Errorf("ParseExpr(%q) got: %d %q, want: %d %q", c.s, e.Kind, e.Text, c.wantKind, c.s)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	// The characters between Z and a are not valid in symbols
+	for _, s := range []string{"a_b", "a[b", "b]", "[a", "!5", "a+", "-", "a,b,c", "5x"} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Errorf("ParseExpr(%q) err: nil, want: error", s)
+		}
+	}
+}
+
+// testEncoder assembles instructions as two words: 1 and the operand
+type testEncoder struct{}
+
+func (testEncoder) Size(seg Segment, stmt *Stmt) int64 {
+	if stmt.Mnemonic != "" {
+		return 2
+	}
+	return 1
+}
+
+func (testEncoder) Encode(seg Segment, addr int64, stmt *Stmt, syms *Symbols) ([]*big.Int, error) {
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return nil, err
+	}
+	n, err := syms.Eval(stmt.Operands[0])
+	if err != nil {
+		return nil, err
+	}
+	if stmt.Mnemonic != "" {
+		return []*big.Int{big.NewInt(1), n}, nil
+	}
+	return []*big.Int{n}, nil
+}
+
+func TestAssemble(t *testing.T) {
+	src := "start: LDA  val\n" +
+		"       HLT  val+1\n" +
+		".data\n" +
+		"val:   7\n" +
+		"       start\n"
+	routine, err := Assemble(strings.NewReader(src), vm.AsmOptions{}, testSyntax, testEncoder{})
+	if err != nil {
+		t.Fatalf("Assemble() err: %v", err)
+	}
+	wantCode := []int64{1, 0, 1, 1}
+	if !reflect.DeepEqual(routine.Code, wantCode) {
+		t.Errorf("Code got: %v, want: %v", routine.Code, wantCode)
+	}
+	if len(routine.Data) != 2 || routine.Data[0].Int64() != 7 || routine.Data[1].Int64() != 0 {
+		t.Errorf("Data got: %v, want: [7 0]", routine.Data)
+	}
+	wantCodeSymbols := map[string]int64{"start": 0}
+	wantDataSymbols := map[string]int64{"val": 0}
+	if !reflect.DeepEqual(routine.CodeSymbols, wantCodeSymbols) ||
+		!reflect.DeepEqual(routine.DataSymbols, wantDataSymbols) {
+		t.Errorf("Symbols got: %v %v, want: %v %v", routine.CodeSymbols,
+			routine.DataSymbols, wantCodeSymbols, wantDataSymbols)
+	}
+	wantLines := []int{1, 1, 2, 2}
+	if !reflect.DeepEqual(routine.SourceMap.Code, wantLines) {
+		t.Errorf("SourceMap.Code got: %v, want: %v", routine.SourceMap.Code, wantLines)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	src := "       LDA  nowhere\n" +
+		"       LDA  a_b\n" +
+		".text\n" +
+		"       LDA  1 2\n" +
+		"a:     LDA  1\n" +
+		".data\n" +
+		"   a:  2\n"
+	_, err := Assemble(strings.NewReader(src), vm.AsmOptions{Filename: "e.asm"}, testSyntax, testEncoder{})
+	want := "e.asm:1:13: unknown symbol: nowhere\n" +
+		"e.asm:2:13: invalid expression: a_b\n" +
+		"e.asm:3:2: unknown directive: text\n" +
+		"e.asm:4:15: too many operands: 2\n" +
+		"e.asm:7:4: duplicate label: a"
+	if err == nil || err.Error() != want {
+		t.Errorf("Assemble() err got: %v, want: %s", err, want)
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	src := "; Test\n" +
+		"start: LDA  val\n" +
+		"       HLT  start\n" +
+		".data\n" +
+		"val:   -10\n"
+	listing := &strings.Builder{}
+	opts := vm.AsmOptions{Listing: listing}
+	_, err := Assemble(strings.NewReader(src), opts, testSyntax, testEncoder{})
+	if err != nil {
+		t.Fatalf("Assemble() err: %v", err)
+	}
+	want := "                 ; Test\n" +
+		"0000  code  1 0  start: LDA  val\n" +
+		"0002  code  1 0         HLT  start\n" +
+		"                 .data\n" +
+		"0000  data  -a   val:   -10\n" +
+		"\n" +
+		"Symbol  Seg   Addr  Defined  Used\n" +
+		"start   code  0000  2        3\n" +
+		"val     data  0000  5        2\n"
+	if listing.String() != want {
+		t.Errorf("listing got:\n%s\nwant:\n%s", listing.String(), want)
+	}
+}
+
+// testDecoder disassembles instructions assembled by testEncoder
+type testDecoder struct{}
+
+func (testDecoder) Decode(code []int64, addr int64, names *Names) (Instr, int64, bool) {
+	if code[addr] != 1 {
+		return Instr{}, 0, false
+	}
+	return Instr{Mnemonic: "LDA", Operands: []string{names.Data(code[addr+1])}}, 2, true
+}
+
+func TestDisassemble(t *testing.T) {
+	routine := &vm.Routine{
+		Code:        []int64{1, 0, 1, 5, 7},
+		Data:        []*big.Int{big.NewInt(9)},
+		CodeSymbols: map[string]int64{"start": 0, "mid": 3, "end": 5},
+		DataSymbols: map[string]int64{"val": 0},
+	}
+	src := &strings.Builder{}
+	if err := Disassemble(src, routine, testDecoder{}); err != nil {
+		t.Fatalf("Disassemble() err: %v", err)
+	}
+	want := "start:  LDA     val\n" +
+		"        1\n" +
+		"mid:    5\n" +
+		"        7\n" +
+		"end:\n" +
+		"\n" +
+		".data\n" +
+		"val:    9\n"
+	if src.String() != want {
+		t.Errorf("Disassemble() got:\n%s\nwant:\n%s", src.String(), want)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Disassembler shared by the VMs
+ *
+ * Each VM supplies a Decoder for its instructions and this package
+ * turns a routine back into source that reassembles to the same words.
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package asm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// Decoder is supplied by each VM to decode instructions
+type Decoder interface {
+	// Decode returns the instruction at addr in code and its size in
+	// words.  ok is false if the words can't be decoded as an instruction,
+	// in which case the word at addr is disassembled as data.
+	Decode(code []int64, addr int64, names *Names) (instr Instr, size int64, ok bool)
+}
+
+// Instr is a decoded instruction
+type Instr struct {
+	Mnemonic string   // Empty for languages without mnemonics
+	AddrMode string   // The addressing mode, if any
+	Operands []string // The operands as they would appear in the source
+}
+
+func (i Instr) String() string {
+	fields := make([]string, 0, len(i.Operands)+2)
+	if i.Mnemonic != "" {
+		fields = append(fields, fmt.Sprintf("%-7s", i.Mnemonic))
+	}
+	if i.AddrMode != "" {
+		fields = append(fields, i.AddrMode)
+	}
+	fields = append(fields, i.Operands...)
+	return strings.TrimRight(strings.Join(fields, " "), " ")
+}
+
+// Names maps addresses back to the names of symbols.  A nil Names
+// returns addresses as numbers.
+type Names struct {
+	code      map[int64][]string
+	data      map[int64][]string
+	codeSyms  map[string]int64
+	singleMem bool // Whether data addresses are named by the code symbols
+}
+
+// NewNames returns the names of the symbols in routine.  Symbols outside
+// of the routine can't be defined in the source so are left out.
+func NewNames(routine *vm.Routine) *Names {
+	return &Names{
+		code:      addrNames(routine.CodeSymbols, int64(len(routine.Code))),
+		data:      addrNames(routine.DataSymbols, int64(len(routine.Data))),
+		codeSyms:  routine.CodeSymbols,
+		singleMem: routine.SingleMem,
+	}
+}
+
+func addrNames(syms map[string]int64, size int64) map[int64][]string {
+	names := make(map[int64][]string)
+	for name, addr := range syms {
+		if addr >= 0 && addr <= size {
+			names[addr] = append(names[addr], name)
+		}
+	}
+	for _, n := range names {
+		sort.Strings(n)
+	}
+	return names
+}
+
+// Code returns the name of addr in code or else addr as a number
+func (n *Names) Code(addr int64) string {
+	if n == nil {
+		return n.Number(addr)
+	}
+	if ns := n.code[addr]; len(ns) > 0 {
+		return ns[0]
+	}
+	return n.Number(addr)
+}
+
+// Data returns the name of addr in data or else addr as a number.  For
+// routines with a single memory space this is the same as Code.
+func (n *Names) Data(addr int64) string {
+	if n == nil || n.singleMem {
+		return n.Code(addr)
+	}
+	for _, name := range n.data[addr] {
+		// The assembler looks up code symbols first so a data symbol
+		// with the same name as a code symbol can't be referred to
+		if _, ok := n.codeSyms[name]; !ok {
+			return name
+		}
+	}
+	return n.Number(addr)
+}
+
+// Number returns addr as a number
+func (n *Names) Number(addr int64) string {
+	return fmt.Sprintf("%d", addr)
+}
+
+// DecodeAt returns the instruction at addr in code using dec or "?" if
+// it can't be decoded
+func DecodeAt(dec Decoder, code []int64, addr int64, names *Names) string {
+	if addr >= 0 && addr < int64(len(code)) {
+		if instr, _, ok := dec.Decode(code, addr, names); ok {
+			return instr.String()
+		}
+	}
+	return "?"
+}
+
+// Disassemble writes the source for routine to w using dec to decode
+// the instructions.  Words that can't be decoded, or that have a label
+// part way through an instruction, are written as data.
+func Disassemble(w io.Writer, routine *vm.Routine, dec Decoder) error {
+	names := NewNames(routine)
+	sw := &sourceWriter{lw: &listingWriter{w: w}}
+	code := routine.Code
+	size := int64(len(code))
+	for addr := int64(0); addr < size; {
+		instr, n, ok := dec.Decode(code, addr, names)
+		if !ok || n < 1 || addr+n > size || hasLabels(names.code, addr+1, addr+n) {
+			instr, n = Instr{Operands: []string{fmt.Sprintf("%d", code[addr])}}, 1
+		}
+		sw.line(names.code[addr], instr)
+		addr += n
+	}
+	sw.labels(names.code[size])
+
+	if len(routine.Data) > 0 || len(routine.DataSymbols) > 0 {
+		sw.lw.printf("\n.data\n")
+		for addr, n := range routine.Data {
+			sw.line(names.data[int64(addr)], Instr{Operands: []string{n.String()}})
+		}
+		sw.labels(names.data[int64(len(routine.Data))])
+	}
+	return sw.lw.err
+}
+
+// hasLabels returns whether there are any labels from start up to end
+func hasLabels(names map[int64][]string, start, end int64) bool {
+	for addr := start; addr < end; addr++ {
+		if len(names[addr]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceWriter writes source in the layout used by the fixtures
+type sourceWriter struct {
+	lw *listingWriter
+}
+
+// line writes instr with labels, only the last of which is put on the
+// same line as the instruction
+func (sw *sourceWriter) line(labels []string, instr Instr) {
+	label := ""
+	if len(labels) > 0 {
+		sw.labels(labels[:len(labels)-1])
+		label = labels[len(labels)-1] + ":"
+	}
+	sw.lw.printf("%-7s %s\n", label, instr)
+}
+
+func (sw *sourceWriter) labels(labels []string) {
+	for _, label := range labels {
+		sw.lw.printf("%s:\n", label)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Assembler listings
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// listingLine is the address and words assembled from a source line
+type listingLine struct {
+	seg   Segment
+	addr  int64
+	words []string
+}
+
+// WriteListing writes a listing of routine to w showing the address,
+// segment and words assembled from each source line followed by a
+// cross-reference of the symbols.  Words are shown in hex.  Code
+// addresses in the source map beyond the end of routine.Code, such as
+// the instructions of codegen which are Go functions rather than words,
+// are listed without words.
+func WriteListing(w io.Writer, routine *vm.Routine) error {
+	sm := routine.SourceMap
+	if sm == nil {
+		return errors.New("routine has no source map")
+	}
+
+	listing := make(map[int]*listingLine, len(sm.Lines))
+	extra := make([]*listingLine, 0)
+	// word is nil if there isn't one at addr
+	add := func(lineNum int, seg Segment, addr int64, word *big.Int) {
+		var words []string
+		if word != nil {
+			words = []string{hexWord(word)}
+		}
+		if lineNum == 0 {
+			// Words generated by the assembler are listed at the end
+			extra = append(extra, &listingLine{seg, addr, words})
+			return
+		}
+		l, ok := listing[lineNum]
+		if !ok {
+			l = &listingLine{seg: seg, addr: addr}
+			listing[lineNum] = l
+		}
+		l.words = append(l.words, words...)
+	}
+	for addr, lineNum := range sm.Code {
+		var word *big.Int
+		if addr < len(routine.Code) {
+			word = big.NewInt(routine.Code[addr])
+		}
+		add(lineNum, CodeSegment, int64(addr), word)
+	}
+	for addr, lineNum := range sm.Data {
+		add(lineNum, DataSegment, int64(addr), routine.Data[addr])
+	}
+
+	// Find the width of the words column so that the source lines up
+	wordsWidth := 0
+	for _, l := range listing {
+		if n := len(strings.Join(l.words, " ")); n > wordsWidth {
+			wordsWidth = n
+		}
+	}
+
+	lw := &listingWriter{w: w}
+	for i, src := range sm.Lines {
+		if l, ok := listing[i+1]; ok {
+			lw.printf("%04x  %-4s  %-*s  %s\n", l.addr, l.seg, wordsWidth, strings.Join(l.words, " "), src)
+		} else {
+			lw.printf("            %-*s  %s\n", wordsWidth, "", src)
+		}
+	}
+	for _, l := range extra {
+		lw.printf("%04x  %-4s  %s\n", l.addr, l.seg, strings.Join(l.words, " "))
+	}
+	writeCrossReference(lw, routine)
+	return lw.err
+}
+
+// writeCrossReference writes each symbol in name order with its segment,
+// address, the line it is defined on and the lines it is used on
+func writeCrossReference(lw *listingWriter, routine *vm.Routine) {
+	refs := routine.SourceMap.Symbols
+	names := make([]string, 0, len(refs))
+	nameWidth := len("Symbol")
+	for name := range refs {
+		names = append(names, name)
+		if len(name) > nameWidth {
+			nameWidth = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	lw.printf("\n%-*s  Seg   Addr  Defined  Used\n", nameWidth, "Symbol")
+	for _, name := range names {
+		seg, addr := "-", "-"
+		if a, ok := routine.CodeSymbols[name]; ok {
+			seg, addr = CodeSegment.String(), fmt.Sprintf("%04x", a)
+		} else if a, ok := routine.DataSymbols[name]; ok {
+			seg, addr = DataSegment.String(), fmt.Sprintf("%04x", a)
+		}
+		defined := "-"
+		if refs[name].Defined != 0 {
+			defined = fmt.Sprintf("%d", refs[name].Defined)
+		}
+		used := make([]string, len(refs[name].Used))
+		for i, lineNum := range refs[name].Used {
+			used[i] = fmt.Sprintf("%d", lineNum)
+		}
+		lw.printf("%-*s  %-4s  %-4s  %-7s  %s\n", nameWidth, name, seg, addr, defined,
+			strings.Join(used, " "))
+	}
+}
+
+func hexWord(n *big.Int) string {
+	if n.Sign() < 0 {
+		return fmt.Sprintf("-%x", new(big.Int).Neg(n))
+	}
+	return fmt.Sprintf("%x", n)
+}
+
+// listingWriter keeps the first error so that it can be checked once
+// the listing has been written.  Trailing spaces are removed from lines.
+type listingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (lw *listingWriter) printf(format string, a ...any) {
+	if lw.err != nil {
+		return
+	}
+	line := strings.TrimRight(fmt.Sprintf(format, a...), " \n")
+	_, lw.err = fmt.Fprintln(lw.w, line)
+}
@@ -0,0 +1,356 @@
+/*
+ * Tokenizer and parser shared by the assemblers
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package asm
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// ExprKind identifies the kind of an Expr
+type ExprKind int
+
+const (
+	Literal  ExprKind = iota // A decimal number such as -5
+	Symbol                   // A label such as loop
+	Binary                   // X+Y or X-Y
+	Indirect                 // [X]
+	Index                    // X,Y
+	AddrOf                   // !X
+)
+
+// Expr is an operand expression
+type Expr struct {
+	Kind  ExprKind
+	Text  string   // The source text of the expression
+	Pos   int      // Byte offset of Text in the source line
+	Value *big.Int // The value of a Literal
+	Name  string   // The name of a Symbol
+	Op    byte     // The operator of a Binary, '+' or '-'
+	X     *Expr    // The left of Binary and Index, the operand of the others
+	Y     *Expr    // The right of Binary and Index
+}
+
+// SymbolNames returns the names of the symbols used in e
+func (e *Expr) SymbolNames() []string {
+	if e == nil {
+		return nil
+	}
+	if e.Kind == Symbol {
+		return []string{e.Name}
+	}
+	return append(e.X.SymbolNames(), e.Y.SymbolNames()...)
+}
+
+// Stmt is an instruction or a data word
+type Stmt struct {
+	Pos         int     // Byte offset of the statement in the source line
+	Mnemonic    string  // Empty for data words and languages without mnemonics
+	MnemonicPos int     // Byte offset of Mnemonic in the source line
+	AddrMode    string  // The addressing mode following the mnemonic, if any
+	AddrModePos int     // Byte offset of AddrMode in the source line
+	Operands    []*Expr // The operands in the order they appear
+}
+
+// CheckOperands returns an error if stmt has fewer than min or more than
+// max operands
+func (s *Stmt) CheckOperands(min, max int) error {
+	if len(s.Operands) < min {
+		return vm.NewAsmError(s.MnemonicPos, s.Mnemonic, "missing operand")
+	}
+	if len(s.Operands) > max {
+		return vm.NewAsmError(s.Operands[max].Pos, s.Operands[max].Text, "too many operands")
+	}
+	return nil
+}
+
+// Directive is an assembler directive such as .data
+type Directive struct {
+	Name string  // The name without the leading '.'
+	Pos  int     // Byte offset of Name in the source line
+	Args []*Expr // Any arguments following the name
+}
+
+// Line is a parsed source line.  A line may have a label with either a
+// Directive or a Stmt, or neither if it is blank or only a comment.
+type Line struct {
+	Num       int    // Line number, starting at 1
+	Src       string // The source line
+	Label     string // The label defined on the line, if any
+	LabelPos  int    // Byte offset of Label in the source line
+	Directive *Directive
+	Stmt      *Stmt
+}
+
+// Syntax describes how the assembly language of a VM differs from the
+// common form of: [label:] [mnemonic [addrMode]] [operand ...] [; comment]
+// Comments may also start with //.
+type Syntax struct {
+	// IsMnemonic reports whether s is an instruction mnemonic.  It is nil
+	// for languages without mnemonics, such as subleq.
+	IsMnemonic func(s string) bool
+	// AddrModes are the addressing modes that may follow a mnemonic
+	AddrModes []string
+	// SplitData is set for VMs with separate code and data memory, where
+	// .data switches assembly to the data segment
+	SplitData bool
+}
+
+var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
+var reIdent = regexp.MustCompile(`^[a-zA-Z][0-9a-zA-Z]*$`)
+
+// Parse parses srcLines returning a Line for each one
+func Parse(filename string, srcLines []string, syntax *Syntax) ([]*Line, vm.AsmErrors) {
+	lines := make([]*Line, len(srcLines))
+	errs := vm.AsmErrors{}
+	for i, srcLine := range srcLines {
+		line, err := parseLine(syntax, i+1, srcLine)
+		if err != nil {
+			errs.Add(err, filename, i+1)
+		}
+		lines[i] = line
+	}
+	return lines, errs
+}
+
+func parseLine(syntax *Syntax, lineNum int, srcLine string) (*Line, error) {
+	line := &Line{Num: lineNum, Src: srcLine}
+	text := srcLine
+	pos := 0 // Byte offset of text in srcLine
+	// Remove any comment
+	if i := strings.IndexByte(text, ';'); i >= 0 {
+		text = text[:i]
+	}
+	if i := strings.Index(text, "//"); i >= 0 {
+		text = text[:i]
+	}
+	// If there is a label
+	if m := reLabel.FindStringSubmatchIndex(text); m != nil {
+		line.Label = text[m[2]:m[3]]
+		line.LabelPos = m[2]
+		text = text[m[1]:]
+		pos = m[1]
+	}
+
+	fields := splitFields(text, pos)
+	if len(fields) == 0 {
+		return line, nil
+	}
+
+	// If there is a directive
+	if strings.HasPrefix(fields[0].text, ".") {
+		name := fields[0].text[1:]
+		if !reIdent.MatchString(name) {
+			return line, vm.NewAsmError(fields[0].pos, fields[0].text, "invalid directive")
+		}
+		args, err := parseExprs(fields[1:])
+		if err != nil {
+			return line, err
+		}
+		line.Directive = &Directive{Name: name, Pos: fields[0].pos + 1, Args: args}
+		return line, nil
+	}
+
+	stmt := &Stmt{Pos: fields[0].pos}
+	// A lone identifier is only a mnemonic if it is known, otherwise it
+	// is taken to be a data word
+	if syntax.IsMnemonic != nil && reIdent.MatchString(fields[0].text) &&
+		(len(fields) > 1 || syntax.IsMnemonic(fields[0].text)) {
+		stmt.Mnemonic, stmt.MnemonicPos = fields[0].text, fields[0].pos
+		fields = fields[1:]
+		// An addressing mode must be followed by an operand, otherwise it
+		// is the operand
+		if len(fields) > 1 && isAddrMode(syntax, fields[0].text) {
+			stmt.AddrMode, stmt.AddrModePos = fields[0].text, fields[0].pos
+			fields = fields[1:]
+		}
+	}
+	operands, err := parseExprs(fields)
+	if err != nil {
+		return line, err
+	}
+	stmt.Operands = operands
+	line.Stmt = stmt
+	return line, nil
+}
+
+func isAddrMode(syntax *Syntax, s string) bool {
+	for _, mode := range syntax.AddrModes {
+		if s == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// field is a whitespace separated field of a source line
+type field struct {
+	text string
+	pos  int // Byte offset of text in the source line
+}
+
+// splitFields splits text around whitespace as strings.Fields, where text
+// starts at byte offset pos of the source line
+func splitFields(text string, pos int) []field {
+	fields := make([]field, 0)
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				fields = append(fields, field{text[start:i], pos + start})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, field{text[start:], pos + start})
+	}
+	return fields
+}
+
+func parseExprs(fields []field) ([]*Expr, error) {
+	exprs := make([]*Expr, len(fields))
+	for i, field := range fields {
+		e, err := parseExprAt(field.text, field.pos)
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = e
+	}
+	return exprs, nil
+}
+
+// ParseExpr parses a single operand expression
+func ParseExpr(s string) (*Expr, error) {
+	return parseExprAt(s, 0)
+}
+
+// parseExprAt parses s as ParseExpr, where s starts at byte offset base
+// of the source line
+func parseExprAt(s string, base int) (*Expr, error) {
+	// If it is an indexed address
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		x, err := parseExprAt(s[:i], base)
+		if err != nil {
+			return nil, err
+		}
+		y, err := parseExprAt(s[i+1:], base+i+1)
+		if err != nil {
+			return nil, err
+		}
+		if x.Kind == Index || y.Kind == Index {
+			return nil, vm.NewAsmError(base, s, "invalid expression")
+		}
+		return &Expr{Kind: Index, Text: s, Pos: base, X: x, Y: y}, nil
+	}
+
+	p := &exprParser{s: s, base: base}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(s) {
+		return nil, vm.NewAsmError(base, s, "invalid expression")
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s    string
+	base int // Byte offset of s in the source line
+	pos  int
+}
+
+func (p *exprParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// sum parses: term {('+'|'-') term}
+func (p *exprParser) sum() (*Expr, error) {
+	start := p.pos
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '+' || p.peek() == '-' {
+		op := p.peek()
+		p.pos++
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = &Expr{Kind: Binary, Text: p.s[start:p.pos], Pos: p.base + start, Op: op, X: x, Y: y}
+	}
+	return x, nil
+}
+
+// term parses: literal | symbol | '[' sum ']' | '!' symbol
+func (p *exprParser) term() (*Expr, error) {
+	start := p.pos
+	c := p.peek()
+	switch {
+	case c == '[':
+		p.pos++
+		x, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ']' {
+			return nil, vm.NewAsmError(p.base, p.s, "invalid expression")
+		}
+		p.pos++
+		return &Expr{Kind: Indirect, Text: p.s[start:p.pos], Pos: p.base + start, X: x}, nil
+	case c == '!':
+		p.pos++
+		x, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		if x.Kind != Symbol {
+			return nil, vm.NewAsmError(p.base, p.s, "invalid expression")
+		}
+		return &Expr{Kind: AddrOf, Text: p.s[start:p.pos], Pos: p.base + start, X: x}, nil
+	case c == '-' || isDigit(c):
+		p.pos++
+		for isDigit(p.peek()) {
+			p.pos++
+		}
+		text := p.s[start:p.pos]
+		n, ok := new(big.Int).SetString(text, 10)
+		if !ok {
+			return nil, vm.NewAsmError(p.base+start, text, "invalid literal")
+		}
+		return &Expr{Kind: Literal, Text: text, Pos: p.base + start, Value: n}, nil
+	case isLetter(c):
+		p.pos++
+		for isLetter(p.peek()) || isDigit(p.peek()) {
+			p.pos++
+		}
+		name := p.s[start:p.pos]
+		return &Expr{Kind: Symbol, Text: name, Pos: p.base + start, Name: name}, nil
+	}
+	return nil, vm.NewAsmError(p.base, p.s, "invalid expression")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -14,35 +14,114 @@ package bsubleq2
 import (
 	"fmt"
 	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 // Location in memory of hltVal
 // If this is used as a destination location then a HLT is executed
 const hltLoc = 1000
 
 type SUBLEQ struct {
-	code        [memSize]int64    // Code / Program
-	mem         [memSize]*big.Int // Memory
-	pc          int64             // Program Counter
-	hltVal      *big.Int          // A value returned by HLT
-	codeSymbols map[string]int64  // The code symbols table from the assembler - to aid debugging
-	dataSymbols map[string]int64  // The data symbols table from the assembler - to aid debugging
-	codeSize    int64             // The size of the code / program
+	code     []int64     // Code / Program
+	mem      []*big.Int  // Memory
+	memSize  int64       // Number of words of memory
+	pc       int64       // Program Counter
+	hltVal   *big.Int    // A value returned by HLT
+	codeSize int64       // The size of the code / program
+	word     vm.Word     // Width of words, results of SUBLEQ wrap to fit
+	tracer   vm.Tracer   // Called around each instruction if set
+	stats    *vm.Stats   // Counts of what has been executed if turned on
+	names    *asm.Names  // Names of addresses used when tracing
+	routine  *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*SUBLEQ)(nil)
+
+// Option configures a SUBLEQ when passed to New
+type Option func(*SUBLEQ)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *SUBLEQ) {
+		v.memSize = n
+	}
 }
 
-func New() *SUBLEQ {
-	var mem [memSize]*big.Int
-	for i := 0; i < memSize; i++ {
-		mem[i] = big.NewInt(0)
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *SUBLEQ) {
+		v.stats = vm.NewStats()
+	}
+}
 
+// WithWordSize sets the width of words, which is unbounded by default.
+// The result of each subtraction wraps around to fit and is signed when
+// compared with 0.  Words loaded from a routine are stored as they are
+// but are still signed when compared.
+func WithWordSize(w vm.Word) Option {
+	return func(v *SUBLEQ) {
+		v.word = w
 	}
-	return &SUBLEQ{mem: mem}
 }
 
+func New(opts ...Option) *SUBLEQ {
+	v := &SUBLEQ{memSize: defaultMemSize, hltVal: big.NewInt(0)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.code = make([]int64, v.memSize)
+	v.mem = make([]*big.Int, v.memSize)
+	for i := range v.mem {
+		v.mem[i] = big.NewInt(0)
+	}
+	return v
+}
+
+// Step executes a single instruction
+// Returns: hlt, error
 func (v *SUBLEQ) Step() (bool, error) {
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *SUBLEQ) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of operands A and B
+func (v *SUBLEQ) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.code, v.pc, v.names)
+	operandA, operandB, _, err := v.fetch()
+	if err != nil {
+		return instr, nil
+	}
+	return instr, []int64{operandA, operandB}
+}
+
+// Registers returns the value of each register other than the PC, of
+// which there are none
+func (v *SUBLEQ) Registers() []vm.Register {
+	return nil
+}
+
+func (v *SUBLEQ) step() (bool, error) {
 	operandA, operandB, operandC, err := v.fetch()
 	if err != nil {
 		return false, err
@@ -50,27 +129,85 @@ func (v *SUBLEQ) Step() (bool, error) {
 	return v.execute(operandA, operandB, operandC)
 }
 
-func (v *SUBLEQ) Run() error {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
-			return err
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
+func (v *SUBLEQ) Run() (bool, error) {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
+			return hlt, err
 		}
 	}
+}
+
+func (v *SUBLEQ) LoadRoutine(r *vm.Routine) error {
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine code too big for memory: %d", len(r.Code))
+	}
+	if int64(len(r.Data)) > v.memSize {
+		return fmt.Errorf("routine data too big for memory: %d", len(r.Data))
+	}
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
 	return nil
 }
 
-func (v *SUBLEQ) LoadRoutine(code []int64, data []*big.Int, codeSymbols map[string]int64, dataSymbols map[string]int64) {
-	// Need to copy the individual data points of the routine because they are pointers
-	for i, d := range data {
-		v.mem[i].Set(d)
+func (v *SUBLEQ) Reset() {
+	for i := range v.code {
+		v.code[i] = 0
+	}
+	for _, n := range v.mem {
+		n.SetInt64(0)
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.code[:], v.routine.Code)
+		// Need to copy the individual data points of the routine because they are pointers
+		for i, d := range v.routine.Data {
+			v.mem[i].Set(d)
+		}
+		v.pc = v.routine.Entry
 	}
-	copy(v.code[:], code)
 	v.codeSize = int64(len(v.code))
-	v.codeSymbols = codeSymbols
-	v.dataSymbols = dataSymbols
+	v.hltVal = big.NewInt(0)
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *SUBLEQ) HltVal() *big.Int {
+	return new(big.Int).Set(v.hltVal)
+}
+
+func (v *SUBLEQ) PC() int64 {
+	return v.pc
+}
+
+func (v *SUBLEQ) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *SUBLEQ) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return new(big.Int).Set(v.mem[addr]), nil
+}
+
+func (v *SUBLEQ) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	v.word.WrapBig(v.mem[addr].Set(n))
+	return nil
 }
 
 // getOperandAB returns the operand as supplied unless it is negative in which
@@ -78,20 +215,20 @@ func (v *SUBLEQ) LoadRoutine(code []int64, data []*big.Int, codeSymbols map[stri
 // operand.  This is for A or B operands and hence always checks memSize.
 func (v *SUBLEQ) getOperandAB(operand int64) (int64, error) {
 	if operand < 0 {
-		operand = -operand
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		ptr := -operand
+		if ptr >= v.memSize {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: ptr}
 		}
-		ioperand := v.mem[operand]
+		ioperand := v.mem[ptr]
 		if !ioperand.IsInt64() {
-			return 0, fmt.Errorf("PC: %d, outside memory range", v.pc)
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(ioperand)}
 		}
 		operand = ioperand.Int64()
 		if operand < 0 {
-			return 0, fmt.Errorf("PC: %d, double indirect not supported", v.pc)
+			return 0, &vm.DoubleIndirect{PC: v.pc, Addr: ptr}
 		}
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		if operand >= v.memSize {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: operand}
 		}
 	}
 
@@ -105,17 +242,17 @@ func (v *SUBLEQ) getOperandAB(operand int64) (int64, error) {
 // the code size.
 func (v *SUBLEQ) getOperandC(operand int64) (int64, error) {
 	if operand < 0 {
-		operand = -operand
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		ptr := -operand
+		if ptr >= v.memSize {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: ptr}
 		}
-		ioperand := v.mem[operand]
+		ioperand := v.mem[ptr]
 		if !ioperand.IsInt64() {
-			return 0, fmt.Errorf("PC: %d, outside memory range", v.pc)
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(ioperand)}
 		}
 		operand = ioperand.Int64()
 		if operand < 0 {
-			return 0, fmt.Errorf("PC: %d, double indirect not supported", v.pc)
+			return 0, &vm.DoubleIndirect{PC: v.pc, Addr: ptr}
 		}
 	}
 
@@ -129,7 +266,7 @@ func (v *SUBLEQ) fetch() (int64, int64, int64, error) {
 	var err error
 
 	if v.pc+2 >= v.codeSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside code range: %d", v.pc, v.pc)
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: v.pc + 2}
 	}
 
 	operandA := v.code[v.pc]
@@ -152,33 +289,14 @@ func (v *SUBLEQ) fetch() (int64, int64, int64, error) {
 	return a, b, c, nil
 }
 
-func (v *SUBLEQ) addr2symbol(addr int64, onlyCode ...bool) string {
-	if len(onlyCode) == 0 {
-		for k, v := range v.dataSymbols {
-			if v == addr {
-				return k
-			}
-		}
-	}
-
-	for k, v := range v.codeSymbols {
-		if v == addr {
-			return k
-		}
-	}
-	return fmt.Sprintf("%d", addr)
-}
-
 // execute executes the supplied instruction
 // Returns: hlt, error
 func (v *SUBLEQ) execute(operandA int64, operandB int64, operandC int64) (bool, error) {
-	//fmt.Printf("PC: %7s    SUBLEQ %s, %s, %s\n", v.addr2symbol(v.pc, true), v.addr2symbol(operandA), v.addr2symbol(operandB), v.addr2symbol(operandC))
-	//fmt.Printf("                      %d - %d = ", v.mem[operandB], v.mem[operandA])
 	if operandB == hltLoc {
-		v.hltVal = big.NewInt(0).Sub(v.mem[operandB], v.mem[operandA])
+		v.hltVal = v.word.WrapBig(big.NewInt(0).Sub(v.mem[operandB], v.mem[operandA]))
 		return true, nil
 	} else {
-		v.mem[operandB].Sub(v.mem[operandB], v.mem[operandA])
+		v.word.WrapBig(v.mem[operandB].Sub(v.mem[operandB], v.mem[operandA]))
 	}
 
 	if v.mem[operandB].Sign() <= 0 {
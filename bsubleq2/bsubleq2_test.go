@@ -1,82 +1,234 @@
 package bsubleq2
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/big"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var tests = []struct {
 	filename string
-	want     map[int]int64 // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"loopuntil_v1.asm", map[int]int64{2: 5000}},
-	{"add12_v1.asm", map[int]int64{2: 4}},
-	{"and_v1.asm", map[int]int64{9: 4499}},
-	{"and_v2.asm", map[int]int64{8: 4499}},
-	{"isz_v1.asm", map[int]int64{9: 9, 10: 24}},
-	{"jsr_v1.asm", map[int]int64{4: 50}},
-	{"tad_v1.asm", map[int]int64{8: 32}},
-	{"subleq_v1.asm", map[int]int64{27: 5000}},
-	{"subleq_v2.asm", map[int]int64{25: 5000}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"and_v1.asm", map[string]int64{"lac": 4499}},
+	{"and_v2.asm", map[string]int64{"lac": 4499}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v2.asm", map[string]int64{"sum": 5000}},
 	// TODO: reimplement switch_v1?
-	// {"switch_v1.asm", map[int]int64{3: 2255}},
-	{"switch_v2.asm", map[int]int64{0: 2255}},
-	{"switch_v3.asm", map[int]int64{0: 2255}},
+	// {"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
+	{"switch_v3.asm", map[string]int64{"lac": 2255}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.filename, func(t *testing.T) {
-			code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(code, data, codeSymbols, dataSymbols)
-			if err := v.Run(); err != nil {
-				t.Fatalf("Run() err: %v", err)
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+				t.Fatalf("RunLimit() err: %v", err)
+			}
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("AssembleFile() err: %v", err)
+			}
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+			if len(got.Data) != len(want.Data) {
+				t.Fatalf("Data got: %v, want: %v", got.Data, want.Data)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			for i, n := range got.Data {
+				if n.Cmp(want.Data[i]) != 0 {
+					t.Errorf("Data[%d] got: %d, want: %d", i, n, want.Data[i])
 				}
 			}
+			if !reflect.DeepEqual(got.DataSymbols, want.DataSymbols) {
+				t.Errorf("DataSymbols got: %v, want: %v", got.DataSymbols, want.DataSymbols)
+			}
 		})
 	}
 }
 
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "n n", "[]", "[]"},
+		{3, "lm50 n", "[]", "[{6 0 50}]"},
+		{6, "sret sret", "[]", "[]"},
+		{9, "lmdone sret", "[]", "[{5 0 15}]"},
+		{12, "z z setVal", "[]", "[]"},
+		{18, "val val", "[]", "[]"},
+		{21, "n z", "[]", "[{0 0 -50}]"},
+		{24, "z val", "[]", "[{4 0 50}]"},
+		{27, "z z [sret]", "[]", "[{0 -50 0}]"},
+		{15, "lm1 1000", "[]", "[]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps:          10,
+		Opcodes:        map[string]int64{"SUBLEQ": 10},
+		Reads:          20,
+		Writes:         9,
+		Indirects:      1,
+		Taken:          2,
+		NotTaken:       7,
+		StackHighWater: map[string]int64{},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+}
+
 func BenchmarkRun(b *testing.B) {
 	for _, test := range tests {
-		code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(code, data, codeSymbols, dataSymbols)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
-				err := v.Run()
+				_, err := v.Run()
 				b.StopTimer()
 
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(code)+len(data))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
 	}
 }
 
@@ -153,3 +305,24 @@ func op_OR(a, b, n int) int {
 	}
 	return res
 }
+
+func TestWithMemSize(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "loopuntil_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+
+	v := New(WithMemSize(1001))
+	if got := v.MemSize(); got != 1001 {
+		t.Errorf("MemSize() got: %d, want: 1001", got)
+	}
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	if v.mem[2].Cmp(big.NewInt(5000)) != 0 {
+		t.Errorf("mem[2] got: %d, want: 5000", v.mem[2])
+	}
+}
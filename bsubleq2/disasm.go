@@ -0,0 +1,59 @@
+/*
+ * A disassembler for this VM
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package bsubleq2
+
+import (
+	"io"
+	"math"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// decoder implements asm.Decoder
+type decoder struct{}
+
+// An instruction is operands A B C, each of which is indirect if
+// negative.  C is left out if it is the address of the next instruction.
+func (decoder) Decode(code []int64, addr int64, names *asm.Names) (asm.Instr, int64, bool) {
+	if addr+2 >= int64(len(code)) {
+		return asm.Instr{}, 0, false
+	}
+	a, b, c := code[addr], code[addr+1], code[addr+2]
+	if a == math.MinInt64 || b == math.MinInt64 || c == math.MinInt64 {
+		return asm.Instr{}, 0, false
+	}
+	instr := asm.Instr{Operands: []string{operandAB(names, a), operandAB(names, b)}}
+	if c < 0 {
+		instr.Operands = append(instr.Operands, "["+names.Data(-c)+"]")
+	} else if c != addr+3 {
+		instr.Operands = append(instr.Operands, names.Code(c))
+	}
+	return instr, 3, true
+}
+
+func operandAB(names *asm.Names, operand int64) string {
+	if operand < 0 {
+		return "[" + names.Data(-operand) + "]"
+	}
+	return names.Data(operand)
+}
+
+// Disassemble writes the source for routine to w.  The guard added to
+// the end of the code by the assembler is left out.
+func Disassemble(w io.Writer, routine *vm.Routine) error {
+	code := routine.Code
+	if n := int64(len(code)); n >= 3 &&
+		code[n-3] == 0 && code[n-2] == 0 && code[n-1] == n-3 {
+		r := *routine
+		r.Code = code[:n-3]
+		routine = &r
+	}
+	return asm.Disassemble(w, routine, decoder{})
+}
@@ -0,0 +1,53 @@
+/*
+ * Counting what is executed for Stats
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package bsubleq2
+
+import "github.com/lawrencewoodman/go-vmcomparison/vm"
+
+// op describes the only instruction for the stats
+var op = vm.OpInfo{Mnemonic: "SUBLEQ", Reads: 2, Writes: 1, Branch: true}
+
+// hltOp describes the instruction when its destination is hltLoc, which
+// halts with the difference rather than storing it and branching
+var hltOp = vm.OpInfo{Mnemonic: "SUBLEQ", Reads: 2}
+
+// Stats returns the counts since the last reset or nil if they haven't
+// been turned on with WithStats
+func (v *SUBLEQ) Stats() *vm.Stats {
+	return v.stats
+}
+
+// countStep executes an instruction and records it in the stats
+// Returns: hlt, error
+func (v *SUBLEQ) countStep() (bool, error) {
+	pc := v.pc
+	var indirects int64
+	if pc >= 0 && pc+2 < int64(len(v.code)) {
+		for _, operand := range v.code[pc : pc+3] {
+			if operand < 0 {
+				indirects++
+			}
+		}
+	}
+	var hlt bool
+	var err error
+	if v.tracer != nil {
+		hlt, err = vm.TraceStep(v.tracer, v, v.step)
+	} else {
+		hlt, err = v.step()
+	}
+	if err == nil {
+		if hlt {
+			v.stats.Record(hltOp, indirects, false)
+		} else {
+			v.stats.Record(op, indirects, v.pc != pc+3)
+		}
+	}
+	return hlt, err
+}
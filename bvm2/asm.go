@@ -9,12 +9,13 @@
 package bvm2
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"math/big"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]int64{
@@ -34,207 +35,86 @@ var instructions = map[string]int64{
 	"JGT":  13,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
+var syntax = &asm.Syntax{
+	IsMnemonic: isMnemonic,
+	AddrModes:  []string{"I", "DI", "II"},
+	SplitData:  true,
+}
 
-	sc := bufio.NewScanner(f)
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
+}
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
-	}
+// encoder implements asm.Encoder
+type encoder struct{}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	isInstr := stmt.Mnemonic != ""
+	if isInstr && seg == asm.CodeSegment {
+		return 3
+	} else if !isInstr && seg == asm.DataSegment {
+		return 1
 	}
-	return lines, nil
+	return 0
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s+`)
-var reAddrMode = regexp.MustCompile(`^\s*([diDI]{1,2})\s+`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+)`)
-var reLiteral = regexp.MustCompile(`^\s*(\-?[0-9]+).*`)
-var reDirective = regexp.MustCompile(`^\.([a-zA-Z]+)$`)
-var reSymbol = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*).*`)
-
-// pass1 returns program and data symbol tables
-func pass1(srcLines []string) (map[string]int64, map[string]int64) {
-	symbolType := "c"
-	var memPos int64 = 0
-	var progPos int64 = 0
-	progSymbols := make(map[string]int64, 0)
-	memSymbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				symbolType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			if symbolType == "c" {
-				progSymbols[label] = progPos
-			} else {
-				memSymbols[label] = memPos
-			}
-			line = line[matchIndices[1]:]
-		}
-
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			progPos += 3
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			memPos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			memPos++
-		}
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if stmt.Mnemonic == "" {
+		return asmData(seg, syms, stmt)
+	}
+	if seg != asm.CodeSegment {
+		return nil, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "instruction inside .data")
 	}
-	return progSymbols, memSymbols
+	code, err := asmInstr(syms, stmt)
+	return asm.Words(code...), err
 }
 
-// Returns: operand, restLine
-func getOperand(line string, addrMode string) (string, string) {
-	operand := ""
-	if reOperand.MatchString(line) {
-		operand = reOperand.FindStringSubmatch(line)[1]
-		matchIndices := reOperand.FindStringSubmatchIndex(line)
-		line = line[matchIndices[3]:]
-	} else {
-		if addrMode != "" {
-			// operand mistaken for address mode
-			operand = addrMode
-		} else {
-			// If operand missing then use '0'
-			operand = "0"
+// asmData assembles a literal value or symbol
+func asmData(seg asm.Segment, syms *asm.Symbols, stmt *asm.Stmt) ([]*big.Int, error) {
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return nil, err
+	}
+	operand := stmt.Operands[0]
+	if seg != asm.DataSegment {
+		if operand.Kind == asm.Literal {
+			return nil, vm.NewAsmError(operand.Pos, operand.Text, "literal outside of .data")
 		}
+		return nil, vm.NewAsmError(operand.Pos, operand.Text, "symbol outside of .data")
 	}
-	return operand, line
+	n, err := syms.Eval(operand)
+	return []*big.Int{n}, err
 }
 
-// pass2 returns code and data
-func pass2(srcLines []string, codeSymbols, dataSymbols map[string]int64) ([]int64, []*big.Int) {
-	outputType := "c"
-	code := make([]int64, 0)
-	data := make([]*big.Int, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				outputType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-			addrMode := ""
-
-			// If there is a possible address mode
-			if reAddrMode.MatchString(line) {
-				addrMode = reAddrMode.FindStringSubmatch(line)[1]
-				matchIndices := reAddrMode.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-			// TODO: handle operand being mistaken for addrMode
-			operandA, line := getOperand(line, "")
-			operandB, line := getOperand(line, "")
-
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(codeSymbols, dataSymbols, instr, addrMode, operandA, operandB)...)
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			num, ok := new(big.Int).SetString(lit, 10)
-			if !ok {
-				panic("can't create literal value")
-			}
-			if outputType == "d" {
-				data = append(data, num)
-			} else {
-				panic("literal shouldn't appear here")
-			}
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			addr, err := resolveSymbol(codeSymbols, dataSymbols, sym)
-			if err != nil {
-				panic(err)
-			}
-			if outputType == "d" {
-				data = append(data, big.NewInt(addr))
-			} else {
-				panic("symbol shouldn't appear here")
-			}
-		}
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	if operand.Kind != asm.Literal && operand.Kind != asm.Symbol {
+		return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 	}
-	return code, data
+	return syms.EvalInt64(operand)
 }
 
-func resolveSymbol(codeSymbols, dataSymbols map[string]int64, sym string) (int64, error) {
-	v, ok := codeSymbols[sym]
+// Missing operands are assembled as 0
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) ([]int64, error) {
+	code := []int64{0, 0, 0}
+	opcode, ok := instructions[stmt.Mnemonic]
 	if !ok {
-		v, ok = dataSymbols[sym]
-		if !ok {
-			return v, fmt.Errorf("unknown symbol: %s", sym)
-		}
+		return code, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
+	}
+	if err := stmt.CheckOperands(0, 2); err != nil {
+		return code, err
 	}
-	return v, nil
-}
 
-func resolveOperand(codeSymbols, dataSymbols map[string]int64, operand string) int64 {
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		addr, err := strconv.ParseInt(operand, 10, 64)
+	operands := []int64{0, 0}
+	for i, operand := range stmt.Operands {
+		n, err := resolveOperand(syms, operand)
 		if err != nil {
-			panic(err)
+			return code, err
 		}
-		return addr
-	}
-	addr, err := resolveSymbol(codeSymbols, dataSymbols, operand)
-	if err != nil {
-		panic(err)
-	}
-	return addr
-}
-
-func asmInstr(codeSymbols, dataSymbols map[string]int64, instr string, addrMode string, operandA string, operandB string) []int64 {
-	opcode, ok := instructions[instr]
-	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
+		operands[i] = n
 	}
+	opA, opB := operands[0], operands[1]
 
-	opA := resolveOperand(codeSymbols, dataSymbols, operandA)
-	opB := resolveOperand(codeSymbols, dataSymbols, operandB)
-
-	switch addrMode {
+	switch stmt.AddrMode {
 	case "":
 	case "I":
 		opA = 0 - opA
@@ -244,41 +124,42 @@ func asmInstr(codeSymbols, dataSymbols map[string]int64, instr string, addrMode
 		opA = 0 - opA
 		opB = 0 - opB
 	default:
-		panic(fmt.Sprintf("unknown addressing mode: %s", addrMode))
+		return code, vm.NewAsmError(stmt.AddrModePos, stmt.AddrMode, "unknown addressing mode")
 	}
 
-	code := []int64{opcode, opA, opB}
-	return code
+	code = []int64{opcode, opA, opB}
+	return code, nil
 }
 
-func printCode(code []int64) {
-	fmt.Printf("\nCODE\n====")
-	for i, v := range code {
-		if i%10 == 0 {
-			fmt.Printf("\n%03d: ", i)
-		}
-		fmt.Printf("%4d ", v)
-	}
-	fmt.Printf("\n")
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
 }
 
-func printSymbols(symbols map[string]*big.Int) {
-	fmt.Printf("Symbols\n=======\n")
-	for k, v := range symbols {
-		fmt.Printf("%s: %d\n", k, v)
-	}
-	fmt.Printf("\n")
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func asm(filename string) ([]int64, []*big.Int, map[string]int64, map[string]int64, error) {
-	srcLines, err := readFile(filename)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, []*big.Int{}, map[string]int64{}, map[string]int64{}, err
+		return nil, err
 	}
-	codeSymbols, dataSymbols := pass1(srcLines)
-	code, data := pass2(srcLines, codeSymbols, dataSymbols)
-	//printSymbols(symbols)
-	//printCode(code)
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "bvm2"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
 
-	return code, data, codeSymbols, dataSymbols, nil
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
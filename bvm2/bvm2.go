@@ -11,30 +11,116 @@ package bvm2
 import (
 	"fmt"
 	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type VM2 struct {
-	code        [memSize]int64    // Code / Program
-	mem         [memSize]*big.Int // Memory
-	pc          int64             // Program Counter
-	hltVal      *big.Int          // A value returned by HLT
-	codeSymbols map[string]int64  // The code symbols table from the assembler - to aid debugging
-	dataSymbols map[string]int64  // The data symbols table from the assembler - to aid debugging
+	code    []int64     // Code / Program
+	mem     []*big.Int  // Memory
+	memSize int64       // Number of words of memory
+	pc      int64       // Program Counter
+	hltVal  *big.Int    // A value returned by HLT
+	word    vm.Word     // Width of words, results of arithmetic wrap to fit
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*VM2)(nil)
+
+// Option configures a VM2 when passed to New
+type Option func(*VM2)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *VM2) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *VM2) {
+		v.stats = vm.NewStats()
+	}
 }
 
-func New() *VM2 {
-	var mem [memSize]*big.Int
-	for i := 0; i < memSize; i++ {
-		mem[i] = big.NewInt(0)
+// WithWordSize sets the width of words, which is unbounded by default.
+// The results of ADD, SUB, DJNZ and SHL wrap around to fit.  Words
+// loaded from a routine are stored as they are so JNZ, SNE, SLE and JGT
+// wrap their operands before comparing them.
+func WithWordSize(w vm.Word) Option {
+	return func(v *VM2) {
+		v.word = w
+	}
+}
 
+func New(opts ...Option) *VM2 {
+	v := &VM2{memSize: defaultMemSize, hltVal: big.NewInt(0)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
 	}
-	return &VM2{mem: mem}
+	v.code = make([]int64, v.memSize)
+	v.mem = make([]*big.Int, v.memSize)
+	for i := range v.mem {
+		v.mem[i] = big.NewInt(0)
+	}
+	return v
 }
 
+// Step executes a single instruction
+// Returns: hlt, error
 func (v *VM2) Step() (bool, error) {
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *VM2) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of those operands that are in data memory
+func (v *VM2) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.code, v.pc, v.names)
+	opcode, operandA, operandB, err := v.fetch()
+	if err != nil {
+		return instr, nil
+	}
+	kinds := operandKinds[mnemonics[opcode]]
+	addrs := make([]int64, 0, 2)
+	for i, operand := range []int64{operandA, operandB} {
+		if kinds[i] == dataOperand {
+			addrs = append(addrs, operand)
+		}
+	}
+	return instr, addrs
+}
+
+// Registers returns the value of each register other than the PC, of
+// which there are none
+func (v *VM2) Registers() []vm.Register {
+	return nil
+}
+
+func (v *VM2) step() (bool, error) {
 	opcode, operandA, operandB, err := v.fetch()
 	if err != nil {
 		return false, err
@@ -42,38 +128,96 @@ func (v *VM2) Step() (bool, error) {
 	return v.execute(opcode, operandA, operandB)
 }
 
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
 func (v *VM2) Run() (bool, error) {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
 			return hlt, err
 		}
 	}
-	return hlt, err
 }
 
-func (v *VM2) Mem() [memSize]*big.Int {
+func (v *VM2) Mem() []*big.Int {
 	return v.mem
 }
 
-func (v *VM2) LoadRoutine(code []int64, data []*big.Int, codeSymbols, dataSymbols map[string]int64) {
-	// Need to copy the individual data points of the routine because they are pointers
-	for i, d := range data {
-		v.mem[i].Set(d)
+func (v *VM2) LoadRoutine(r *vm.Routine) error {
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine code too big for memory: %d", len(r.Code))
+	}
+	if int64(len(r.Data)) > v.memSize {
+		return fmt.Errorf("routine data too big for memory: %d", len(r.Data))
 	}
-	copy(v.code[:], code)
-	v.codeSymbols = codeSymbols
-	v.dataSymbols = dataSymbols
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
+}
+
+func (v *VM2) Reset() {
+	for i := range v.code {
+		v.code[i] = 0
+	}
+	for _, n := range v.mem {
+		n.SetInt64(0)
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.code[:], v.routine.Code)
+		// Need to copy the individual data points of the routine because they are pointers
+		for i, d := range v.routine.Data {
+			v.mem[i].Set(d)
+		}
+		v.pc = v.routine.Entry
+	}
+	v.hltVal = big.NewInt(0)
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *VM2) HltVal() *big.Int {
+	return new(big.Int).Set(v.hltVal)
+}
+
+func (v *VM2) PC() int64 {
+	return v.pc
+}
+
+func (v *VM2) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *VM2) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return new(big.Int).Set(v.mem[addr]), nil
+}
+
+func (v *VM2) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	v.word.WrapBig(v.mem[addr].Set(n))
+	return nil
 }
 
 // fetch gets the next instruction from memory
 // Returns: opcode, operandA, operandB
 // TODO: describe instruction format
 func (v *VM2) fetch() (int64, int64, int64, error) {
-	if v.pc+2 >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, v.pc+1)
+	if v.pc+2 >= v.memSize {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: v.pc + 2}
 	}
 	opcode := v.code[v.pc]
 	operandA := v.code[v.pc+1]
@@ -82,68 +226,40 @@ func (v *VM2) fetch() (int64, int64, int64, error) {
 	// If addressing mode: operand A indirect
 	if operandA < 0 {
 		operandA = -operandA
-		if operandA >= memSize {
-			return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandA)
+		if operandA >= v.memSize {
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandA}
 		}
 		iOperandA := v.mem[operandA]
 		if !iOperandA.IsInt64() {
-			return 0, 0, 0, fmt.Errorf("PC: %d, operand A not int64", v.pc)
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(iOperandA)}
 		}
 		operandA = iOperandA.Int64()
 	}
-	if operandA >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandA)
+	if operandA < 0 || operandA >= v.memSize {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandA}
 	}
 
 	// If addressing mode: operand B indirect
 	if operandB < 0 {
 		operandB = -operandB
-		if operandB >= memSize {
-			return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandB)
+		if operandB >= v.memSize {
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandB}
 		}
 		iOperandB := v.mem[operandB]
 		if !iOperandB.IsInt64() {
-			return 0, 0, 0, fmt.Errorf("PC: %d, operand B not int64", v.pc)
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(iOperandB)}
 		}
 		operandB = iOperandB.Int64()
 	}
-	if operandB >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandB)
+	if operandB < 0 || operandB >= v.memSize {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandB}
 	}
 	return opcode, operandA, operandB, nil
 }
 
-func (v *VM2) addr2symbol(addr int64, onlyCode ...bool) string {
-	if len(onlyCode) == 0 {
-		for k, v := range v.dataSymbols {
-			if v == addr {
-				return k
-			}
-		}
-	}
-
-	for k, v := range v.codeSymbols {
-		if v == addr {
-			return k
-		}
-	}
-	return fmt.Sprintf("%d", addr)
-}
-
-func (v *VM2) opcode2mnemonic(opcode int64) string {
-	for m, o := range instructions {
-		if o == opcode {
-			return m
-		}
-	}
-	panic("opcode not found")
-}
-
 // execute executes the supplied instruction
 // Returns: hlt, error
 func (v *VM2) execute(opcode int64, operandA int64, operandB int64) (bool, error) {
-	//fmt.Printf("%7s:    %s   %s, %s\n", v.addr2symbol(v.pc, true), v.opcode2mnemonic(opcode), v.addr2symbol(operandA), v.addr2symbol(operandB))
-	//fmt.Printf("            pre:  [%s]: %d, [%s]: %d\n", v.addr2symbol(operandA), v.mem[operandA], v.addr2symbol(operandB), v.mem[operandB])
 	var one = big.NewInt(1)
 	switch opcode {
 	case 0: // HLT
@@ -157,10 +273,10 @@ func (v *VM2) execute(opcode int64, operandA int64, operandB int64) (bool, error
 		v.mem[operandB] = big.NewInt(v.pc + 3)
 		v.pc = operandA
 	case 3: // ADD
-		v.mem[operandB].Add(v.mem[operandB], v.mem[operandA])
+		v.word.WrapBig(v.mem[operandB].Add(v.mem[operandB], v.mem[operandA]))
 		v.pc += 3
 	case 4: // DJNZ
-		v.mem[operandA].Sub(v.mem[operandA], one)
+		v.word.WrapBig(v.mem[operandA].Sub(v.mem[operandA], one))
 		if v.mem[operandA].Sign() != 0 {
 			v.pc = operandB
 		} else {
@@ -176,42 +292,41 @@ func (v *VM2) execute(opcode int64, operandA int64, operandB int64) (bool, error
 		v.pc += 3
 	case 8: // SHL
 		if !v.mem[operandA].IsUint64() {
-			return false, fmt.Errorf("PC: %d, mem[A] is not uint64", v.pc)
+			return false, &vm.InvalidOperand{PC: v.pc, Addr: operandA, Value: new(big.Int).Set(v.mem[operandA])}
 		}
-		v.mem[operandB].Lsh(v.mem[operandB], uint(v.mem[operandA].Uint64()))
+		v.word.WrapBig(v.mem[operandB].Lsh(v.mem[operandB], uint(v.mem[operandA].Uint64())))
 		v.pc += 3
 	case 9: // JNZ
-		if v.mem[operandA].Sign() != 0 {
+		if v.word.SignBig(v.mem[operandA]) != 0 {
 			v.pc = operandB
 		} else {
 			v.pc += 3
 		}
 	case 10: // SNE
-		if v.mem[operandA].Cmp(v.mem[operandB]) != 0 {
+		if v.word.CmpBig(v.mem[operandA], v.mem[operandB]) != 0 {
 			v.pc += 6
 		} else {
 			v.pc += 3
 		}
 	case 11: // SLE
-		if v.mem[operandA].Cmp(v.mem[operandB]) <= 0 {
+		if v.word.CmpBig(v.mem[operandA], v.mem[operandB]) <= 0 {
 			v.pc += 6
 		} else {
 			v.pc += 3
 		}
 	case 12: // SUB
-		v.mem[operandB].Sub(v.mem[operandB], v.mem[operandA])
+		v.word.WrapBig(v.mem[operandB].Sub(v.mem[operandB], v.mem[operandA]))
 		v.pc += 3
 	case 13: // JGT
-		if v.mem[operandA].Sign() == 1 {
+		if v.word.SignBig(v.mem[operandA]) > 0 {
 			v.pc = operandB
 		} else {
 			v.pc += 3
 		}
 
 	default:
-		return false, fmt.Errorf("unknown opcode: %d (%d)", opcode, (opcode&0x3f000000)>>24)
+		return false, &vm.InvalidOpcode{PC: v.pc, Addr: v.pc, Opcode: opcode}
 	}
 
-	//	fmt.Printf("            post:  [%s]: %d, [%s]: %d\n", v.addr2symbol(operandA), v.mem[operandA], v.addr2symbol(operandB), v.mem[operandB])
 	return false, nil
 }
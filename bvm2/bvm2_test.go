@@ -1,65 +1,328 @@
 package bvm2
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math/big"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var tests = []struct {
 	filename string
-	want     map[int64]int64 // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"add12_v1.asm", map[int64]int64{2: 4}},
-	{"and_v1.asm", map[int64]int64{4: 4499}},
-	{"tad_v1.asm", map[int64]int64{4: 32}},
-	{"isz_v1.asm", map[int64]int64{4: 9, 6: 24}},
-	{"jsr_v1.asm", map[int64]int64{2: 50}},
-	{"loopuntil_v1.asm", map[int64]int64{0: 5000}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"and_v1.asm", map[string]int64{"lac": 4499}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "tmp": 24}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
 	// TODO: reinstate subleq_v1?
-	//{"subleq_v1.asm", map[int64]int64{101: 5000}},
-	{"subleq_v2.asm", map[int64]int64{27: 5000}},
-	{"subleq_v3.asm", map[int64]int64{25: 5000}},
+	//{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v3.asm", map[string]int64{"sum": 5000}},
 	//TODO: reinstate switch_v1
-	//{"switch_v1.asm", map[int64]int64{44: 2255}},
-	{"switch_v2.asm", map[int64]int64{0: 2255}},
+	//{"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.filename, func(t *testing.T) {
-			code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(code, data, codeSymbols, dataSymbols)
-			_, err = v.Run()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = vm.RunLimit(context.Background(), v, maxTestSteps)
 			if err != nil {
-				t.Fatalf("Run() err: %v", err)
+				t.Fatalf("RunLimit() err: %v", err)
+			}
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("AssembleFile() err: %v", err)
+			}
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+			if len(got.Data) != len(want.Data) {
+				t.Fatalf("Data got: %v, want: %v", got.Data, want.Data)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			for i, n := range got.Data {
+				if n.Cmp(want.Data[i]) != 0 {
+					t.Errorf("Data[%d] got: %d, want: %d", i, n, want.Data[i])
 				}
 			}
+			if !reflect.DeepEqual(got.DataSymbols, want.DataSymbols) {
+				t.Errorf("DataSymbols got: %v, want: %v", got.DataSymbols, want.DataSymbols)
+			}
+		})
+	}
+}
+
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "MOV     l50 n", "[]", "[{0 0 50}]"},
+		{3, "JSR     setVal sret", "[]", "[{1 0 6}]"},
+		{9, "MOV     n val", "[]", "[{2 0 50}]"},
+		{12, "JMP     I sret", "[]", "[]"},
+		{6, "HLT     ok", "[]", "[]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	big70 := new(big.Int).Lsh(big.NewInt(1), 70)
+	cases := []struct {
+		name string
+		code []int64
+		data []*big.Int
+		want error
+	}{
+		{"invalid opcode", []int64{99, 0, 0}, nil,
+			&vm.InvalidOpcode{PC: 0, Addr: 0, Opcode: 99}},
+		{"outside memory", []int64{1, 40000, 0}, nil,
+			&vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"negative shift", []int64{8, 0, 1}, []*big.Int{big.NewInt(-1), big.NewInt(1)},
+			&vm.InvalidOperand{PC: 0, Addr: 0, Value: big.NewInt(-1)}},
+		{"shift too big", []int64{8, 0, 1}, []*big.Int{big70, big.NewInt(1)},
+			&vm.InvalidOperand{PC: 0, Addr: 0, Value: big70}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := New()
+			if err := v.LoadRoutine(&vm.Routine{Code: c.code, Data: c.data}); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err := v.Run()
+			if !reflect.DeepEqual(err, c.want) {
+				t.Errorf("Run() err got: %v, want: %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps:          5,
+		Opcodes:        map[string]int64{"HLT": 1, "JMP": 1, "JSR": 1, "MOV": 2},
+		Reads:          3,
+		Writes:         3,
+		Indirects:      1,
+		Taken:          2,
+		StackHighWater: map[string]int64{},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+}
+
+func TestWithWordSize(t *testing.T) {
+	// Adds 1 to r if neg <= zero and 2 to r if a+b > 0, then HLTs with r.
+	// neg is loaded as it is, beyond even 64 bits, so is only negative once
+	// signed by SLE.
+	src := "        SLE  neg zero\n" +
+		"        JMP  chk 0\n" +
+		"        ADD  l1 r\n" +
+		"chk:    ADD  b a\n" +
+		"        JGT  a pos\n" +
+		"        JMP  done 0\n" +
+		"pos:    ADD  l2 r\n" +
+		"done:   HLT  r 0\n" +
+		".data\n" +
+		"a:      2047\n" +
+		"b:      1\n" +
+		"neg:    1267650600228229401496703209471\n" + // 1<<100 + 4095
+		"zero:   0\n" +
+		"l1:     1\n" +
+		"l2:     2\n" +
+		"r:      0\n"
+	routine, err := AssembleString(src, vm.AsmOptions{})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	cases := []struct {
+		bits    uint
+		wantA   int64
+		wantHlt int64
+	}{
+		{0, 2048, 2},
+		{12, -2048, 1},
+		{16, 2048, 2},
+		{64, 2048, 2},
+	}
+	for _, c := range cases {
+		word := vm.MustWord(c.bits)
+		t.Run(word.String(), func(t *testing.T) {
+			v := New(WithWordSize(word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			a := v.mem[routine.DataSymbols["a"]].Int64()
+			if a != c.wantA {
+				t.Errorf("a got: %d, want: %d", a, c.wantA)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
+		})
+	}
+}
+
+func TestWithWordSizeCompare(t *testing.T) {
+	// big is stored as it is, so is only 0 once wrapped to fit a word.
+	// Adds 1 to r if SNE finds big the same as zero and 2 if JNZ finds
+	// big is 0, then HLTs with r.
+	src := "        SNE  big zero\n" +
+		"        ADD  l1 r\n" +
+		"        JNZ  big done\n" +
+		"        ADD  l2 r\n" +
+		"done:   HLT  r 0\n" +
+		".data\n" +
+		"big:    4096\n" +
+		"zero:   0\n" +
+		"l1:     1\n" +
+		"l2:     2\n" +
+		"r:      0\n"
+	routine, err := AssembleString(src, vm.AsmOptions{})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	cases := []struct {
+		bits    uint
+		wantHlt int64
+	}{
+		{0, 0},
+		{12, 3},
+		{16, 0},
+	}
+	for _, c := range cases {
+		word := vm.MustWord(c.bits)
+		t.Run(word.String(), func(t *testing.T) {
+			v := New(WithWordSize(word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
 		})
 	}
 }
 
 func BenchmarkRun(b *testing.B) {
 	for _, test := range tests {
-		code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(code, data, codeSymbols, dataSymbols)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
 				_, err = v.Run()
@@ -68,13 +331,52 @@ func BenchmarkRun(b *testing.B) {
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(code)+len(data))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := Save(buf, routine); err != nil {
+		t.Fatalf("Save() err: %v", err)
+	}
+	loaded, err := Load(buf)
+	if err != nil {
+		t.Fatalf("Load() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(loaded); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	if v.mem[2].Cmp(big.NewInt(50)) != 0 {
+		t.Errorf("mem[2] got: %d, want: 50", v.mem[2])
 	}
 }
@@ -0,0 +1,68 @@
+/*
+ * Counting what is executed for Stats
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package bvm2
+
+import "github.com/lawrencewoodman/go-vmcomparison/vm"
+
+// opInfo describes each instruction for the stats, keyed by opcode
+var opInfo = make(map[int64]vm.OpInfo, len(instructions))
+
+func init() {
+	for _, op := range []vm.OpInfo{
+		{Mnemonic: "HLT", Reads: 1},
+		{Mnemonic: "MOV", Reads: 1, Writes: 1},
+		{Mnemonic: "JSR", Writes: 1, Branch: true},
+		{Mnemonic: "ADD", Reads: 2, Writes: 1},
+		{Mnemonic: "DJNZ", Reads: 1, Writes: 1, Branch: true},
+		{Mnemonic: "JMP", Branch: true},
+		{Mnemonic: "AND", Reads: 2, Writes: 1},
+		{Mnemonic: "OR", Reads: 2, Writes: 1},
+		{Mnemonic: "SHL", Reads: 2, Writes: 1},
+		{Mnemonic: "JNZ", Reads: 1, Branch: true},
+		{Mnemonic: "SNE", Reads: 2, Branch: true},
+		{Mnemonic: "SLE", Reads: 2, Branch: true},
+		{Mnemonic: "SUB", Reads: 2, Writes: 1},
+		{Mnemonic: "JGT", Reads: 1, Branch: true},
+	} {
+		opInfo[instructions[op.Mnemonic]] = op
+	}
+}
+
+// Stats returns the counts since the last reset or nil if they haven't
+// been turned on with WithStats
+func (v *VM2) Stats() *vm.Stats {
+	return v.stats
+}
+
+// countStep executes an instruction and records it in the stats
+// Returns: hlt, error
+func (v *VM2) countStep() (bool, error) {
+	pc := v.pc
+	var op vm.OpInfo
+	var indirects int64
+	if pc >= 0 && pc+2 < int64(len(v.code)) {
+		op = opInfo[v.code[pc]]
+		for _, operand := range v.code[pc+1 : pc+3] {
+			if operand < 0 {
+				indirects++
+			}
+		}
+	}
+	var hlt bool
+	var err error
+	if v.tracer != nil {
+		hlt, err = vm.TraceStep(v.tracer, v, v.step)
+	} else {
+		hlt, err = v.step()
+	}
+	if err == nil {
+		v.stats.Record(op, indirects, v.pc != pc+3)
+	}
+	return hlt, err
+}
@@ -9,12 +9,13 @@
 package bvmstack
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"math/big"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]int64{
@@ -42,212 +43,122 @@ var instructions = map[string]int64{
 	"OVER":  24 << 24,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
+var syntax = &asm.Syntax{IsMnemonic: isMnemonic, SplitData: true}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
+}
 
-	sc := bufio.NewScanner(f)
+// encoder implements asm.Encoder
+type encoder struct{}
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	isInstr := stmt.Mnemonic != ""
+	if isInstr == (seg == asm.CodeSegment) {
+		return 1
 	}
+	return 0
+}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if stmt.Mnemonic == "" {
+		return asmData(seg, syms, stmt)
+	}
+	if seg != asm.CodeSegment {
+		return nil, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "instruction inside .data")
 	}
-	return lines, nil
+	instrCode, err := asmInstr(syms, stmt)
+	return asm.Words(instrCode), err
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s*`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+)\s*`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+)\s*`)
-var reSymbol = regexp.MustCompile(`^\s*!([a-zA-Z][0-9a-zA-Z]*).*`)
-var reDirective = regexp.MustCompile(`^\.([a-zA-Z]+)$`)
-var reComment = regexp.MustCompile(`^\s*(;.*)$`)
-
-// pass1 returns code and data symbol tables
-func pass1(srcLines []string) (map[string]int64, map[string]int64) {
-	symbolType := "c"
-	var dataPos int64 = 0
-	var codePos int64 = 0
-	codeSymbols := make(map[string]int64, 0)
-	dataSymbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				symbolType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			if symbolType == "c" {
-				codeSymbols[label] = codePos
-			} else {
-				dataSymbols[label] = dataPos
-			}
-			line = line[matchIndices[1]:]
+// asmData assembles a literal value or a symbol in the form: !symbol
+func asmData(seg asm.Segment, syms *asm.Symbols, stmt *asm.Stmt) ([]*big.Int, error) {
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return nil, err
+	}
+	operand := stmt.Operands[0]
+	switch operand.Kind {
+	case asm.Literal:
+		if seg != asm.DataSegment {
+			return nil, vm.NewAsmError(operand.Pos, operand.Text, "literal outside of .data")
 		}
-
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			codePos++
-			continue
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			dataPos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			dataPos++
+		n, err := syms.Eval(operand)
+		return []*big.Int{n}, err
+	case asm.AddrOf:
+		if seg != asm.DataSegment {
+			return nil, vm.NewAsmError(operand.X.Pos, operand.X.Text, "symbol outside of .data")
 		}
+		n, err := syms.Eval(operand.X)
+		return []*big.Int{n}, err
+	case asm.Symbol:
+		// Without a '!' a symbol is taken to be an instruction
+		return nil, vm.NewAsmError(operand.Pos, operand.Text, "unknown instruction")
 	}
-	return codeSymbols, dataSymbols
+	return nil, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func pass2(srcLines []string, codeSymbols, dataSymbols map[string]int64) ([]int64, []*big.Int) {
-	outputType := "c"
-	code := make([]int64, 0)
-	data := make([]*big.Int, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				outputType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-
-			operand := ""
-			if reOperand.MatchString(line) {
-				operand = reOperand.FindStringSubmatch(line)[1]
-				matchIndices := reOperand.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-
-			if reComment.MatchString(line) {
-				matchIndices := reComment.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(codeSymbols, dataSymbols, instr, operand))
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			num, ok := new(big.Int).SetString(lit, 10)
-			if !ok {
-				panic("can't create literal value")
-			}
-			if outputType == "d" {
-				data = append(data, num)
-			} else {
-				panic("literal shouldn't appear here")
-			}
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			addr, err := resolveSymbol(codeSymbols, dataSymbols, sym)
-			if err != nil {
-				panic(err)
-			}
-			if outputType == "d" {
-				data = append(data, big.NewInt(addr))
-			} else {
-				panic("symbol shouldn't appear here")
-			}
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return syms.EvalInt64(operand)
+	case asm.Symbol:
+		if v, ok := syms.Lookup(operand.Name); ok {
+			return v, nil
 		}
 	}
-	return code, data
+	return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func resolveSymbol(codeSymbols, dataSymbols map[string]int64, sym string) (int64, error) {
-	v, ok := codeSymbols[sym]
+// The operand is added to the opcode and is 0 if missing
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) (int64, error) {
+	opcode, ok := instructions[stmt.Mnemonic]
 	if !ok {
-		v, ok = dataSymbols[sym]
-		if !ok {
-			return v, fmt.Errorf("unknown symbol: %s", sym)
-		}
+		return 0, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
 	}
-	return v, nil
-}
-
-func resolveOperand(codeSymbols, dataSymbols map[string]int64, operand string) int64 {
-	if operand == "" {
-		return 0
+	if err := stmt.CheckOperands(0, 1); err != nil {
+		return opcode, err
 	}
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		addr, err := strconv.ParseInt(operand, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		return addr
+	if len(stmt.Operands) == 0 {
+		return opcode, nil
 	}
-	addr, err := resolveSymbol(codeSymbols, dataSymbols, operand)
+
+	n, err := resolveOperand(syms, stmt.Operands[0])
 	if err != nil {
-		panic(err)
+		return opcode, err
 	}
-	return addr
+	return opcode + n, nil
 }
 
-func asmInstr(codeSymbols, dataSymbols map[string]int64, instr string, operand string) int64 {
-	opcode, ok := instructions[instr]
-	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
-	}
-
-	code := opcode + resolveOperand(codeSymbols, dataSymbols, operand)
-	return code
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
 }
 
-func printSymbols(codeSymbols, dataSymbols map[string]int64) {
-	fmt.Printf("Symbols\n=======\n\ncode:\n")
-	for k, v := range codeSymbols {
-		fmt.Printf("  %s: %d\n", k, v)
-	}
-	fmt.Printf("\ndata:\n")
-	for k, v := range dataSymbols {
-		fmt.Printf("  %s: %d\n", k, v)
-	}
-	fmt.Printf("\n")
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func asm(filename string) ([]int64, []*big.Int, map[string]int64, map[string]int64, error) {
-	srcLines, err := readFile(filename)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, []*big.Int{}, map[string]int64{}, map[string]int64{}, err
+		return nil, err
 	}
-	codeSymbols, dataSymbols := pass1(srcLines)
-	code, data := pass2(srcLines, codeSymbols, dataSymbols)
-	//printSymbols(codeSymbols, dataSymbols)
-	//fmt.Printf("%v\n", code)
-	return code, data, codeSymbols, dataSymbols, nil
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "bvmstack"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
+
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
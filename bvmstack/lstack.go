@@ -1,7 +1,7 @@
 /*
- * A limited stack - It will keep pushing and popping but won't error of it
- * reaches the beginning or end of the stack instead it will just keep
- * acting on the same position in the stack.  Uses Big numbers.
+ * A limited stack - If an operation would go beyond the beginning or end
+ * of the stack it is ignored and a fault is recorded for the VM to report.
+ * Uses Big numbers.
  *
  * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
  *
@@ -9,29 +9,45 @@
  */
 package bvmstack
 
-import "math/big"
+import (
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
 
 // 8 element limited stack
 type LStack struct {
 	// Using 8 as on some platforms AND mask may be quicker than
 	// condition
-	stack [8]*big.Int
-	sp    int
+	stack   [8]*big.Int
+	sp      int
+	fault   stackFault // Set by the first operation that fails
+	faultSP int        // The stack pointer when the fault occurred
 }
 
+// stackFault records why an operation on a stack failed
+type stackFault int
+
+const (
+	noFault stackFault = iota
+	overflow
+	underflow
+)
+
 func NewLStack() *LStack {
 	return &LStack{}
 }
 
+// pop returns TOS, or a new 0 if the stack is empty so that the caller
+// can use it before the fault is looked for
 // TODO: research best to decrement then get or otherway around
 func (s *LStack) pop() *big.Int {
-	ts := s.stack[s.sp]
-
-	if s.sp > 0 {
-		s.sp--
-	} else {
-		panic("stack empty")
+	if s.sp == 0 {
+		s.setFault(underflow)
+		return new(big.Int)
 	}
+	ts := s.stack[s.sp]
+	s.sp--
 	return ts
 }
 
@@ -39,14 +55,20 @@ func (s *LStack) push(n *big.Int) {
 	if s.sp < 7 {
 		s.sp++
 	} else {
-		panic("stack full")
+		s.setFault(overflow)
+		return
 	}
 	s.stack[s.sp] = big.NewInt(0).Set(n)
 	// NOTE: keep sp at TOS so the we can use peek and replace
 }
 
+// peek returns TOS, or a new 0 if the stack is empty as pop does
 // TODO: check name
 func (s *LStack) peek() *big.Int {
+	if s.sp == 0 {
+		s.setFault(underflow)
+		return new(big.Int)
+	}
 	return s.stack[s.sp]
 }
 
@@ -54,33 +76,35 @@ func (s *LStack) drop() {
 	if s.sp > 0 {
 		s.sp--
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 func (s *LStack) dup() {
-	if s.sp < 7 {
+	if s.sp == 0 {
+		s.setFault(underflow)
+	} else if s.sp < 7 {
 		s.stack[s.sp+1] = big.NewInt(0).Set(s.stack[s.sp])
 		s.sp++
 	} else {
-		panic("stack full")
+		s.setFault(overflow)
 	}
 
 }
 
 func (s *LStack) swap() {
-	if s.sp >= 1 {
+	if s.sp >= 2 {
 		a := s.stack[s.sp-1]
 		b := s.stack[s.sp]
 		s.stack[s.sp-1] = b
 		s.stack[s.sp] = a
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 func (s *LStack) over() {
-	if s.sp >= 1 {
+	if s.sp >= 2 {
 		if s.sp < 7 {
 			a := s.stack[s.sp-1]
 			b := s.stack[s.sp]
@@ -90,16 +114,16 @@ func (s *LStack) over() {
 			s.stack[s.sp+1] = big.NewInt(0).Set(a)
 			s.sp++
 		} else {
-			panic("stack full")
+			s.setFault(overflow)
 		}
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 // rot (a b c -- b c a)
 func (s *LStack) rot() {
-	if s.sp >= 2 {
+	if s.sp >= 3 {
 		a := s.stack[s.sp-2]
 		b := s.stack[s.sp-1]
 		c := s.stack[s.sp]
@@ -108,7 +132,7 @@ func (s *LStack) rot() {
 		s.stack[s.sp-1] = c
 		s.stack[s.sp] = a
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
@@ -119,3 +143,45 @@ func (s *LStack) nos() string {
 	}
 	return s.stack[s.sp-1].String()
 }
+
+// depth returns the number of items on the stack
+func (s *LStack) depth() int {
+	return s.sp
+}
+
+// nth returns a copy of the nth item from the top of the stack, where 0
+// is TOS, or 0 if there aren't enough items
+func (s *LStack) nth(n int) *big.Int {
+	if n < 0 || n >= s.sp || s.stack[s.sp-n] == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(s.stack[s.sp-n])
+}
+
+// items returns the items on the stack with TOS first
+func (s *LStack) items() []*big.Int {
+	items := make([]*big.Int, s.depth())
+	for i := range items {
+		items[i] = s.nth(i)
+	}
+	return items
+}
+
+func (s *LStack) setFault(fault stackFault) {
+	if s.fault == noFault {
+		s.fault = fault
+		s.faultSP = s.sp
+	}
+}
+
+// err returns the fault recorded, if any, as an error for the
+// instruction at pc
+func (s *LStack) err(pc int64, name string) error {
+	switch s.fault {
+	case overflow:
+		return &vm.StackOverflow{PC: pc, Addr: int64(s.faultSP), Stack: name}
+	case underflow:
+		return &vm.StackUnderflow{PC: pc, Addr: int64(s.faultSP), Stack: name}
+	}
+	return nil
+}
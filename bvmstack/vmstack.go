@@ -12,101 +12,258 @@ package bvmstack
 import (
 	"fmt"
 	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type VMStack struct {
-	code   [memSize]int64    // Code / Program
-	mem    [memSize]*big.Int // Memory
-	pc     int64             // Program Counter
-	dstack *LStack           // 8 element limited data stack
+	code     []int64    // Code / Program
+	mem      []*big.Int // Memory
+	memSize  int64      // Number of words of memory
+	bmemSize *big.Int   // memSize as a big number for comparisons
+	pc       int64      // Program Counter
+	dstack   *LStack    // 8 element limited data stack
 	// stack  *CStack // 8 element circular data stack
-	rstack      *LStack          // 8 element limited return
-	hltVal      *big.Int         // A value returned by HLT
-	codeSymbols map[string]int64 // The code symbols table from the assembler - to aid debugging
-	dataSymbols map[string]int64 // The data symbols table from the assembler - to aid debugging
+	rstack  *LStack     // 8 element limited return
+	hltVal  *big.Int    // A value returned by HLT
+	word    vm.Word     // Width of words, results of arithmetic wrap to fit
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*VMStack)(nil)
+var _ vm.StackInspector = (*VMStack)(nil)
+
+// Option configures a VMStack when passed to New
+type Option func(*VMStack)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *VMStack) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *VMStack) {
+		v.stats = vm.NewStats()
+	}
 }
 
-func New() *VMStack {
-	var mem [memSize]*big.Int
-	for i := 0; i < memSize; i++ {
-		mem[i] = big.NewInt(0)
+// WithWordSize sets the width of words, which is unbounded by default.
+// The results of ADD, SUB, INC, DJNZ and SHL wrap around to fit.  Words
+// loaded from a routine and the operands of LIT are stored as they are
+// so JNZ, JZ and JGT wrap the value before comparing it.
+func WithWordSize(w vm.Word) Option {
+	return func(v *VMStack) {
+		v.word = w
+	}
+}
 
+func New(opts ...Option) *VMStack {
+	v := &VMStack{memSize: defaultMemSize, dstack: NewLStack(), rstack: NewLStack(), hltVal: big.NewInt(0)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
 	}
-	return &VMStack{mem: mem, dstack: NewLStack(), rstack: NewLStack()}
-	// return &VMStack2{stack: NewCStack()}
+	v.code = make([]int64, v.memSize)
+	v.bmemSize = big.NewInt(v.memSize)
+	v.mem = make([]*big.Int, v.memSize)
+	for i := range v.mem {
+		v.mem[i] = big.NewInt(0)
+	}
+	return v
 }
 
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
 func (v *VMStack) Run() (bool, error) {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
 			return hlt, err
 		}
 	}
-	return hlt, err
 }
 
-func (v *VMStack) Mem() [memSize]*big.Int {
+func (v *VMStack) Mem() []*big.Int {
 	return v.mem
 }
 
-func (v *VMStack) LoadRoutine(code []int64, data []*big.Int, codeSymbols, dataSymbols map[string]int64) {
-	// Need to copy the individual data points of the routine because they are pointers
-	for i, d := range data {
-		v.mem[i].Set(d)
+func (v *VMStack) LoadRoutine(r *vm.Routine) error {
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine code too big for memory: %d", len(r.Code))
+	}
+	if int64(len(r.Data)) > v.memSize {
+		return fmt.Errorf("routine data too big for memory: %d", len(r.Data))
 	}
-	copy(v.code[:], code)
-	v.codeSymbols = codeSymbols
-	v.dataSymbols = dataSymbols
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
 }
 
-func (v *VMStack) addr2symbol(addr int64, onlyCode ...bool) string {
-	if len(onlyCode) == 0 {
-		for k, v := range v.dataSymbols {
-			if v == addr && addr != 0 {
-				return k
-			}
+func (v *VMStack) Reset() {
+	for i := range v.code {
+		v.code[i] = 0
+	}
+	for _, n := range v.mem {
+		n.SetInt64(0)
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.code[:], v.routine.Code)
+		// Need to copy the individual data points of the routine because they are pointers
+		for i, d := range v.routine.Data {
+			v.mem[i].Set(d)
 		}
+		v.pc = v.routine.Entry
+	}
+	v.dstack = NewLStack()
+	v.rstack = NewLStack()
+	v.hltVal = big.NewInt(0)
+	if v.stats != nil {
+		v.stats = vm.NewStats()
 	}
+}
 
-	for k, v := range v.codeSymbols {
-		if v == addr {
-			return k
-		}
+func (v *VMStack) HltVal() *big.Int {
+	return new(big.Int).Set(v.hltVal)
+}
+
+func (v *VMStack) PC() int64 {
+	return v.pc
+}
+
+func (v *VMStack) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *VMStack) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
 	}
-	return fmt.Sprintf("%d", addr)
+	return new(big.Int).Set(v.mem[addr]), nil
 }
 
-func (v *VMStack) opcode2mnemonic(opcode int64) string {
-	for m, o := range instructions {
-		if o == opcode {
-			return m
-		}
+func (v *VMStack) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
 	}
-	panic("opcode not found")
+	v.word.WrapBig(v.mem[addr].Set(n))
+	return nil
 }
 
 var zero = big.NewInt(0)
 var one = big.NewInt(1)
 
-// TODO: Enforce memSize  being int64
-var bmemSize = big.NewInt(memSize)
-
+// Step executes a single instruction
 // Returns: hlt, error
 func (v *VMStack) Step() (bool, error) {
-	if v.pc >= memSize {
-		return false, fmt.Errorf("outside memory range: %d", v.pc)
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *VMStack) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of the memory it accesses
+func (v *VMStack) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.code, v.pc, v.names)
+	if v.pc < 0 || v.pc >= v.memSize {
+		return instr, nil
 	}
 	ir := v.code[v.pc]
 	opcode := (ir & 0xFF000000)
 	operand := (ir & 0x00FFFFFF)
 
-	//fmt.Printf("%6s: %5s %-7s   (%5s %5d -- ", v.addr2symbol(v.pc, true), v.opcode2mnemonic(opcode), v.addr2symbol(operand), v.dstack.nos(), v.dstack.peek())
+	// Take account of the operand being pushed on to the stack
+	nth := func(n int) int64 {
+		if operand > 0 {
+			if n == 0 {
+				return operand
+			}
+			n--
+		}
+		item := v.dstack.nth(n)
+		if !item.IsInt64() {
+			return -1
+		}
+		return item.Int64()
+	}
+	switch opcode {
+	case 1 << 24, 2 << 24: // FETCH, STORE
+		return instr, []int64{nth(0)}
+	case 14 << 24, 15 << 24: // FETCHBI, ADDBI
+		return instr, []int64{nth(0) + nth(1)}
+	case 16 << 24: // FETCHI
+		addr := nth(0)
+		if n, err := v.ReadMem(addr); err == nil && n.IsInt64() {
+			return instr, []int64{addr, n.Int64()}
+		}
+		return instr, []int64{addr}
+	}
+	return instr, nil
+}
+
+// Registers returns the depth of the stacks and the top items of them
+func (v *VMStack) Registers() []vm.Register {
+	return []vm.Register{
+		{Name: "dsp", Value: big.NewInt(int64(v.dstack.depth()))},
+		{Name: "tos", Value: v.dstack.nth(0)},
+		{Name: "nos", Value: v.dstack.nth(1)},
+		{Name: "rsp", Value: big.NewInt(int64(v.rstack.depth()))},
+		{Name: "rtos", Value: v.rstack.nth(0)},
+	}
+}
+
+// Stacks returns the contents of the data and return stacks
+func (v *VMStack) Stacks() []vm.Stack {
+	return []vm.Stack{
+		{Name: "data", Items: v.dstack.items()},
+		{Name: "return", Items: v.rstack.items()},
+	}
+}
+
+// step executes the instruction at the PC.  Stack faults are recorded by
+// the stacks as they happen and are only looked for once the instruction
+// has been executed, as checking after every stack operation would slow
+// execution too much.
+// Returns: hlt, error
+func (v *VMStack) step() (bool, error) {
+	pc := v.pc
+	if v.pc < 0 || v.pc >= v.memSize {
+		return false, &vm.MemoryFault{PC: v.pc, Addr: v.pc}
+	}
+	ir := v.code[v.pc]
+	opcode := (ir & 0xFF000000)
+	operand := (ir & 0x00FFFFFF)
 
 	if operand > 0 {
 		v.dstack.push(big.NewInt(operand))
@@ -115,32 +272,35 @@ func (v *VMStack) Step() (bool, error) {
 	switch opcode {
 	case 0 << 24: // HLT
 		v.hltVal = v.dstack.pop()
+		if v.dstack.fault != noFault {
+			return false, v.dstack.err(pc, "data")
+		}
 		return true, nil
 	case 1 << 24: // FETCH
 		addr := v.dstack.peek()
-		// if addr > memSize
-		if addr.Cmp(bmemSize) >= 0 {
-			return false, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, addr)
+		// if addr < 0 or addr >= memSize
+		if addr.Sign() < 0 || addr.Cmp(v.bmemSize) >= 0 {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 		}
 		addr.Set(v.mem[addr.Int64()])
 		v.pc++
 	case 2 << 24: // STORE (n addr --)
 		addr := v.dstack.pop()
-		// if addr > memSize
-		if addr.Cmp(bmemSize) >= 0 {
-			return false, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, addr)
+		// if addr < 0 or addr >= memSize
+		if addr.Sign() < 0 || addr.Cmp(v.bmemSize) >= 0 {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 		}
 		v.mem[addr.Int64()] = v.dstack.pop()
 		v.pc++
 	case 3 << 24: // ADD
 		a := v.dstack.pop()
 		b := v.dstack.peek()
-		b.Add(a, b)
+		v.word.WrapBig(b.Add(a, b))
 		v.pc++
 	case 4 << 24: // SUB (a b -- a-b)
 		b := v.dstack.pop()
 		a := v.dstack.peek()
-		a.Sub(a, b)
+		v.word.WrapBig(a.Sub(a, b))
 		v.pc++
 	case 5 << 24: // AND
 		a := v.dstack.pop()
@@ -149,14 +309,14 @@ func (v *VMStack) Step() (bool, error) {
 		v.pc++
 	case 6 << 24: // INC
 		a := v.dstack.peek()
-		a.Add(a, one)
+		v.word.WrapBig(a.Add(a, one))
 		v.pc++
 	case 7 << 24: // JNZ (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val.Sign() != 0 {
+		if v.word.SignBig(val) != 0 {
 			if !addr.IsInt64() {
-				panic("address is not in64")
+				return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 			}
 			v.pc = addr.Int64()
 		} else {
@@ -165,10 +325,10 @@ func (v *VMStack) Step() (bool, error) {
 	case 8 << 24: // DJNZ - (val addr -- val) - Decrement and Jump if not Zero
 		addr := v.dstack.pop()
 		val := v.dstack.peek()
-		val.Sub(val, one)
+		v.word.WrapBig(val.Sub(val, one))
 		if val.Sign() != 0 {
 			if !addr.IsInt64() {
-				panic("address is not in64")
+				return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 			}
 
 			v.pc = addr.Int64()
@@ -178,13 +338,13 @@ func (v *VMStack) Step() (bool, error) {
 	case 9 << 24: // JMP
 		addr := v.dstack.pop()
 		if !addr.IsInt64() {
-			panic("address is not in64")
+			return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 		}
 		v.pc = addr.Int64()
 	case 10 << 24: // SHL
 		// TODO: Be able to supply number of bits to shift on stack?
 		a := v.dstack.peek()
-		a.Lsh(a, 1)
+		v.word.WrapBig(a.Lsh(a, 1))
 		v.pc++
 	case 11 << 24: // LIT - Put the 24-bit operand on the stack
 		if operand == 0 {
@@ -204,13 +364,13 @@ func (v *VMStack) Step() (bool, error) {
 		v.rstack.push(pc.Add(pc, one))
 		addr := v.dstack.pop()
 		if !addr.IsInt64() {
-			panic("address is not in64")
+			return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 		}
 		v.pc = addr.Int64()
 	case 18 << 24: // RET
 		addr := v.rstack.pop()
 		if !addr.IsInt64() {
-			panic("address is not in64")
+			return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 		}
 		v.pc = addr.Int64()
 	case 19 << 24: // DUP
@@ -225,9 +385,9 @@ func (v *VMStack) Step() (bool, error) {
 	case 21 << 24: // JZ (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val.Sign() == 0 {
+		if v.word.SignBig(val) == 0 {
 			if !addr.IsInt64() {
-				panic("address is not in64")
+				return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 			}
 			v.pc = addr.Int64()
 		} else {
@@ -236,9 +396,9 @@ func (v *VMStack) Step() (bool, error) {
 	case 22 << 24: // JGT (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val.Sign() > 0 {
+		if v.word.SignBig(val) > 0 {
 			if !addr.IsInt64() {
-				panic("address is not in64")
+				return false, &vm.MemoryFault{PC: v.pc, Addr: vm.BigAddr(addr)}
 			}
 
 			v.pc = addr.Int64()
@@ -252,9 +412,20 @@ func (v *VMStack) Step() (bool, error) {
 		v.dstack.over()
 		v.pc++
 	default:
-		panic("unknown opcode")
+		return false, &vm.InvalidOpcode{PC: v.pc, Addr: v.pc, Opcode: opcode >> 24}
 	}
 
-	//fmt.Printf("%5s %5d)\n", v.dstack.nos(), v.dstack.peek())
+	if v.dstack.fault != noFault || v.rstack.fault != noFault {
+		return false, v.stackErr(pc)
+	}
 	return false, nil
 }
+
+// stackErr returns the fault recorded by either stack as an error for the
+// instruction at pc
+func (v *VMStack) stackErr(pc int64) error {
+	if err := v.dstack.err(pc, "data"); err != nil {
+		return err
+	}
+	return v.rstack.err(pc, "return")
+}
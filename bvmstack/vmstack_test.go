@@ -1,67 +1,250 @@
 package bvmstack
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var tests = []struct {
 	filename string
-	want     map[int64]int64 // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"add12_v1.asm", map[int64]int64{2: 4}},
-	{"and_v1.asm", map[int64]int64{3: 4499}},
-	{"tad_v1.asm", map[int64]int64{3: 32}},
-	{"isz_v1.asm", map[int64]int64{3: 9, 4: 24}},
-	{"isz_v2.asm", map[int64]int64{3: 9, 4: 24}},
-	{"isz_v3.asm", map[int64]int64{3: 9, 4: 24}},
-	{"jsr_v1.asm", map[int64]int64{1: 50}},
-	{"loopuntil_v1.asm", map[int64]int64{1: 5000}},
-	{"loopuntil_v2.asm", map[int64]int64{1: 5000}},
-	{"subleq_v1.asm", map[int64]int64{21: 5000}},
-	{"subleq_v2.asm", map[int64]int64{21: 5000}},
-	{"subleq_v3.asm", map[int64]int64{21: 5000}},
-	{"switch_v1.asm", map[int64]int64{2: 2255}},
-	{"switch_v2.asm", map[int64]int64{2: 2255}},
-	{"switch_v3.asm", map[int64]int64{10: 2255}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"and_v1.asm", map[string]int64{"lac": 4499}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"isz_v2.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"isz_v3.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
+	{"loopuntil_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v3.asm", map[string]int64{"sum": 5000}},
+	{"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
+	{"switch_v3.asm", map[string]int64{"lac": 2255}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.filename, func(t *testing.T) {
-			code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(code, data, codeSymbols, dataSymbols)
-			_, err = v.Run()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = vm.RunLimit(context.Background(), v, maxTestSteps)
+			if err != nil {
+				t.Fatalf("RunLimit() err: %v", err)
+			}
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("Run() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+			if len(got.Data) != len(want.Data) {
+				t.Fatalf("Data got: %v, want: %v", got.Data, want.Data)
+			}
+			for i, n := range got.Data {
+				if n.Cmp(want.Data[i]) != 0 {
+					t.Errorf("Data[%d] got: %d, want: %d", i, n, want.Data[i])
 				}
 			}
+			if !reflect.DeepEqual(got.DataSymbols, want.DataSymbols) {
+				t.Errorf("DataSymbols got: %v, want: %v", got.DataSymbols, want.DataSymbols)
+			}
 		})
 	}
 }
 
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "LIT     50", "[{dsp 0 1} {tos 0 50}]", "[]"},
+		{1, "JSR     setVal", "[{rsp 0 1} {rtos 0 2}]", "[]"},
+		{3, "STORE   val", "[{dsp 1 0} {tos 50 0}]", "[{1 0 50}]"},
+		{4, "RET", "[{rsp 1 0} {rtos 2 0}]", "[]"},
+		{2, "HLT     1", "[]", "[]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want error
+	}{
+		{"data stack underflow", "DROP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack overflow", strings.Repeat("LIT 1\n", 8),
+			&vm.StackOverflow{PC: 7, Addr: 7, Stack: "data"}},
+		{"return stack underflow", "RET\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "return"}},
+		{"data stack underflow on add", "ADD\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack underflow on peek", "FETCH\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack underflow on dup", "DUP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack underflow on swap", "LIT 1\nSWAP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 1, Addr: 1, Stack: "data"}},
+		{"outside memory", "FETCH 40000\n",
+			&vm.MemoryFault{PC: 0, Addr: 40000}},
+		// An operand of 0 isn't pushed so neg mustn't be at 0
+		{"negative PC", "FETCH neg\nJMP\n.data\npad: 0\nneg: -5\n",
+			&vm.MemoryFault{PC: -5, Addr: -5}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			routine, err := AssembleString(c.src, vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v", err)
+			}
+			v := New()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = v.Run()
+			if !reflect.DeepEqual(err, c.want) {
+				t.Errorf("Run() err got: %v, want: %v", err, c.want)
+			}
+		})
+	}
+
+	v := New()
+	if err := v.LoadRoutine(&vm.Routine{Code: []int64{99 << 24}}); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	want := &vm.InvalidOpcode{PC: 0, Addr: 0, Opcode: 99}
+	if _, err := v.Run(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Run() err got: %v, want: %v", err, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps:          5,
+		Opcodes:        map[string]int64{"HLT": 1, "JSR": 1, "LIT": 1, "RET": 1, "STORE": 1},
+		Writes:         1,
+		Taken:          2,
+		StackHighWater: map[string]int64{"data": 2, "return": 1},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+}
+
 func BenchmarkRun(b *testing.B) {
 	for _, test := range tests {
-		code, data, codeSymbols, dataSymbols, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(code, data, codeSymbols, dataSymbols)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
 				_, err = v.Run()
@@ -70,13 +253,27 @@ func BenchmarkRun(b *testing.B) {
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc].Cmp(big.NewInt(wantValue)) != 0 {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr].Cmp(big.NewInt(wantValue)) != 0 {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(code)+len(data))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
 	}
 }
@@ -0,0 +1,138 @@
+/*
+ * Comparing the results of two benchmark runs
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// comparison lines up the old and new results of a benchmark, either
+// of which may be nil if the benchmark is only in one of the files
+type comparison struct {
+	pkg      string
+	name     string
+	stubName string
+	old      *stat
+	new      *stat
+}
+
+// compare lines up oldStats and newStats by pkg and test name, sorted
+// by stub name and then pkg
+func compare(oldStats, newStats []stat) []comparison {
+	var comps []comparison
+	index := make(map[string]int)
+	add := func(s *stat, isNew bool) {
+		key := s.pkg + "/" + s.name
+		i, ok := index[key]
+		if !ok {
+			i = len(comps)
+			index[key] = i
+			comps = append(comps, comparison{pkg: s.pkg, name: s.name, stubName: s.stubName})
+		}
+		if isNew {
+			comps[i].new = s
+		} else {
+			comps[i].old = s
+		}
+	}
+	for i := range oldStats {
+		add(&oldStats[i], false)
+	}
+	for i := range newStats {
+		add(&newStats[i], true)
+	}
+	sort.SliceStable(comps, func(i, j int) bool {
+		if comps[i].stubName != comps[j].stubName {
+			return comps[i].stubName < comps[j].stubName
+		}
+		if comps[i].pkg != comps[j].pkg {
+			return comps[i].pkg < comps[j].pkg
+		}
+		return comps[i].name < comps[j].name
+	})
+	return comps
+}
+
+// significance returns a marker for whether the difference between the
+// mean of the runs of old and new is significant at the 95% level using
+// Welch's t-test: '*' if it is, '~' if it isn't and '?' if there aren't
+// enough runs to tell
+func significance(old, new *stat) string {
+	if old.runs < 2 || new.runs < 2 {
+		return "?"
+	}
+	if old.stddev == 0 && new.stddev == 0 {
+		if old.mean == new.mean {
+			return "~"
+		}
+		return "*"
+	}
+	t, df := welch(old, new)
+	if t > tValue(int(math.Max(1, math.Floor(df)))) {
+		return "*"
+	}
+	return "~"
+}
+
+// welch returns the t statistic, as an absolute value, and the degrees
+// of freedom of Welch's t-test of the means of old and new, which must
+// each have at least 2 runs and mustn't both have a stddev of 0
+// Returns: t, df
+func welch(old, new *stat) (float64, float64) {
+	vo := old.stddev * old.stddev / float64(old.runs)
+	vn := new.stddev * new.stddev / float64(new.runs)
+	t := math.Abs(new.mean-old.mean) / math.Sqrt(vo+vn)
+	df := (vo + vn) * (vo + vn) /
+		(vo*vo/float64(old.runs-1) + vn*vn/float64(new.runs-1))
+	return t, df
+}
+
+// printCompare prints a table for each stub name showing how each
+// benchmark has changed.  Speeds and their delta are the median of the
+// runs but the significance of the delta is tested on their means, as
+// labelled.
+func printCompare(w io.Writer, comps []comparison) error {
+	currentStubName := ""
+	for _, c := range comps {
+		if c.stubName != currentStubName {
+			// Print a title
+			fmt.Fprintf(w, "\nTest: %s\n%s\n\n", c.stubName, strings.Repeat("=", len(c.stubName)+6))
+			currentStubName = c.stubName
+			fmt.Fprintf(w, "   Pkg        Test Name        Old Median   New Median  Median Delta  Old Ratio  New Ratio  Ratio Delta   Old Size  New Size\n")
+			fmt.Fprintf(w, "---------|------------------|------------|------------|------------|----------|----------|-----------|---------|---------\n")
+		}
+		fmt.Fprintf(w, "%-9s  %-17s ", c.pkg, c.name)
+		switch {
+		case c.old == nil:
+			fmt.Fprintf(w, "  %10s   %10.1f   %10s   %9s  %9.3f  %11s   %8s  %8s\n",
+				"-", c.new.ns, "new", "-", c.new.speedRatio, "-", "-", sizeStr(c.new.size))
+		case c.new == nil:
+			fmt.Fprintf(w, "  %10.1f   %10s   %10s   %9.3f  %9s  %11s   %8s  %8s\n",
+				c.old.ns, "-", "gone", c.old.speedRatio, "-", "-", sizeStr(c.old.size), "-")
+		default:
+			delta := (c.new.ns - c.old.ns) / c.old.ns * 100
+			fmt.Fprintf(w, "  %10.1f   %10.1f   %+8.1f%% %s   %9.3f  %9.3f  %+11.3f   %8s  %8s",
+				c.old.ns, c.new.ns, delta, significance(c.old, c.new),
+				c.old.speedRatio, c.new.speedRatio, c.new.speedRatio-c.old.speedRatio,
+				sizeStr(c.old.size), sizeStr(c.new.size))
+			if c.old.size != c.new.size {
+				fmt.Fprintf(w, "  %+d", c.new.size-c.old.size)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "\nOld, New and their delta are the median ns/op of the runs.  The delta is\n"+
+		"marked using Welch's t-test of the means of the runs:\n"+
+		"* significant at 95%%, ~ not significant, ? too few runs to tell\n")
+	return nil
+}
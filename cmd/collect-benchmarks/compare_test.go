@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// runsStat returns a stat with a summary of runs with mean and stddev
+func runsStat(runs int, mean, stddev float64) *stat {
+	return &stat{summary: summary{runs: runs, mean: mean, stddev: stddev}}
+}
+
+func TestWelch(t *testing.T) {
+	cases := []struct {
+		old    *stat
+		new    *stat
+		wantT  float64
+		wantDF float64
+	}{
+		// Equal variances and runs give twice the df of each
+		{runsStat(3, 10, 1), runsStat(3, 12, 1), 2 / math.Sqrt(2.0/3), 4},
+		// vo = 1/5, vn = 9/10, df = 1.1^2 / (0.2^2/4 + 0.9^2/9)
+		{runsStat(5, 10, 1), runsStat(10, 12, 3), 2 / math.Sqrt(1.1), 12.1},
+		{runsStat(10, 12, 3), runsStat(5, 10, 1), 2 / math.Sqrt(1.1), 12.1},
+		// Only one side varying leaves the df of that side
+		{runsStat(4, 10, 2), runsStat(8, 10, 0), 0, 3},
+	}
+	for i, c := range cases {
+		gotT, gotDF := welch(c.old, c.new)
+		if !near(gotT, c.wantT) || !near(gotDF, c.wantDF) {
+			t.Errorf("(%d) welch() got: %f, %f, want: %f, %f",
+				i, gotT, gotDF, c.wantT, c.wantDF)
+		}
+	}
+}
+
+func TestSignificance(t *testing.T) {
+	cases := []struct {
+		name string
+		old  *stat
+		new  *stat
+		want string
+	}{
+		{"one old run", runsStat(1, 10, 0), runsStat(5, 20, 1), "?"},
+		{"one new run", runsStat(5, 10, 1), runsStat(1, 20, 0), "?"},
+		{"no variance same", runsStat(3, 10, 0), runsStat(3, 10, 0), "~"},
+		{"no variance different", runsStat(3, 10, 0), runsStat(3, 11, 0), "*"},
+		// df 4 so t must be more than 2.776, df of 2 per side would need 4.303
+		{"equal df below", runsStat(3, 10, 1), runsStat(3, 12.2, 1), "~"},
+		{"equal df above", runsStat(3, 10, 1), runsStat(3, 12.3, 1), "*"},
+		// df 12.1 so t must be more than 2.179, a pooled df of 13 would
+		// only need 2.160
+		{"unequal df below", runsStat(5, 10, 1), runsStat(10, 10+2.17*math.Sqrt(1.1), 3), "~"},
+		{"unequal df above", runsStat(5, 10, 1), runsStat(10, 10+2.19*math.Sqrt(1.1), 3), "*"},
+		{"slower", runsStat(10, 10+2.19*math.Sqrt(1.1), 3), runsStat(5, 10, 1), "*"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := significance(c.old, c.new); got != c.want {
+				t.Errorf("significance() got: %s, want: %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	mk := func(pkg, name string, ns float64) stat {
+		return stat{pkg: pkg, name: name, stubName: getStubName(name), ns: ns}
+	}
+	oldStats := []stat{
+		mk("vm2", "add12_v1.asm", 200),
+		mk("vm1", "and_v1.asm", 300),
+		mk("vm1", "add12_v1.asm", 100),
+	}
+	newStats := []stat{
+		mk("vm1", "add12_v1.asm", 90),
+		mk("native", "add12_v1.asm", 10),
+	}
+	want := []struct {
+		pkg   string
+		name  string
+		oldNs float64 // -1 if only new
+		newNs float64 // -1 if only old
+	}{
+		{"native", "add12_v1.asm", -1, 10},
+		{"vm1", "add12_v1.asm", 100, 90},
+		{"vm2", "add12_v1.asm", 200, -1},
+		{"vm1", "and_v1.asm", 300, -1},
+	}
+	got := compare(oldStats, newStats)
+	if len(got) != len(want) {
+		t.Fatalf("compare() got: %d comparisons, want: %d", len(got), len(want))
+	}
+	ns := func(s *stat) float64 {
+		if s == nil {
+			return -1
+		}
+		return s.ns
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.pkg != w.pkg || g.name != w.name || g.stubName != getStubName(w.name) ||
+			ns(g.old) != w.oldNs || ns(g.new) != w.newNs {
+			t.Errorf("compare()[%d] got: %s %s %v %v, want: %s %s %v %v", i,
+				g.pkg, g.name, ns(g.old), ns(g.new), w.pkg, w.name, w.oldNs, w.newNs)
+		}
+	}
+}
+
+func TestPrintCompare(t *testing.T) {
+	old := runsStat(3, 1000, 1)
+	old.pkg, old.name, old.stubName = "vm1", "add12_v1.asm", "add12"
+	old.ns, old.speedRatio, old.size = 1000, 2, 24
+	new := runsStat(3, 900, 1)
+	new.pkg, new.name, new.stubName = "vm1", "add12_v1.asm", "add12"
+	new.ns, new.speedRatio, new.size = 900, 1.8, 24
+	comps := []comparison{
+		{pkg: "native", name: "add12_v1.asm", stubName: "add12", new: new},
+		{pkg: "vm1", name: "add12_v1.asm", stubName: "add12", old: old, new: new},
+		{pkg: "vm2", name: "add12_v1.asm", stubName: "add12", old: old},
+	}
+	buf := &bytes.Buffer{}
+	if err := printCompare(buf, comps); err != nil {
+		t.Fatalf("printCompare() err: %v", err)
+	}
+	// Rows are left as fields to not depend on the column widths
+	wantRows := [][]string{
+		{"native", "add12_v1.asm", "-", "900.0", "new", "-", "1.800", "-", "-", "24"},
+		{"vm1", "add12_v1.asm", "1000.0", "900.0", "-10.0%", "*", "2.000", "1.800", "-0.200", "24", "24"},
+		{"vm2", "add12_v1.asm", "1000.0", "-", "gone", "2.000", "-", "-", "24", "-"},
+	}
+	lines := strings.Split(buf.String(), "\n")
+	for _, w := range wantRows {
+		found := false
+		for _, line := range lines {
+			if strings.Join(strings.Fields(line), " ") == strings.Join(w, " ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("printCompare() no row: %v\n%s", w, buf)
+		}
+	}
+	for _, label := range []string{"Old Median", "New Median", "Median Delta", "Welch's t-test of the means"} {
+		if !strings.Contains(buf.String(), label) {
+			t.Errorf("printCompare() no label: %s\n%s", label, buf)
+		}
+	}
+}
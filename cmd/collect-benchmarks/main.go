@@ -10,26 +10,37 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/cli"
 )
 
 type stat struct {
 	pkg        string
 	name       string
 	stubName   string
-	ns         int64
+	samples    []float64 // The ns/op of each run
+	ns         float64   // The median ns/op
 	speedRatio float64
 	size       int64
+	noisy      bool    // Whether the runs vary too much to be trusted
+	hasMem     bool    // Whether allocations were reported
+	allocs     float64 // The mean allocations per op
+	bytes      float64 // The mean bytes allocated per op
+	summary
 }
 
 func usage(errMsg string) {
 	fmt.Fprintf(os.Stderr, "Error: %s\n", errMsg)
-	fmt.Fprintf(os.Stderr, "Usage: %s [csv|tables] filename\n", os.Args[0])
+	flag.Usage()
+	os.Exit(1)
 }
 
 func readFile(filename string) ([]string, error) {
@@ -56,7 +67,7 @@ func readFile(filename string) ([]string, error) {
 
 // Regular expressions for parts of a line
 var rePkg = regexp.MustCompile(`^pkg: .*?\/go-vmcomparison\/(.*)$`)
-var reBenchmark = regexp.MustCompile(`^Benchmark.*?\/(.*?)-[^ ]+\s+\d+\s+(\d+) ns\/op$`)
+var reBenchmark = regexp.MustCompile(`^Benchmark[^ ]*?\/([^ ]*?)(?:-\d+)?\s+\d+\s+([\d.]+) ns\/op(?:\s+(\d+) B\/op\s+(\d+) allocs\/op)?$`)
 var reSize = regexp.MustCompile(`^Routine: ([^ ]+) size: (\d+)$`)
 var reNameStub = regexp.MustCompile(`^([^_]*).*$`)
 
@@ -85,46 +96,66 @@ func parse(lines []string) []stat {
 			}
 			stats[len(stats)-1].size = size
 		} else if reBenchmark.MatchString(line) {
-			testName := reBenchmark.FindStringSubmatch(line)[1]
-			nsS := reBenchmark.FindStringSubmatch(line)[2]
-			ns, err := strconv.ParseInt(nsS, 10, 64)
+			matches := reBenchmark.FindStringSubmatch(line)
+			testName := matches[1]
+			ns, err := strconv.ParseFloat(matches[2], 64)
 			if err != nil {
 				panic(err)
 			}
-			stats = append(stats, stat{pkg: pkg, name: testName, stubName: getStubName(testName), ns: ns, size: size})
+			s := stat{pkg: pkg, name: testName, stubName: getStubName(testName), samples: []float64{ns}, size: size}
+			// If allocations are reported, by -benchmem or b.ReportAllocs
+			if matches[3] != "" {
+				s.hasMem = true
+				s.bytes, err = strconv.ParseFloat(matches[3], 64)
+				if err != nil {
+					panic(err)
+				}
+				s.allocs, err = strconv.ParseFloat(matches[4], 64)
+				if err != nil {
+					panic(err)
+				}
+			}
+			stats = append(stats, s)
 		}
 	}
 	return stats
 }
 
-func getStubName(s string) string {
-	return reNameStub.FindStringSubmatch(s)[1]
-}
-
-func printCSV(stats []stat) {
-	for _, s := range stats {
-		fmt.Printf("%s,%s,%d,%d\n", s.pkg, s.name, s.ns, s.size)
-	}
-}
-
-func printTables(stats []stat) {
-	currentStubName := ""
+// aggregate combines the runs of each benchmark from 'go test -count=N'
+// and summarises them.  A benchmark is noisy if the standard deviation
+// of its runs is greater than noise times the mean.
+func aggregate(stats []stat, noise float64) []stat {
+	var aggStats []stat
+	index := make(map[string]int)
 	for _, s := range stats {
-		if s.stubName != currentStubName {
-			// Print a title
-			fmt.Printf("\nTest: %s\n%s\n\n", s.stubName, strings.Repeat("=", len(s.stubName)+6))
-			currentStubName = s.stubName
-			fmt.Printf("   Pkg        Test Name       Speed Ratio   Code Words   Speed (ns)\n")
-			fmt.Printf("---------|------------------|-------------|------------|------------\n")
-		}
-		fmt.Printf("%-9s  %-17s      %7.3f        ", s.pkg, s.name, s.speedRatio)
+		key := s.pkg + "/" + s.name
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(aggStats)
+			aggStats = append(aggStats, s)
+			continue
+		}
+		aggStats[i].samples = append(aggStats[i].samples, s.samples...)
 		if s.size > 0 {
-			fmt.Printf("%5d", s.size)
-		} else {
-			fmt.Printf("     ")
+			aggStats[i].size = s.size
 		}
-		fmt.Printf("     %8d\n", s.ns)
+		// The allocations are totalled to find the mean below
+		aggStats[i].hasMem = aggStats[i].hasMem || s.hasMem
+		aggStats[i].allocs += s.allocs
+		aggStats[i].bytes += s.bytes
 	}
+	for i, s := range aggStats {
+		aggStats[i].allocs /= float64(len(s.samples))
+		aggStats[i].bytes /= float64(len(s.samples))
+		aggStats[i].summary = summarise(s.samples)
+		aggStats[i].ns = aggStats[i].median
+		aggStats[i].noisy = aggStats[i].isNoisy(noise)
+	}
+	return aggStats
+}
+
+func getStubName(s string) string {
+	return reNameStub.FindStringSubmatch(s)[1]
 }
 
 func groupSort(stats []stat) []stat {
@@ -141,53 +172,166 @@ func groupSort(stats []stat) []stat {
 	return stats
 }
 
-func calcDiff(stats []stat) []stat {
+// warnings is where warnings are written, tests replace it to see them
+var warnings io.Writer = os.Stderr
+
+// calcDiff sets the speedRatio of each stat relative to the fastest
+// test in package baseline with the same stub name.  A warning is given
+// for each stub name without a baseline test as its speedRatios are left
+// at 0.
+func calcDiff(stats []stat, baseline string) []stat {
+	fastest := fastestByPkg(stats)
+	warned := make(map[string]bool)
 	for i, s := range stats {
-		for _, si := range stats {
-			if s.pkg == "native" {
-				stats[i].speedRatio = 1
-			} else if s.stubName == si.stubName && si.pkg == "native" {
-				stats[i].speedRatio = float64(s.ns) / float64(si.ns)
+		b, ok := fastest[s.stubName][baseline]
+		if !ok {
+			if !warned[s.stubName] {
+				fmt.Fprintf(warnings, "Warning: no %s benchmark for: %s\n", baseline, s.stubName)
+				warned[s.stubName] = true
 			}
+			continue
 		}
+		stats[i].speedRatio = s.ns / b.ns
 	}
 	return stats
 }
 
+// fastestByPkg returns the fastest test of each package for each stub
+// name: [stubName][pkg]stat
+func fastestByPkg(stats []stat) map[string]map[string]stat {
+	fastest := make(map[string]map[string]stat)
+	for _, s := range stats {
+		if _, ok := fastest[s.stubName]; !ok {
+			fastest[s.stubName] = make(map[string]stat)
+		}
+		if f, ok := fastest[s.stubName][s.pkg]; !ok || s.ns < f.ns {
+			fastest[s.stubName][s.pkg] = s
+		}
+	}
+	return fastest
+}
+
+// loadStats returns the summarised results in filename
+func loadStats(filename string, noise float64, baseline string) ([]stat, error) {
+	lines, err := readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return summariseStats(parse(lines), noise, baseline), nil
+}
+
+// summariseStats combines the runs of each benchmark and calculates
+// their speed ratios
+func summariseStats(stats []stat, noise float64, baseline string) []stat {
+	stats = aggregate(stats, noise)
+	return calcDiff(stats, baseline)
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [%s] filename\n", os.Args[0],
+			strings.Join(formatNames(), "|"))
+		fmt.Fprintf(os.Stderr, "       %s [flags] run [%s]\n", os.Args[0],
+			strings.Join(formatNames(), "|"))
+		fmt.Fprintf(os.Stderr, "       %s [flags] matrix filename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] compare oldFilename newFilename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Runs of a benchmark from 'go test -count=N' are summarised\n")
+		fmt.Fprintf(os.Stderr, "Speed ratios are relative to the fastest test of the baseline package\n")
+		flag.PrintDefaults()
+	}
+	noise := flag.Float64("noise", 0.05,
+		"flag results whose standard deviation is more than this fraction of the mean")
+	baseline := flag.String("baseline", "native", "package to calculate speed ratios against")
+	runOpts := runOptions{}
+	flag.StringVar(&runOpts.dir, "dir", ".", "run: root directory of the repository")
+	flag.IntVar(&runOpts.count, "count", 1, "run: number of times to run each benchmark")
+	flag.StringVar(&runOpts.benchtime, "benchtime", "1s", "run: time or iterations, Nx, to run each benchmark for")
+	flag.BoolVar(&runOpts.subprocess, "subprocess", false,
+		"run: run 'go test' to include native and codegen rather than running in-process")
+	flag.Parse()
+
+	if flag.NArg() > 0 && flag.Arg(0) == "run" {
+		command := "tables"
+		switch flag.NArg() {
+		case 1:
+		case 2:
+			command = flag.Arg(1)
+			if _, ok := formats[command]; !ok {
+				usage(fmt.Sprintf("incorrect command: %s", command))
+			}
+		default:
+			usage("wrong number of arguments")
+		}
+		if runOpts.count < 1 {
+			usage("count must be at least 1")
+		}
+		stats, err := runBenchmarks(runOpts)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		stats = groupSort(summariseStats(stats, *noise, *baseline))
+		if err := formats[command](os.Stdout, stats); err != nil {
+			cli.Fatal(err)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) == "matrix" {
+		if flag.NArg() != 2 {
+			usage("matrix needs a filename")
+		}
+		stats, err := loadStats(flag.Arg(1), *noise, *baseline)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		if err := printMatrix(os.Stdout, stats); err != nil {
+			cli.Fatal(err)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) == "compare" {
+		if flag.NArg() != 3 {
+			usage("compare needs two filenames")
+		}
+		oldStats, err := loadStats(flag.Arg(1), *noise, *baseline)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		newStats, err := loadStats(flag.Arg(2), *noise, *baseline)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		if err := printCompare(os.Stdout, compare(oldStats, newStats)); err != nil {
+			cli.Fatal(err)
+		}
+		return
+	}
+
 	filename := ""
 	command := "csv"
 
-	switch len(os.Args) {
-	case 1:
+	switch flag.NArg() {
+	case 0:
 		usage("no filename")
-		os.Exit(1)
+	case 1:
+		filename = flag.Arg(0)
 	case 2:
-		filename = os.Args[1]
-	case 3:
-		command = os.Args[1]
-		if command != "csv" && command != "tables" {
+		command = flag.Arg(0)
+		if _, ok := formats[command]; !ok {
 			usage(fmt.Sprintf("incorrect command: %s", command))
-			os.Exit(1)
 		}
-		filename = os.Args[2]
+		filename = flag.Arg(1)
 	default:
 		usage("wrong number of arguments")
-		os.Exit(1)
 	}
 
-	lines, err := readFile(filename)
+	stats, err := loadStats(filename, *noise, *baseline)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s", err)
-		os.Exit(1)
+		cli.Fatal(err)
 	}
-	stats := parse(lines)
-	stats = calcDiff(stats)
 	stats = groupSort(stats)
-	switch command {
-	case "csv":
-		printCSV(stats)
-	case "tables":
-		printTables(stats)
+	if err := formats[command](os.Stdout, stats); err != nil {
+		cli.Fatal(err)
 	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// near returns whether a and b are equal to within a small tolerance
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+// benchOutput is the output of 'go test -bench . -count=2' for two
+// packages, the first reporting allocations and the second not
+var benchOutput = []string{
+	"goos: linux",
+	"goarch: amd64",
+	"pkg: github.com/lawrencewoodman/go-vmcomparison/vm1",
+	"BenchmarkRun/add12_v1.asm-8         \t     100\t      1000 ns/op\t      16 B/op\t       1 allocs/op",
+	"Routine: add12_v1.asm size: 24",
+	"Stats: add12_v1.asm steps: 10",
+	"BenchmarkRun/loopuntil_v1.asm-8     \t     100\t      5000 ns/op\t       0 B/op\t       0 allocs/op",
+	"Routine: loopuntil_v1.asm size: 12",
+	"BenchmarkRun/add12_v1.asm-8         \t     100\t      1200 ns/op\t      32 B/op\t       3 allocs/op",
+	"Routine: add12_v1.asm size: 24",
+	"BenchmarkRun/loopuntil_v1.asm-8     \t     100\t      5000 ns/op\t       0 B/op\t       0 allocs/op",
+	"Routine: loopuntil_v1.asm size: 12",
+	"PASS",
+	"ok  \tgithub.com/lawrencewoodman/go-vmcomparison/vm1\t1.234s",
+	"pkg: github.com/lawrencewoodman/go-vmcomparison/native",
+	"BenchmarkRun/add12_v1.asm-8         \t    1000\t       500.5 ns/op",
+	"BenchmarkRun/add12_v1.asm-8         \t    1000\t       499.5 ns/op",
+}
+
+func TestParse(t *testing.T) {
+	add12 := func(ns, bytes, allocs float64) stat {
+		return stat{pkg: "vm1", name: "add12_v1.asm", stubName: "add12",
+			samples: []float64{ns}, size: 24,
+			hasMem: true, bytes: bytes, allocs: allocs}
+	}
+	loopuntil := stat{pkg: "vm1", name: "loopuntil_v1.asm", stubName: "loopuntil",
+		samples: []float64{5000}, size: 12, hasMem: true}
+	native := func(ns float64) stat {
+		return stat{pkg: "native", name: "add12_v1.asm", stubName: "add12",
+			samples: []float64{ns}}
+	}
+	want := []stat{
+		add12(1000, 16, 1),
+		loopuntil,
+		add12(1200, 32, 3),
+		loopuntil,
+		native(500.5),
+		native(499.5),
+	}
+	got := parse(benchOutput)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parse() got: %+v, want: %+v", got, want)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	got := aggregate(parse(benchOutput), 0.05)
+	want := []struct {
+		pkg     string
+		name    string
+		runs    int
+		ns      float64
+		size    int64
+		noisy   bool
+		hasMem  bool
+		bytes   float64
+		allocs  float64
+		samples []float64
+	}{
+		{"vm1", "add12_v1.asm", 2, 1100, 24, true, true, 24, 2, []float64{1000, 1200}},
+		{"vm1", "loopuntil_v1.asm", 2, 5000, 12, false, true, 0, 0, []float64{5000, 5000}},
+		{"native", "add12_v1.asm", 2, 500, 0, false, false, 0, 0, []float64{500.5, 499.5}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("aggregate() got: %d stats, want: %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.pkg != w.pkg || g.name != w.name || g.runs != w.runs ||
+			!near(g.ns, w.ns) || g.size != w.size || g.noisy != w.noisy ||
+			g.hasMem != w.hasMem || !near(g.bytes, w.bytes) ||
+			!near(g.allocs, w.allocs) || !reflect.DeepEqual(g.samples, w.samples) {
+			t.Errorf("aggregate()[%d] got: %+v, want: %+v", i, g, w)
+		}
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []float64
+		want    summary
+	}{
+		{"odd", []float64{3, 1, 5, 2, 4}, summary{
+			runs: 5, mean: 3, median: 3, stddev: math.Sqrt(2.5), min: 1, max: 5,
+			ciLow:  3 - 2.776*math.Sqrt(2.5)/math.Sqrt(5),
+			ciHigh: 3 + 2.776*math.Sqrt(2.5)/math.Sqrt(5),
+		}},
+		{"even", []float64{4, 1, 3, 2}, summary{
+			runs: 4, mean: 2.5, median: 2.5, stddev: math.Sqrt(5.0 / 3), min: 1, max: 4,
+			ciLow:  2.5 - 3.182*math.Sqrt(5.0/3)/2,
+			ciHigh: 2.5 + 3.182*math.Sqrt(5.0/3)/2,
+		}},
+		{"even with different middle", []float64{10, 20, 40, 30}, summary{
+			runs: 4, mean: 25, median: 25, stddev: math.Sqrt(500.0 / 3), min: 10, max: 40,
+			ciLow:  25 - 3.182*math.Sqrt(500.0/3)/2,
+			ciHigh: 25 + 3.182*math.Sqrt(500.0/3)/2,
+		}},
+		{"skewed", []float64{1, 1, 10}, summary{
+			runs: 3, mean: 4, median: 1, stddev: math.Sqrt(27), min: 1, max: 10,
+			ciLow:  4 - 4.303*math.Sqrt(27)/math.Sqrt(3),
+			ciHigh: 4 + 4.303*math.Sqrt(27)/math.Sqrt(3),
+		}},
+		{"single run", []float64{7}, summary{
+			runs: 1, mean: 7, median: 7, stddev: 0, min: 7, max: 7,
+			ciLow: 7, ciHigh: 7,
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			samples := append([]float64{}, c.samples...)
+			got := summarise(samples)
+			if got.runs != c.want.runs || !near(got.mean, c.want.mean) ||
+				!near(got.median, c.want.median) || !near(got.stddev, c.want.stddev) ||
+				got.min != c.want.min || got.max != c.want.max ||
+				!near(got.ciLow, c.want.ciLow) || !near(got.ciHigh, c.want.ciHigh) {
+				t.Errorf("summarise() got: %+v, want: %+v", got, c.want)
+			}
+			if !reflect.DeepEqual(samples, c.samples) {
+				t.Errorf("summarise() changed samples to: %v", samples)
+			}
+		})
+	}
+}
+
+func TestTValue(t *testing.T) {
+	cases := []struct {
+		df   int
+		want float64
+	}{
+		{1, 12.706},
+		{2, 4.303},
+		{10, 2.228},
+		{30, 2.042},
+		{31, 1.960},
+		{1000, 1.960},
+	}
+	for _, c := range cases {
+		if got := tValue(c.df); got != c.want {
+			t.Errorf("tValue(%d) got: %f, want: %f", c.df, got, c.want)
+		}
+	}
+}
+
+func TestIsNoisy(t *testing.T) {
+	cases := []struct {
+		mean      float64
+		stddev    float64
+		threshold float64
+		want      bool
+	}{
+		{100, 6, 0.05, true},
+		{100, 5, 0.05, false},
+		{100, 4, 0.05, false},
+		{100, 4, 0.01, true},
+		{100, 0, 0, false},
+		{0, 0, 0.05, false},
+	}
+	for _, c := range cases {
+		s := summary{mean: c.mean, stddev: c.stddev}
+		if got := s.isNoisy(c.threshold); got != c.want {
+			t.Errorf("isNoisy(%v) mean: %v, stddev: %v got: %t, want: %t",
+				c.threshold, c.mean, c.stddev, got, c.want)
+		}
+	}
+}
+
+// nsStat returns a stat for the test name in pkg taking ns per op
+func nsStat(pkg, name string, ns float64) stat {
+	return stat{pkg: pkg, name: name, stubName: getStubName(name), ns: ns}
+}
+
+// speedStats are the results of two packages and a baseline, where
+// codegen has two tests for add12 and vm1 has the only and test
+var speedStats = []stat{
+	nsStat("vm1", "add12_v1.asm", 400),
+	nsStat("codegen", "add12_v1.asm", 300),
+	nsStat("codegen", "add12_v2.asm", 200),
+	nsStat("native", "add12_v1.asm", 100),
+	nsStat("vm1", "and_v1.asm", 500),
+}
+
+func TestFastestByPkg(t *testing.T) {
+	want := map[string]map[string]float64{
+		"add12": {"vm1": 400, "codegen": 200, "native": 100},
+		"and":   {"vm1": 500},
+	}
+	got := fastestByPkg(speedStats)
+	gotNs := make(map[string]map[string]float64)
+	for stubName, pkgs := range got {
+		gotNs[stubName] = make(map[string]float64)
+		for pkg, s := range pkgs {
+			if s.pkg != pkg || s.stubName != stubName {
+				t.Errorf("fastestByPkg()[%s][%s] got: %s %s", stubName, pkg, s.pkg, s.name)
+			}
+			gotNs[stubName][pkg] = s.ns
+		}
+	}
+	if !reflect.DeepEqual(gotNs, want) {
+		t.Errorf("fastestByPkg() got: %v, want: %v", gotNs, want)
+	}
+	if name := got["add12"]["codegen"].name; name != "add12_v2.asm" {
+		t.Errorf("fastestByPkg() codegen got: %s, want: add12_v2.asm", name)
+	}
+}
+
+func TestCalcDiff(t *testing.T) {
+	cases := []struct {
+		baseline     string
+		wantRatios   []float64
+		wantWarnings string
+	}{
+		{"native", []float64{4, 3, 2, 1, 0},
+			"Warning: no native benchmark for: and\n"},
+		// The fastest codegen test is the baseline, not the first
+		{"codegen", []float64{2, 1.5, 1, 0.5, 0},
+			"Warning: no codegen benchmark for: and\n"},
+		{"vm1", []float64{1, 0.75, 0.5, 0.25, 1}, ""},
+		{"vm2", []float64{0, 0, 0, 0, 0},
+			"Warning: no vm2 benchmark for: add12\n" +
+				"Warning: no vm2 benchmark for: and\n"},
+	}
+	defer func(w io.Writer) { warnings = w }(warnings)
+	for _, c := range cases {
+		t.Run(c.baseline, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			warnings = buf
+			stats := append([]stat{}, speedStats...)
+			got := calcDiff(stats, c.baseline)
+			for i, s := range got {
+				if !near(s.speedRatio, c.wantRatios[i]) {
+					t.Errorf("calcDiff()[%d] %s/%s got: %f, want: %f",
+						i, s.pkg, s.name, s.speedRatio, c.wantRatios[i])
+				}
+			}
+			if buf.String() != c.wantWarnings {
+				t.Errorf("calcDiff() warnings got: %q, want: %q", buf, c.wantWarnings)
+			}
+		})
+	}
+}
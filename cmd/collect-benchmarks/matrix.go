@@ -0,0 +1,59 @@
+/*
+ * Pairwise speed ratios between the packages
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// printMatrix prints a table for each stub name of the speed ratio of
+// every package against every other package.  Each cell is the time of
+// the row's package divided by the time of the column's package, using
+// the fastest test of each package.
+func printMatrix(w io.Writer, stats []stat) error {
+	fastest := fastestByPkg(stats)
+	stubNames := make([]string, 0, len(fastest))
+	for stubName := range fastest {
+		stubNames = append(stubNames, stubName)
+	}
+	sort.Strings(stubNames)
+
+	for _, stubName := range stubNames {
+		pkgs := make([]string, 0, len(fastest[stubName]))
+		for pkg := range fastest[stubName] {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+
+		// Print a title
+		fmt.Fprintf(w, "\nTest: %s\n%s\n\n", stubName, strings.Repeat("=", len(stubName)+6))
+		fmt.Fprintf(w, "%-9s", "")
+		for _, pkg := range pkgs {
+			fmt.Fprintf(w, "  %9s", pkg)
+		}
+		fmt.Fprintf(w, "\n---------")
+		for range pkgs {
+			fmt.Fprintf(w, "|----------")
+		}
+		fmt.Fprintln(w)
+		for _, rowPkg := range pkgs {
+			fmt.Fprintf(w, "%-9s", rowPkg)
+			for _, colPkg := range pkgs {
+				ratio := fastest[stubName][rowPkg].ns / fastest[stubName][colPkg].ns
+				fmt.Fprintf(w, "  %9.3f", ratio)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "\nEach ratio is the time of the row's fastest test over the column's\n")
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintMatrix(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := printMatrix(buf, speedStats); err != nil {
+		t.Fatalf("printMatrix() err: %v", err)
+	}
+	// Each table is the header and rows, split into fields to not depend
+	// on the column widths.  Packages are in name order and each cell is
+	// the row's fastest test over the column's.
+	want := []string{
+		"Test: add12",
+		"===========",
+		"codegen native vm1",
+		"---------|----------|----------|----------",
+		"codegen 1.000 2.000 0.500",
+		"native 0.500 1.000 0.250",
+		"vm1 2.000 4.000 1.000",
+		"Test: and",
+		"=========",
+		"vm1",
+		"---------|----------",
+		"vm1 1.000",
+		"Each ratio is the time of the row's fastest test over the column's",
+	}
+	var got []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			got = append(got, strings.Join(fields, " "))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("printMatrix() got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * The output formats for the benchmark results
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// formats are the output formats for the results
+var formats = map[string]func(w io.Writer, stats []stat) error{
+	"csv":      printCSV,
+	"tables":   printTables,
+	"json":     printJSON,
+	"markdown": printMarkdown,
+	"html":     printHTML,
+}
+
+// formatNames returns the names of the output formats
+func formatNames() []string {
+	return []string{"csv", "tables", "json", "markdown", "html"}
+}
+
+// statJSON is how a stat is represented in JSON
+type statJSON struct {
+	Pkg        string    `json:"pkg"`
+	Name       string    `json:"name"`
+	StubName   string    `json:"stubName"`
+	Ns         float64   `json:"ns"`
+	SpeedRatio float64   `json:"speedRatio"`
+	Size       int64     `json:"size"`
+	Runs       int       `json:"runs"`
+	Mean       float64   `json:"mean"`
+	Median     float64   `json:"median"`
+	Stddev     float64   `json:"stddev"`
+	Min        float64   `json:"min"`
+	Max        float64   `json:"max"`
+	CILow      float64   `json:"ciLow"`
+	CIHigh     float64   `json:"ciHigh"`
+	Noisy      bool      `json:"noisy"`
+	Samples    []float64 `json:"samples"`
+	Allocs     *float64  `json:"allocs,omitempty"` // Allocations per op
+	Bytes      *float64  `json:"bytes,omitempty"`  // Bytes allocated per op
+}
+
+func (s stat) json() statJSON {
+	js := statJSON{
+		Pkg:        s.pkg,
+		Name:       s.name,
+		StubName:   s.stubName,
+		Ns:         s.ns,
+		SpeedRatio: s.speedRatio,
+		Size:       s.size,
+		Runs:       s.runs,
+		Mean:       s.mean,
+		Median:     s.median,
+		Stddev:     s.stddev,
+		Min:        s.min,
+		Max:        s.max,
+		CILow:      s.ciLow,
+		CIHigh:     s.ciHigh,
+		Noisy:      s.noisy,
+		Samples:    s.samples,
+	}
+	if s.hasMem {
+		js.Allocs = &s.allocs
+		js.Bytes = &s.bytes
+	}
+	return js
+}
+
+func printCSV(w io.Writer, stats []stat) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"pkg", "name", "stubName", "ns", "speedRatio", "size", "runs",
+		"mean", "median", "stddev", "min", "max", "ciLow", "ciHigh", "noisy",
+		"allocs", "bytes",
+	})
+	for _, s := range stats {
+		cw.Write([]string{
+			s.pkg,
+			s.name,
+			s.stubName,
+			nsStr(s.ns),
+			ratioStr(s.speedRatio),
+			strconv.FormatInt(s.size, 10),
+			strconv.Itoa(s.runs),
+			nsStr(s.mean),
+			nsStr(s.median),
+			nsStr(s.stddev),
+			nsStr(s.min),
+			nsStr(s.max),
+			nsStr(s.ciLow),
+			nsStr(s.ciHigh),
+			strconv.FormatBool(s.noisy),
+			memStr(s.hasMem, s.allocs),
+			memStr(s.hasMem, s.bytes),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printTables prints a table for each stub name.  The speed is the
+// median of the runs and the confidence interval is shown as a
+// percentage of the mean.
+func printTables(w io.Writer, stats []stat) error {
+	currentStubName := ""
+	for _, s := range stats {
+		if s.stubName != currentStubName {
+			// Print a title
+			fmt.Fprintf(w, "\nTest: %s\n%s\n\n", s.stubName, strings.Repeat("=", len(s.stubName)+6))
+			currentStubName = s.stubName
+			fmt.Fprintf(w, "   Pkg        Test Name       Speed Ratio   Code Words   Speed (ns)   Allocs/op       B/op     ±%%   Runs\n")
+			fmt.Fprintf(w, "---------|------------------|-------------|------------|------------|-----------|----------|-------|------\n")
+		}
+		fmt.Fprintf(w, "%-9s  %-17s      %7.3f        ", s.pkg, s.name, s.speedRatio)
+		if s.size > 0 {
+			fmt.Fprintf(w, "%5d", s.size)
+		} else {
+			fmt.Fprintf(w, "     ")
+		}
+		fmt.Fprintf(w, "   %10.1f   %9s  %9s   %5.1f   %4d", s.ns,
+			memStr(s.hasMem, s.allocs), memStr(s.hasMem, s.bytes), s.ciPercent(), s.runs)
+		if s.noisy {
+			fmt.Fprintf(w, "  noisy")
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, stats []stat) error {
+	js := make([]statJSON, len(stats))
+	for i, s := range stats {
+		js[i] = s.json()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(js)
+}
+
+// printMarkdown prints a table for each stub name, ready to go into
+// README.md
+func printMarkdown(w io.Writer, stats []stat) error {
+	currentStubName := ""
+	for _, s := range stats {
+		if s.stubName != currentStubName {
+			if currentStubName != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "### %s\n\n", s.stubName)
+			fmt.Fprintf(w, "| Pkg | Test Name | Stub Name | Speed Ratio | Code Words | Speed (ns) | Allocs/op | B/op | Mean (ns) | Stddev | Min | Max | 95%% CI | Runs | Noisy |\n")
+			fmt.Fprintf(w, "|-----|-----------|-----------|------------:|-----------:|-----------:|----------:|-----:|----------:|-------:|----:|----:|-------:|-----:|:-----:|\n")
+			currentStubName = s.stubName
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %s | %s | %s | %s | %s | %s | %s | %s | %d | %s |\n",
+			s.pkg, s.name, s.stubName, ratioStr(s.speedRatio), sizeStr(s.size),
+			nsStr(s.ns), memStr(s.hasMem, s.allocs), memStr(s.hasMem, s.bytes), nsStr(s.mean), nsStr(s.stddev), nsStr(s.min), nsStr(s.max),
+			ciStr(s.ciLow, s.ciHigh), s.runs, noisyStr(s.noisy))
+	}
+	return nil
+}
+
+// htmlGroup is the stats for a stub name
+type htmlGroup struct {
+	StubName string
+	Stats    []statJSON
+}
+
+var htmlTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"ratio": ratioStr,
+	"size":  sizeStr,
+	"ns":    nsStr,
+	"ci":    ciStr,
+	"noisy": noisyStr,
+	"mem": func(n *float64) string {
+		if n == nil {
+			return ""
+		}
+		return memStr(true, *n)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>VM Benchmarks</title>
+</head>
+<body>
+{{- range .}}
+<h2>{{.StubName}}</h2>
+<table>
+<tr><th>Pkg</th><th>Test Name</th><th>Stub Name</th><th>Speed Ratio</th><th>Code Words</th><th>Speed (ns)</th><th>Allocs/op</th><th>B/op</th><th>Mean (ns)</th><th>Stddev</th><th>Min</th><th>Max</th><th>95% CI</th><th>Runs</th><th>Noisy</th></tr>
+{{- range .Stats}}
+<tr><td>{{.Pkg}}</td><td>{{.Name}}</td><td>{{.StubName}}</td><td>{{ratio .SpeedRatio}}</td><td>{{size .Size}}</td><td>{{ns .Ns}}</td><td>{{mem .Allocs}}</td><td>{{mem .Bytes}}</td><td>{{ns .Mean}}</td><td>{{ns .Stddev}}</td><td>{{ns .Min}}</td><td>{{ns .Max}}</td><td>{{ci .CILow .CIHigh}}</td><td>{{.Runs}}</td><td>{{noisy .Noisy}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// printHTML prints a table for each stub name
+func printHTML(w io.Writer, stats []stat) error {
+	groups := []*htmlGroup{}
+	for _, s := range stats {
+		if len(groups) == 0 || groups[len(groups)-1].StubName != s.stubName {
+			groups = append(groups, &htmlGroup{StubName: s.stubName})
+		}
+		g := groups[len(groups)-1]
+		g.Stats = append(g.Stats, s.json())
+	}
+	return htmlTemplate.Execute(w, groups)
+}
+
+// sizeStr returns size as a string or an empty string if it isn't known
+func sizeStr(size int64) string {
+	if size > 0 {
+		return strconv.FormatInt(size, 10)
+	}
+	return ""
+}
+
+func nsStr(ns float64) string {
+	return strconv.FormatFloat(ns, 'f', 1, 64)
+}
+
+func ratioStr(ratio float64) string {
+	return strconv.FormatFloat(ratio, 'f', 3, 64)
+}
+
+func ciStr(low, high float64) string {
+	return nsStr(low) + " - " + nsStr(high)
+}
+
+func noisyStr(noisy bool) string {
+	if noisy {
+		return "yes"
+	}
+	return ""
+}
+
+// memStr returns n, an allocation count, as a string or an empty string
+// if allocations weren't reported
+func memStr(hasMem bool, n float64) string {
+	if !hasMem {
+		return ""
+	}
+	return strconv.FormatFloat(math.Round(n*10)/10, 'f', -1, 64)
+}
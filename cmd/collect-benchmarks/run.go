@@ -0,0 +1,164 @@
+/*
+ * Running the benchmarks rather than parsing their saved output
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/suite"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+	"github.com/lawrencewoodman/go-vmcomparison/native"
+)
+
+// runOptions control how the benchmarks are run
+type runOptions struct {
+	dir        string // The root directory of the repository
+	count      int    // The number of times to run each benchmark
+	benchtime  string // As for 'go test -benchtime'
+	subprocess bool   // Whether to run 'go test' rather than in-process
+}
+
+// runBenchmarks runs the benchmarks and returns a stat for each run
+func runBenchmarks(opts runOptions) ([]stat, error) {
+	if opts.subprocess {
+		return runSubprocess(opts)
+	}
+	return runInProcess(opts)
+}
+
+// runSubprocess runs the benchmarks of every package with 'go test' and
+// parses its output
+func runSubprocess(opts runOptions) ([]stat, error) {
+	cmd := exec.Command("go", "test", "-run", "^$", "-bench", ".", "-benchmem",
+		"-count", strconv.Itoa(opts.count), "-benchtime", opts.benchtime, "./...")
+	cmd.Dir = opts.dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go test: %w", err)
+	}
+	return parse(strings.Split(string(bytes.TrimSpace(out)), "\n")), nil
+}
+
+// runInProcess benchmarks running each fixture listed in the suite
+// manifest, testdata/suite.json, and each native routine using
+// testing.Benchmark.  The codegen routines are only available to
+// 'go test' so need runSubprocess.
+func runInProcess(opts runOptions) ([]stat, error) {
+	// testing.Benchmark takes the benchtime from the test flags
+	testing.Init()
+	if err := flag.Set("test.benchtime", opts.benchtime); err != nil {
+		return nil, fmt.Errorf("invalid benchtime: %s", opts.benchtime)
+	}
+	s, err := suite.Load(opts.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []stat
+	for run := 0; run < opts.count; run++ {
+		for _, name := range target.Names() {
+			t, err := target.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, routineName := range s.Names() {
+				if !s.Routines[routineName].Implements(name) {
+					continue
+				}
+				filename := suite.FixtureFilename(opts.dir, name, routineName)
+				st, err := benchmarkFile(t, filename)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", filename, err)
+				}
+				stats = append(stats, st)
+			}
+		}
+		for _, name := range native.Names() {
+			stats = append(stats, benchmarkNative(name))
+		}
+	}
+	return stats, nil
+}
+
+// benchmarkFile benchmarks running the routine in filename on t
+func benchmarkFile(t *target.Target, filename string) (stat, error) {
+	routine, err := t.LoadFile(filename)
+	if err != nil {
+		return stat{}, err
+	}
+	var runErr error
+	r := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.StopTimer()
+		for n := 0; n < b.N; n++ {
+			v := t.New()
+			if err := v.LoadRoutine(routine); err != nil {
+				runErr = err
+				return
+			}
+			b.StartTimer()
+			_, err := v.Run()
+			b.StopTimer()
+			if err != nil {
+				runErr = err
+				return
+			}
+		}
+	})
+	if runErr != nil {
+		return stat{}, runErr
+	}
+
+	name := filepath.Base(filename)
+	return stat{
+		pkg:      t.Name,
+		name:     name,
+		stubName: getStubName(name),
+		samples:  []float64{float64(r.T.Nanoseconds()) / float64(r.N)},
+		size:     int64(routine.Size()),
+		hasMem:   true,
+		allocs:   float64(r.AllocsPerOp()),
+		bytes:    float64(r.AllocedBytesPerOp()),
+	}, nil
+}
+
+// benchmarkNative benchmarks the native routine for stubName
+func benchmarkNative(stubName string) stat {
+	routine, _ := native.Get(stubName)
+	r := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.StopTimer()
+		mem, action := routine.Init()
+		for n := 0; n < b.N; n++ {
+			v := native.New()
+			v.LoadMem(mem)
+			b.StartTimer()
+			action(v)
+			b.StopTimer()
+		}
+	})
+	return stat{
+		pkg:      "native",
+		name:     stubName,
+		stubName: stubName,
+		samples:  []float64{float64(r.T.Nanoseconds()) / float64(r.N)},
+		hasMem:   true,
+		allocs:   float64(r.AllocsPerOp()),
+		bytes:    float64(r.AllocedBytesPerOp()),
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Summary statistics for benchmarks run more than once
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// summary describes the ns/op of each run of a benchmark
+type summary struct {
+	runs   int
+	mean   float64
+	median float64
+	stddev float64 // Sample standard deviation
+	min    float64
+	max    float64
+	ciLow  float64 // 95% confidence interval of the mean
+	ciHigh float64
+}
+
+// tTable is the two-tailed 95% critical value of Student's t distribution
+// for 1 to 30 degrees of freedom
+var tTable = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tValue returns the two-tailed 95% critical value of Student's t
+// distribution for df degrees of freedom
+func tValue(df int) float64 {
+	if df <= len(tTable) {
+		return tTable[df-1]
+	}
+	return 1.960
+}
+
+// summarise returns the summary of samples, which mustn't be empty
+func summarise(samples []float64) summary {
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	s := summary{runs: n, min: sorted[0], max: sorted[n-1]}
+
+	if n%2 == 1 {
+		s.median = sorted[n/2]
+	} else {
+		s.median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	sum := 0.0
+	for _, x := range sorted {
+		sum += x
+	}
+	s.mean = sum / float64(n)
+
+	s.ciLow, s.ciHigh = s.mean, s.mean
+	if n > 1 {
+		sumSq := 0.0
+		for _, x := range sorted {
+			sumSq += (x - s.mean) * (x - s.mean)
+		}
+		s.stddev = math.Sqrt(sumSq / float64(n-1))
+		margin := tValue(n-1) * s.stddev / math.Sqrt(float64(n))
+		s.ciLow, s.ciHigh = s.mean-margin, s.mean+margin
+	}
+	return s
+}
+
+// ciPercent returns the half-width of the confidence interval as a
+// percentage of the mean
+func (s summary) ciPercent() float64 {
+	if s.mean == 0 {
+		return 0
+	}
+	return (s.ciHigh - s.mean) / s.mean * 100
+}
+
+// isNoisy returns whether the coefficient of variation is greater than
+// threshold
+func (s summary) isNoisy(threshold float64) bool {
+	return s.mean != 0 && s.stddev/s.mean > threshold
+}
@@ -0,0 +1,191 @@
+/*
+ * An assembler for each of the VMs
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/codegen"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/cli"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// The codegen target assembles to Go source rather than an object
+const codegenName = "codegen"
+
+func usage(errMsg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", errMsg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -target name [-format obj|list|hex] [-o output] filename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Targets: %s %s\n", strings.Join(target.Names(), " "), codegenName)
+		flag.PrintDefaults()
+	}
+	targetName := flag.String("target", "", "VM to assemble for")
+	format := flag.String("format", "obj", "output format: obj, list or hex; obj is Go source for codegen, which has no hex")
+	output := flag.String("o", "", "output file (default: source with .obj extension for obj, otherwise stdout)")
+	flag.Parse()
+
+	if *targetName == "" {
+		usage("no target given")
+	}
+	if flag.NArg() != 1 {
+		usage("expecting one source file")
+	}
+	filename := flag.Arg(0)
+
+	if *targetName == codegenName {
+		listing := &strings.Builder{}
+		opts := vm.AsmOptions{Filename: filename}
+		switch *format {
+		case "obj":
+		case "list":
+			opts.Listing = listing
+		default:
+			usage(fmt.Sprintf("format not supported by codegen: %s", *format))
+		}
+		src, err := assembleCodegen(opts)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		if opts.Listing != nil {
+			src = listing.String()
+		}
+		if err := writeOutput(*output, func(w io.Writer) error {
+			_, err := io.WriteString(w, src)
+			return err
+		}); err != nil {
+			cli.Fatal(err)
+		}
+		return
+	}
+
+	t, err := target.Get(*targetName)
+	if err != nil {
+		usage(err.Error())
+	}
+	var write func(w io.Writer, routine *vm.Routine) error
+	switch *format {
+	case "obj":
+		write = t.Save
+		if *output == "" {
+			*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".obj"
+		}
+	case "list":
+		write = asm.WriteListing
+	case "hex":
+		write = writeHex
+	default:
+		usage(fmt.Sprintf("unknown format: %s", *format))
+	}
+
+	routine, err := assembleFile(t, filename)
+	if err != nil {
+		cli.Fatal(err)
+	}
+	if err := writeOutput(*output, func(w io.Writer) error {
+		return write(w, routine)
+	}); err != nil {
+		cli.Fatal(err)
+	}
+}
+
+func assembleFile(t *target.Target, filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return t.Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// assembleCodegen assembles opts.Filename into Go source for codegen
+func assembleCodegen(opts vm.AsmOptions) (string, error) {
+	f, err := os.Open(opts.Filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return codegen.Assemble(f, opts, nil)
+}
+
+// writeOutput calls write with filename opened for writing or stdout if
+// filename is empty
+func writeOutput(filename string, write func(w io.Writer) error) error {
+	if filename == "" {
+		bw := bufio.NewWriter(os.Stdout)
+		if err := write(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeHex writes the code and then any data of routine in hex with
+// eight words to a line
+func writeHex(w io.Writer, routine *vm.Routine) error {
+	code := make([]*big.Int, len(routine.Code))
+	for i, n := range routine.Code {
+		code[i] = big.NewInt(n)
+	}
+	if err := writeHexWords(w, "code", code); err != nil {
+		return err
+	}
+	if len(routine.Data) > 0 {
+		return writeHexWords(w, "data", routine.Data)
+	}
+	return nil
+}
+
+func writeHexWords(w io.Writer, segment string, words []*big.Int) error {
+	if _, err := fmt.Fprintf(w, "%s:\n", segment); err != nil {
+		return err
+	}
+	for addr := 0; addr < len(words); addr += 8 {
+		line := fmt.Sprintf("%04x:", addr)
+		for i := addr; i < addr+8 && i < len(words); i++ {
+			if words[i].Sign() < 0 {
+				line += fmt.Sprintf(" %8s", fmt.Sprintf("-%x", new(big.Int).Neg(words[i])))
+			} else {
+				line += fmt.Sprintf(" %08x", words[i])
+			}
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+/*
+ * The commands understood by the debugger
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// debugger holds the state of a debugging session
+type debugger struct {
+	v           vm.Machine
+	routine     *vm.Routine
+	names       *asm.Names
+	w           io.Writer
+	interrupt   <-chan os.Signal
+	breakpoints map[int64]bool
+	watchpoints map[int64]*big.Int // The last value seen at each address
+	steps       int64              // Instructions executed since reset
+	stopped     string             // Why the routine can't continue, if it can't
+}
+
+type command struct {
+	name  string
+	alias string
+	args  string
+	help  string
+	fn    func(d *debugger, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"step", "s", "[n]", "execute n instructions, default 1", (*debugger).step},
+		{"continue", "c", "", "execute until HLT, a breakpoint or a watchpoint", (*debugger).cont},
+		{"break", "b", "[addr|label]", "set a breakpoint on a code address or list them", (*debugger).setBreak},
+		{"delete", "d", "addr|label", "delete a breakpoint", (*debugger).deleteBreak},
+		{"watch", "w", "[addr|symbol]", "stop when a data cell changes or list watchpoints", (*debugger).watch},
+		{"unwatch", "", "addr|symbol", "delete a watchpoint", (*debugger).unwatch},
+		{"print", "p", "addr|symbol [n]", "print n words of data memory, default 1", (*debugger).print},
+		{"set", "", "addr|symbol value", "set a word of data memory", (*debugger).set},
+		{"regs", "r", "", "print the registers", (*debugger).regs},
+		{"stack", "", "", "print the stacks", (*debugger).stacks},
+		{"list", "l", "[n]", "list n source lines around the PC, default 5", (*debugger).list},
+		{"where", "", "", "print the current instruction", (*debugger).whereCmd},
+		{"reset", "", "", "reset the routine to its start", (*debugger).reset},
+		{"help", "h", "", "print this help", (*debugger).help},
+		{"quit", "q", "", "exit the debugger", nil},
+	}
+}
+
+func newDebugger(v vm.Machine, routine *vm.Routine, w io.Writer, interrupt <-chan os.Signal) *debugger {
+	return &debugger{
+		v:           v,
+		routine:     routine,
+		names:       asm.NewNames(routine),
+		w:           w,
+		interrupt:   interrupt,
+		breakpoints: make(map[int64]bool),
+		watchpoints: make(map[int64]*big.Int),
+	}
+}
+
+// exec executes the command in line
+// Returns: whether to quit
+func (d *debugger) exec(line string) bool {
+	fields := strings.Fields(line)
+	for _, c := range commands {
+		if fields[0] != c.name && fields[0] != c.alias {
+			continue
+		}
+		if c.fn == nil {
+			return true
+		}
+		if err := c.fn(d, fields[1:]); err != nil {
+			fmt.Fprintf(d.w, "Error: %s\n", err)
+		}
+		return false
+	}
+	fmt.Fprintf(d.w, "Error: unknown command: %s, type help for a list\n", fields[0])
+	return false
+}
+
+func (d *debugger) step(args []string) error {
+	n, err := optCount(args, 1)
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		if stop := d.stepOne(); stop {
+			break
+		}
+	}
+	d.where()
+	return nil
+}
+
+func (d *debugger) cont(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expecting no arguments")
+	}
+	for {
+		if stop := d.stepOne(); stop {
+			break
+		}
+		if d.breakpoints[d.v.PC()] {
+			fmt.Fprintf(d.w, "Breakpoint: %s\n", d.codeLoc(d.v.PC()))
+			break
+		}
+		select {
+		case <-d.interrupt:
+			fmt.Fprintf(d.w, "Interrupted\n")
+			d.where()
+			return nil
+		default:
+		}
+	}
+	d.where()
+	return nil
+}
+
+// stepOne executes an instruction and reports anything that should stop
+// execution
+// Returns: whether to stop
+func (d *debugger) stepOne() bool {
+	if d.stopped != "" {
+		fmt.Fprintf(d.w, "%s, use reset to start again\n", d.stopped)
+		return true
+	}
+	hlt, err := d.v.Step()
+	d.steps++
+	if err != nil {
+		fmt.Fprintf(d.w, "Error: %s\n", err)
+		d.stopped = "Routine stopped by an error"
+		return true
+	}
+	stop := d.checkWatchpoints()
+	if hlt {
+		fmt.Fprintf(d.w, "HLT: %s, steps: %d\n", d.v.HltVal(), d.steps)
+		d.stopped = "Routine has halted"
+		return true
+	}
+	return stop
+}
+
+// checkWatchpoints reports each watched cell that has changed
+// Returns: whether any changed
+func (d *debugger) checkWatchpoints() bool {
+	changed := false
+	for _, addr := range sortedAddrs(d.watchpoints) {
+		n, err := d.v.ReadMem(addr)
+		if err != nil || n.Cmp(d.watchpoints[addr]) == 0 {
+			continue
+		}
+		fmt.Fprintf(d.w, "Watchpoint: %s: %s -> %s\n", d.dataLoc(addr), d.watchpoints[addr], n)
+		d.watchpoints[addr] = new(big.Int).Set(n)
+		changed = true
+	}
+	return changed
+}
+
+func (d *debugger) setBreak(args []string) error {
+	switch len(args) {
+	case 0:
+		for _, addr := range sortedAddrs(d.breakpoints) {
+			fmt.Fprintf(d.w, "%s\n", d.codeLoc(addr))
+		}
+		return nil
+	case 1:
+		addr, err := d.codeAddr(args[0])
+		if err != nil {
+			return err
+		}
+		d.breakpoints[addr] = true
+		fmt.Fprintf(d.w, "Breakpoint set: %s\n", d.codeLoc(addr))
+		return nil
+	}
+	return fmt.Errorf("expecting at most one address")
+}
+
+func (d *debugger) deleteBreak(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expecting one address")
+	}
+	addr, err := d.codeAddr(args[0])
+	if err != nil {
+		return err
+	}
+	if !d.breakpoints[addr] {
+		return fmt.Errorf("no breakpoint at: %s", args[0])
+	}
+	delete(d.breakpoints, addr)
+	return nil
+}
+
+func (d *debugger) watch(args []string) error {
+	switch len(args) {
+	case 0:
+		for _, addr := range sortedAddrs(d.watchpoints) {
+			fmt.Fprintf(d.w, "%s: %s\n", d.dataLoc(addr), d.watchpoints[addr])
+		}
+		return nil
+	case 1:
+		addr, err := target.DataAddr(d.routine, args[0])
+		if err != nil {
+			return err
+		}
+		n, err := d.v.ReadMem(addr)
+		if err != nil {
+			return err
+		}
+		d.watchpoints[addr] = new(big.Int).Set(n)
+		fmt.Fprintf(d.w, "Watchpoint set: %s: %s\n", d.dataLoc(addr), n)
+		return nil
+	}
+	return fmt.Errorf("expecting at most one address")
+}
+
+func (d *debugger) unwatch(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expecting one address")
+	}
+	addr, err := target.DataAddr(d.routine, args[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := d.watchpoints[addr]; !ok {
+		return fmt.Errorf("no watchpoint at: %s", args[0])
+	}
+	delete(d.watchpoints, addr)
+	return nil
+}
+
+func (d *debugger) print(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expecting an address and an optional count")
+	}
+	addr, err := target.DataAddr(d.routine, args[0])
+	if err != nil {
+		return err
+	}
+	n, err := optCount(args[1:], 1)
+	if err != nil {
+		return err
+	}
+	for a := addr; a < addr+n; a++ {
+		v, err := d.v.ReadMem(a)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(d.w, "%s: %s\n", d.dataLoc(a), v)
+	}
+	return nil
+}
+
+func (d *debugger) set(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expecting an address and a value")
+	}
+	addr, err := target.DataAddr(d.routine, args[0])
+	if err != nil {
+		return err
+	}
+	n, ok := new(big.Int).SetString(args[1], 0)
+	if !ok {
+		return fmt.Errorf("invalid value: %s", args[1])
+	}
+	if err := d.v.WriteMem(addr, n); err != nil {
+		return err
+	}
+	// Setting a watched cell isn't a change made by the routine
+	if _, ok := d.watchpoints[addr]; ok {
+		d.watchpoints[addr] = n
+	}
+	return nil
+}
+
+func (d *debugger) regs(args []string) error {
+	fmt.Fprintf(d.w, "pc: %d\n", d.v.PC())
+	if t, ok := d.v.(vm.Traceable); ok {
+		for _, r := range t.Registers() {
+			fmt.Fprintf(d.w, "%s: %s\n", r.Name, r.Value)
+		}
+	}
+	fmt.Fprintf(d.w, "steps: %d\n", d.steps)
+	return nil
+}
+
+func (d *debugger) stacks(args []string) error {
+	si, ok := d.v.(vm.StackInspector)
+	if !ok {
+		return fmt.Errorf("VM has no stacks")
+	}
+	for _, s := range si.Stacks() {
+		items := make([]string, len(s.Items))
+		for i, n := range s.Items {
+			items[i] = n.String()
+		}
+		fmt.Fprintf(d.w, "%s: [%s]\n", s.Name, strings.Join(items, " "))
+	}
+	return nil
+}
+
+func (d *debugger) list(args []string) error {
+	n, err := optCount(args, 5)
+	if err != nil {
+		return err
+	}
+	sm := d.routine.SourceMap
+	lineNum := d.lineNum(d.v.PC())
+	if lineNum == 0 {
+		return fmt.Errorf("no source for: %d", d.v.PC())
+	}
+	first := lineNum - int(n)/2
+	if first < 1 {
+		first = 1
+	}
+	for l := first; l < first+int(n) && l <= len(sm.Lines); l++ {
+		marker := " "
+		if l == lineNum {
+			marker = ">"
+		}
+		fmt.Fprintf(d.w, "%s %4d  %s\n", marker, l, sm.Lines[l-1])
+	}
+	return nil
+}
+
+func (d *debugger) whereCmd(args []string) error {
+	d.where()
+	return nil
+}
+
+func (d *debugger) reset(args []string) error {
+	d.v.Reset()
+	d.steps = 0
+	d.stopped = ""
+	for addr := range d.watchpoints {
+		if n, err := d.v.ReadMem(addr); err == nil {
+			d.watchpoints[addr] = new(big.Int).Set(n)
+		}
+	}
+	d.where()
+	return nil
+}
+
+func (d *debugger) help(args []string) error {
+	for _, c := range commands {
+		name := c.name
+		if c.alias != "" {
+			name += ", " + c.alias
+		}
+		fmt.Fprintf(d.w, "%-12s %-18s %s\n", name, c.args, c.help)
+	}
+	fmt.Fprintf(d.w, "An empty line repeats the last command\n")
+	return nil
+}
+
+// where prints the instruction at the PC with its source line
+func (d *debugger) where() {
+	pc := d.v.PC()
+	instr := "?"
+	if t, ok := d.v.(vm.Traceable); ok {
+		instr, _ = t.Decode()
+	}
+	loc := fmt.Sprintf("%d", pc)
+	if name := d.codeName(pc); name != loc {
+		loc += " <" + name + ">"
+	}
+	line := fmt.Sprintf("%s: %-24s", loc, instr)
+	if lineNum := d.lineNum(pc); lineNum != 0 {
+		sm := d.routine.SourceMap
+		line += fmt.Sprintf(" ; %s:%d: %s", sm.Filename, lineNum,
+			strings.TrimSpace(sm.Lines[lineNum-1]))
+	}
+	fmt.Fprintln(d.w, strings.TrimRight(line, " "))
+}
+
+// lineNum returns the source line number of addr in code or 0 if unknown
+func (d *debugger) lineNum(addr int64) int {
+	sm := d.routine.SourceMap
+	if sm == nil || addr < 0 || addr >= int64(len(sm.Code)) {
+		return 0
+	}
+	lineNum := sm.Code[addr]
+	if lineNum < 1 || lineNum > len(sm.Lines) {
+		return 0
+	}
+	return lineNum
+}
+
+// codeAddr returns the code address given by s, which is either a number
+// or a label
+func (d *debugger) codeAddr(s string) (int64, error) {
+	if addr, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return addr, nil
+	}
+	if addr, ok := d.routine.CodeSymbols[s]; ok {
+		return addr, nil
+	}
+	return 0, fmt.Errorf("unknown label: %s", s)
+}
+
+// codeName returns addr as the nearest label at or before it with an
+// offset if needed
+func (d *debugger) codeName(addr int64) string {
+	name, labelAddr := "", int64(-1)
+	for n, a := range d.routine.CodeSymbols {
+		if a <= addr && (a > labelAddr || (a == labelAddr && n < name)) {
+			name, labelAddr = n, a
+		}
+	}
+	switch {
+	case name == "":
+		return fmt.Sprintf("%d", addr)
+	case labelAddr == addr:
+		return name
+	}
+	return fmt.Sprintf("%s+%d", name, addr-labelAddr)
+}
+
+// codeLoc returns addr in code with its name if it has one
+func (d *debugger) codeLoc(addr int64) string {
+	if name := d.codeName(addr); name != fmt.Sprintf("%d", addr) {
+		return fmt.Sprintf("%s (%d)", name, addr)
+	}
+	return fmt.Sprintf("%d", addr)
+}
+
+// dataLoc returns addr in data with its name if it has one
+func (d *debugger) dataLoc(addr int64) string {
+	if name := d.names.Data(addr); name != d.names.Number(addr) {
+		return fmt.Sprintf("%s (%d)", name, addr)
+	}
+	return fmt.Sprintf("%d", addr)
+}
+
+// optCount returns the count in args or def if there isn't one
+func optCount(args []string, def int64) (int64, error) {
+	switch len(args) {
+	case 0:
+		return def, nil
+	case 1:
+		n, err := strconv.ParseInt(args[0], 0, 64)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid count: %s", args[0])
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("expecting at most one count")
+}
+
+func sortedAddrs[T any](m map[int64]T) []int64 {
+	addrs := make([]int64, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm1"
+)
+
+// sumSrc adds one to sum three times starting from one and halts with 4
+// after 13 steps
+const sumSrc = "        LDA  one\n" +
+	"loop:   ADD  one\n" +
+	"        STA  sum\n" +
+	"        DSZ  count\n" +
+	"        JMP  loop\n" +
+	"        HLT  sum\n" +
+	"one:    1\n" +
+	"sum:    0\n" +
+	"count:  3\n"
+
+// newTestDebugger returns a debugger for sumSrc on vm1 and the buffer
+// that it writes to
+func newTestDebugger(t *testing.T) (*debugger, *bytes.Buffer) {
+	t.Helper()
+	routine, err := vm1.AssembleString(sumSrc, vm.AsmOptions{Filename: "sum.asm"})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	v := vm1.New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	return newDebugger(v, routine, buf, nil), buf
+}
+
+func TestExec(t *testing.T) {
+	cases := []struct {
+		name      string
+		cmds      []string
+		wantPC    int64
+		wantSteps int64
+		wantLines []string // Lines that must be output in this order
+	}{
+		{"breakpoint by label", []string{"break loop", "continue", "c"}, 2, 5,
+			[]string{
+				"Breakpoint set: loop (2)",
+				"Breakpoint: loop (2)",
+				"2 <loop>: ADD one ; sum.asm:2: loop: ADD one",
+				"Breakpoint: loop (2)",
+			}},
+		{"watchpoint change", []string{"watch sum", "continue", "continue"}, 6, 7,
+			[]string{
+				"Watchpoint set: sum (13): 0",
+				"Watchpoint: sum (13): 0 -> 2",
+				"6 <loop+4>: DSZ count ; sum.asm:4: DSZ count",
+				"Watchpoint: sum (13): 2 -> 3",
+			}},
+		{"step n", []string{"step 4", "s"}, 2, 5,
+			[]string{
+				"8 <loop+6>: JMP loop ; sum.asm:5: JMP loop",
+				"2 <loop>: ADD one ; sum.asm:2: loop: ADD one",
+			}},
+		{"reset", []string{"watch sum", "step 3", "reset", "print sum", "watch"}, 0, 0,
+			[]string{
+				"Watchpoint: sum (13): 0 -> 2",
+				"0: LDA one ; sum.asm:1: LDA one",
+				"sum (13): 0",
+				"sum (13): 0",
+			}},
+		{"print by symbol", []string{"step 3", "print sum", "print one 3", "p 12"}, 6, 3,
+			[]string{
+				"sum (13): 2",
+				"one (12): 1",
+				"sum (13): 2",
+				"count (14): 3",
+				"one (12): 1",
+			}},
+		{"stop after HLT", []string{"continue", "step", "continue"}, 10, 13,
+			[]string{
+				"HLT: 4, steps: 13",
+				"10 <loop+8>: HLT sum ; sum.asm:6: HLT sum",
+				"Routine has halted, use reset to start again",
+				"Routine has halted, use reset to start again",
+			}},
+		{"unknown symbol", []string{"print nothing", "break nothing"}, 0, 0,
+			[]string{
+				"Error: unknown address: nothing",
+				"Error: unknown label: nothing",
+			}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, buf := newTestDebugger(t)
+			for _, cmd := range c.cmds {
+				if quit := d.exec(cmd); quit {
+					t.Fatalf("exec(%q) quit", cmd)
+				}
+			}
+			if pc := d.v.PC(); pc != c.wantPC {
+				t.Errorf("PC got: %d, want: %d", pc, c.wantPC)
+			}
+			if d.steps != c.wantSteps {
+				t.Errorf("steps got: %d, want: %d", d.steps, c.wantSteps)
+			}
+			// Lines are compared as fields to not depend on the column widths
+			lines := strings.Split(buf.String(), "\n")
+			i := 0
+			for _, line := range lines {
+				if i < len(c.wantLines) &&
+					strings.Join(strings.Fields(line), " ") == c.wantLines[i] {
+					i++
+				}
+			}
+			if i < len(c.wantLines) {
+				t.Errorf("output has no line: %q\n%s", c.wantLines[i], buf)
+			}
+		})
+	}
+}
+
+func TestExecQuit(t *testing.T) {
+	d, _ := newTestDebugger(t)
+	for _, cmd := range []string{"quit", "q"} {
+		if quit := d.exec(cmd); !quit {
+			t.Errorf("exec(%q) got: %t, want: true", cmd, quit)
+		}
+	}
+}
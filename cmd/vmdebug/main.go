@@ -0,0 +1,94 @@
+/*
+ * An interactive debugger for each of the VMs
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/cli"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+)
+
+func usage(errMsg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", errMsg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -target name [-word bits] filename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Targets: %s\n", strings.Join(target.Names(), " "))
+		fmt.Fprintf(os.Stderr, "The file may be source or an object from vmasm\n")
+		fmt.Fprintf(os.Stderr, "Type help at the prompt for a list of commands\n")
+		flag.PrintDefaults()
+	}
+	targetName := flag.String("target", "", "VM to run on")
+	word := flag.String("word", "", "word size in bits or unbounded (default: the target's)")
+	flag.Parse()
+
+	if *targetName == "" {
+		usage("no target given")
+	}
+	if flag.NArg() != 1 {
+		usage("expecting one file")
+	}
+	t, err := target.Get(*targetName)
+	if err != nil {
+		usage(err.Error())
+	}
+
+	routine, err := t.LoadFile(flag.Arg(0))
+	if err != nil {
+		cli.Fatal(err)
+	}
+	v, err := t.NewMachine(*word)
+	if err != nil {
+		usage(err.Error())
+	}
+	if err := v.LoadRoutine(routine); err != nil {
+		cli.Fatal(err)
+	}
+
+	// An interrupt stops continue rather than exiting
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	d := newDebugger(v, routine, os.Stdout, interrupt)
+	d.where()
+	scanner := bufio.NewScanner(os.Stdin)
+	lastCmd := ""
+	for {
+		fmt.Print("(vmdebug) ")
+		if !scanner.Scan() {
+			fmt.Println()
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		// An empty line repeats the last command
+		if line == "" {
+			line = lastCmd
+		}
+		if line == "" {
+			continue
+		}
+		lastCmd = line
+		if quit := d.exec(line); quit {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cli.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * A disassembler for each of the VMs
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/cli"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+)
+
+func usage(errMsg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", errMsg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -target name filename\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Targets: %s\n", strings.Join(target.Names(), " "))
+		fmt.Fprintf(os.Stderr, "The file may be an object from vmasm or source\n")
+		flag.PrintDefaults()
+	}
+	targetName := flag.String("target", "", "VM the file is for")
+	flag.Parse()
+
+	if *targetName == "" {
+		usage("no target given")
+	}
+	if flag.NArg() != 1 {
+		usage("expecting one file")
+	}
+	t, err := target.Get(*targetName)
+	if err != nil {
+		usage(err.Error())
+	}
+
+	routine, err := t.LoadFile(flag.Arg(0))
+	if err != nil {
+		cli.Fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := t.Disassemble(w, routine); err != nil {
+		cli.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		cli.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Runs a routine on any of the VMs
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/cli"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+func usage(errMsg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", errMsg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -target name [-budget n] [-timeout d] [-trace text|json] [-word bits] filename [addr|symbol ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Targets: %s\n", strings.Join(target.Names(), " "))
+		fmt.Fprintf(os.Stderr, "The file may be source or an object from vmasm\n")
+		flag.PrintDefaults()
+	}
+	targetName := flag.String("target", "", "VM to run on")
+	budget := flag.Int64("budget", 0, "maximum number of instructions to execute, 0 for no limit")
+	timeout := flag.Duration("timeout", 0, "maximum time to run for, 0 for no limit")
+	trace := flag.String("trace", "", "trace each instruction to stderr as text or json")
+	word := flag.String("word", "", "word size in bits or unbounded (default: the target's)")
+	flag.Parse()
+
+	if *targetName == "" {
+		usage("no target given")
+	}
+	if flag.NArg() < 1 {
+		usage("no file given")
+	}
+	if *budget < 0 {
+		usage("budget must not be negative")
+	}
+	if *timeout < 0 {
+		usage("timeout must not be negative")
+	}
+	t, err := target.Get(*targetName)
+	if err != nil {
+		usage(err.Error())
+	}
+	var tracer vm.Tracer
+	switch *trace {
+	case "":
+	case "text":
+		tracer = vm.NewTextTracer(os.Stderr)
+	case "json":
+		tracer = vm.NewJSONTracer(os.Stderr)
+	default:
+		usage(fmt.Sprintf("unknown trace format: %s", *trace))
+	}
+
+	routine, err := t.LoadFile(flag.Arg(0))
+	if err != nil {
+		cli.Fatal(err)
+	}
+	addrs := make([]int64, 0, flag.NArg()-1)
+	for _, s := range flag.Args()[1:] {
+		addr, err := target.DataAddr(routine, s)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	v, err := t.NewMachine(*word)
+	if err != nil {
+		usage(err.Error())
+	}
+	if err := v.LoadRoutine(routine); err != nil {
+		cli.Fatal(err)
+	}
+	if tracer != nil {
+		v.SetTracer(tracer)
+	}
+	// An interrupt stops the routine so that its state can be reported
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	steps, err := vm.RunLimit(ctx, v, *budget)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		fmt.Fprintf(os.Stderr, "PC: %d, steps: %d\n", v.PC(), steps)
+		os.Exit(1)
+	}
+
+	fmt.Printf("HLT: %s\n", v.HltVal())
+	fmt.Printf("steps: %d\n", steps)
+	for i, addr := range addrs {
+		n, err := v.ReadMem(addr)
+		if err != nil {
+			cli.Fatal(err)
+		}
+		fmt.Printf("%s (%d): %s\n", flag.Arg(i+1), addr, n)
+	}
+}
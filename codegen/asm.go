@@ -9,14 +9,17 @@
 package codegen
 
 import (
-	"bufio"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"strconv"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]uint{
@@ -43,203 +46,192 @@ var instructions = map[string]uint{
 	"JGT":   20 << 24,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
+var reFilename = regexp.MustCompile(`^([0-9a-zA-Z_]+).*`)
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
-	}
-
-	if err := sc.Err(); err != nil {
-		return []string{}, err
-	}
-	return lines, nil
+var syntax = &asm.Syntax{
+	IsMnemonic: isMnemonic,
+	AddrModes:  []string{"I", "II"},
+	SplitData:  true,
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z]+[0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s+`)
-var reAddrMode = regexp.MustCompile(`^\s*([iI]{1,2})\s+`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z,]+).*`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?)([0-9]+).*`)
-var reSymbol = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*).*`)
-var reIndexOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+),([0-9a-zA-z]+).*`)
-var reDirective = regexp.MustCompile(`^\.([a-zA-Z]+)$`)
-var reFilename = regexp.MustCompile(`^([0-9a-zA-z_]+).*`)
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
+}
 
-// pass1 returns program and data symbol tables
-func pass1(srcLines []string) (map[string]uint, map[string]uint) {
-	symbolType := "p"
-	var memPos uint = 0
-	var progPos uint = 0
-	progSymbols := make(map[string]uint, 0)
-	memSymbols := make(map[string]uint, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				symbolType = "m"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			if symbolType == "p" {
-				progSymbols[label] = progPos
-			} else {
-				memSymbols[label] = memPos
-			}
-			line = line[matchIndices[1]:]
-		}
+// sizer implements asm.Sizer.  Each instruction is a function in the
+// program and each data word is an element of memory.
+type sizer struct{}
 
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			progPos++
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			memPos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			memPos++
-		}
+func (sizer) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	isInstr := stmt.Mnemonic != ""
+	if isInstr == (seg == asm.CodeSegment) {
+		return 1
 	}
-	return progSymbols, memSymbols
+	return 0
 }
 
-func pass2(srcLines []string, progSymbols, memSymbols map[string]uint) string {
+func pass2(filename string, lines []*asm.Line, syms *asm.Symbols) (string, vm.AsmErrors) {
 	code := "\tprogram := []func(v *CGVM){\n"
-	for lineNum, line := range srcLines {
+	errs := vm.AsmErrors{}
+	for _, line := range lines {
 		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
+		if line.Directive != nil {
+			if line.Directive.Name == "data" {
 				code += "\t}"
 				code += "\n"
 				code += "\tmemory := []uint{\n"
 			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
+				errs.Add(vm.NewAsmError(line.Directive.Pos, line.Directive.Name, "unknown directive"), filename, line.Num)
 			}
 		}
+		if line.Stmt == nil {
+			continue
+		}
 
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
+		var str string
+		var err error
+		if line.Stmt.Mnemonic != "" {
+			str, err = asmInstr(syms, line.Stmt)
+		} else {
+			str, err = asmData(syms, line.Stmt)
 		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-			addrMode := ""
-			operand := ""
-			// If there is a possible address mode
-			if reAddrMode.MatchString(line) {
-				addrMode = reAddrMode.FindStringSubmatch(line)[1]
-				matchIndices := reAddrMode.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-			// If there is an operand
-			if reOperand.MatchString(line) {
-				operand = reOperand.FindStringSubmatch(line)[1]
-				matchIndices := reOperand.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			} else {
-				if addrMode != "" {
-					// operand mistaken for address mode
-					operand = addrMode
-				} else {
-					// TODO: replace panic addition to errors
-					panic(fmt.Sprintf("%d: no operand found for instruction: %s", lineNum, line))
-				}
-			}
-			if len(line) > 0 {
-				panic(fmt.Sprintf("%d: remaining line: %s", lineNum, line))
-			}
-			code += asmInstr(progSymbols, memSymbols, instr, addrMode, operand)
+		if err != nil {
+			errs.Add(err, filename, line.Num)
+		}
+		code += str
+	}
+	code += "\t}\n"
+	return code, errs
+}
 
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			_, ok := memSymbols[sym]
-			if !ok {
-				panic(fmt.Sprintf("%d: unknown symbol: %s", lineNum, sym))
-			}
+// asmData assembles a literal value or symbol
+func asmData(syms *asm.Symbols, stmt *asm.Stmt) (string, error) {
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return "", err
+	}
+	operand := stmt.Operands[0]
+	switch operand.Kind {
+	case asm.Symbol:
+		if _, ok := syms.Data[operand.Name]; !ok {
+			return "", vm.NewAsmError(operand.Pos, operand.Name, "unknown symbol")
+		}
+		return fmt.Sprintf("\t\tm_%s,\n", operand.Name), nil
+	case asm.Literal:
+		n, ok := literalWord(operand.Value)
+		if !ok {
+			return "", vm.NewAsmError(operand.Pos, operand.Text, "invalid literal")
+		}
+		return fmt.Sprintf("\t\t%d,\n", n), nil
+	}
+	return "", vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
+}
 
-			code += fmt.Sprintf("\t\tm_%s,\n", sym)
+// literalWord returns n as a word with negative numbers rolled around,
+// it returns false if n doesn't fit
+func literalWord(n *big.Int) (uint64, bool) {
+	if n.Sign() < 0 {
+		// Roll the number around to represent a negative number
+		n = new(big.Int).Add(n, new(big.Int).SetUint64(math.MaxUint64))
+		n.Add(n, big.NewInt(1))
+	}
+	if !n.IsUint64() {
+		return 0, false
+	}
+	return n.Uint64(), true
+}
 
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			sign := reLiteral.FindStringSubmatch(line)[1]
-			lit := reLiteral.FindStringSubmatch(line)[2]
-			if sign == "-" {
-				ui64, err := strconv.ParseUint(lit, 10, 64)
-				if err != nil {
-					panic(err)
-				}
-				// Roll the number around to represent a negative number
-				ui64 = math.MaxUint64 - (ui64 - 1)
-				lit = strconv.FormatUint(ui64, 10)
+// listingRoutine returns a routine for asm.WriteListing to list the
+// source that was assembled without errors.  The instructions become Go
+// functions rather than words so the routine has no Code, only a source
+// map recording which line each was assembled from.
+func listingRoutine(filename string, srcLines []string, lines []*asm.Line, syms *asm.Symbols) *vm.Routine {
+	sm := &vm.SourceMap{
+		Filename: filename,
+		Lines:    srcLines,
+		Symbols:  asm.SymbolRefs(lines),
+	}
+	data := make([]*big.Int, 0)
+	codeSize := 0
+	seg := asm.CodeSegment
+	for _, line := range lines {
+		if line.Directive != nil && line.Directive.Name == "data" {
+			seg = asm.DataSegment
+		}
+		if line.Stmt != nil && (sizer{}).Size(seg, line.Stmt) > 0 {
+			if seg == asm.CodeSegment {
+				codeSize++
+			} else {
+				data = append(data, dataWord(syms, line.Stmt))
 			}
-
-			code += fmt.Sprintf("\t\t%s,\n", lit)
 		}
+		sm.Record(line.Num, codeSize, len(data))
+	}
+	return &vm.Routine{
+		Data:        data,
+		CodeSymbols: syms.Code,
+		DataSymbols: syms.Data,
+		SourceMap:   sm,
 	}
-	code += "\t}\n"
-	return code
 }
 
-func resolveOperand(progSymbols, memSymbols map[string]uint, addrMode, operand string) string {
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		return operand
+// dataWord returns the word assembled by asmData from stmt
+func dataWord(syms *asm.Symbols, stmt *asm.Stmt) *big.Int {
+	operand := stmt.Operands[0]
+	if operand.Kind == asm.Symbol {
+		return big.NewInt(syms.Data[operand.Name])
+	}
+	n, _ := literalWord(operand.Value)
+	return new(big.Int).SetUint64(n)
+}
+
+func resolveOperand(syms *asm.Symbols, addrMode string, operand *asm.Expr) (string, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return operand.Text, nil
+	case asm.Index:
 		// If operand is an indexed address
-	} else if reIndexOperand.MatchString(operand) {
 		if addrMode != "II" {
-			panic("operand doesn't match addressing mode")
+			return "", vm.NewAsmError(operand.Pos, operand.Text, "operand doesn't match addressing mode")
+		}
+		base, err := resolveOperand(syms, "", operand.X)
+		if err != nil {
+			return "", err
+		}
+		index, err := resolveOperand(syms, "", operand.Y)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("calcBaseIndexAddr(v, %s, %s)", base, index), nil
+	case asm.Symbol:
+		if _, ok := syms.Code[operand.Name]; ok {
+			return fmt.Sprintf("p_%s", operand.Name), nil
+		}
+		if _, ok := syms.Data[operand.Name]; ok {
+			return fmt.Sprintf("m_%s", operand.Name), nil
 		}
-		base := reIndexOperand.FindStringSubmatch(operand)[1]
-		base = resolveOperand(progSymbols, memSymbols, "", base)
-		index := reIndexOperand.FindStringSubmatch(operand)[2]
-		index = resolveOperand(progSymbols, memSymbols, "", index)
-		return fmt.Sprintf("calcBaseIndexAddr(v, %s, %s)", base, index)
-	}
-
-	if _, ok := progSymbols[operand]; ok {
-		return fmt.Sprintf("p_%s", operand)
-	}
-
-	if _, ok := memSymbols[operand]; ok {
-		return fmt.Sprintf("m_%s", operand)
 	}
-	panic(fmt.Sprintf("unknown operand: %s", operand))
+	return "", vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func asmInstr(progSymbols, memSymbols map[string]uint, instr string, addrMode string, operand string) string {
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) (string, error) {
 	// TODO: don't need map for instructions as opcode value isn't needed
-	_, ok := instructions[instr]
+	_, ok := instructions[stmt.Mnemonic]
 	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
+		return "", vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
+	}
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return "", err
 	}
 
-	return fmt.Sprintf("\t\tfunc(v *CGVM) { op_%s(v, %s) },\n", instr, resolveOperand(progSymbols, memSymbols, addrMode, operand))
+	op, err := resolveOperand(syms, stmt.AddrMode, stmt.Operands[0])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\t\tfunc(v *CGVM) { op_%s(v, %s) },\n", stmt.Mnemonic, op), nil
 }
 
-func createConsts(progSymbols, memSymbols map[string]uint) string {
+func createConsts(progSymbols, memSymbols map[string]int64) string {
 	code := "\tconst (\n"
 	pkeys := make([]string, 0, len(progSymbols))
 	mkeys := make([]string, 0, len(memSymbols))
@@ -269,34 +261,83 @@ func createConsts(progSymbols, memSymbols map[string]uint) string {
 	return code
 }
 
-func makeWantMapStr(want map[uint]uint) string {
+// makeWantMapStr returns want as a map of memory addresses, in symbol
+// order, for the generated test
+func makeWantMapStr(memSymbols map[string]int64, want map[string]uint) (string, error) {
+	symbols := make([]string, 0, len(want))
+	for symbol := range want {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
 	str := "map[uint]uint{"
-	for k, v := range want {
-		str += fmt.Sprintf("%d: %d,", k, v)
+	for _, symbol := range symbols {
+		addr, ok := memSymbols[symbol]
+		if !ok {
+			return "", fmt.Errorf("unknown symbol in want: %s", symbol)
+		}
+		str += fmt.Sprintf("%d: %d,", addr, want[symbol])
 	}
 	str += "}"
-	return str
+	return str, nil
 }
 
-func asm(filename string, want map[uint]uint) (string, error) {
-	srcLines, err := readFile(filename)
+// Assemble assembles the source read from r into a Go source file.  The
+// name of the generated init function is taken from opts.Filename and
+// want is the value of each data symbol the generated test expects after
+// running.  If opts.Listing is set a listing is written to it, which
+// shows the address of each instruction but not a word for it.
+func Assemble(r io.Reader, opts vm.AsmOptions, want map[string]uint) (string, error) {
+	srcLines, err := asm.ReadLines(r)
 	if err != nil {
 		return "", err
 	}
 
-	progSymbols, memSymbols := pass1(srcLines)
+	lines, errs := asm.Parse(opts.Filename, srcLines, syntax)
+	syms, pass1Errs := asm.Pass1(opts.Filename, lines, syntax, sizer{})
+	errs = append(errs, pass1Errs...)
 	header := "// Generated test file by main_test.go\n\n"
 	header += "package codegen\n\n"
-	cmd_name := reFilename.FindStringSubmatch(filepath.Base(filename))[1]
+	filename := filepath.Base(opts.Filename)
+	if !reFilename.MatchString(filename) {
+		return "", fmt.Errorf("invalid filename: %s", opts.Filename)
+	}
+	cmd_name := reFilename.FindStringSubmatch(filename)[1]
 	code := header
 	code += fmt.Sprintf("func init%s() ([]uint, []func(*CGVM)) {\n", cmd_name)
-	code += createConsts(progSymbols, memSymbols)
-	code += pass2(srcLines, progSymbols, memSymbols)
+	code += createConsts(syms.Code, syms.Data)
+	body, pass2Errs := pass2(opts.Filename, lines, syms)
+	errs = append(errs, pass2Errs...)
+	if len(errs) > 0 {
+		errs.Sort()
+		return "", errs
+	}
+	wantStr, err := makeWantMapStr(syms.Data, want)
+	if err != nil {
+		return "", err
+	}
+	code += body
 	code += "\treturn memory, program\n"
 	code += "}\n\n"
 	code += "func init() {\n"
 	code += fmt.Sprintf("\taddTest(\"%s\", init%s, %s)\n",
-		filepath.Base(filename), cmd_name, makeWantMapStr(want))
+		filename, cmd_name, wantStr)
 	code += "}\n"
+	if opts.Listing != nil {
+		routine := listingRoutine(opts.Filename, srcLines, lines, syms)
+		if err := asm.WriteListing(opts.Listing, routine); err != nil {
+			return "", err
+		}
+	}
 	return code, nil
 }
+
+// AssembleFile assembles the source in filename into a Go source file
+func AssembleFile(filename string, want map[string]uint) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename}, want)
+}
@@ -8,47 +8,111 @@
 package codegen
 
 import (
-	"math"
+	"context"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
+
+// The width of words unless set with WithWordSize
+var defaultWord = vm.MustWord(32)
 
 type CGVM struct {
-	mem    [memSize]uint // Memory
-	ac     uint          // 32-bit accumulator
-	pc     uint          // Program Counter
-	hltNow bool          // Whether to halt
-	hltVal uint          // A value returned by HLT
+	mem     []uint  // Memory
+	memSize uint    // Number of words of memory
+	ac      uint    // Accumulator
+	pc      uint    // Program Counter
+	hltNow  bool    // Whether to halt
+	hltVal  uint    // A value returned by HLT
+	err     error   // The error that stopped the VM, if any
+	word    vm.Word // Width of words, results of arithmetic wrap to fit
+}
+
+// Option configures a CGVM when passed to New
+type Option func(*CGVM)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n uint) Option {
+	return func(v *CGVM) {
+		v.memSize = n
+	}
 }
 
-func New() *CGVM {
-	return &CGVM{}
+// WithWordSize sets the width of words, which is 32 bits by default.
+// Words are unsigned so unbounded is the same as 64 bits.  The results of
+// ADD, SUB, DSZ and INC wrap around to fit and the top bit is taken as the
+// sign for JGT.  Words passed to LoadMem are used as they are so JEQ and
+// JGT wrap the AC before comparing it.
+func WithWordSize(w vm.Word) Option {
+	return func(v *CGVM) {
+		v.word = w
+	}
+}
+
+func New(opts ...Option) *CGVM {
+	v := &CGVM{memSize: defaultMemSize, word: defaultWord}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(int64(v.memSize)); err != nil {
+		panic(err)
+	}
+	v.mem = make([]uint, v.memSize)
+	return v
 }
 
 func mask32(n uint) uint {
 	return n & 0xFFFFFFFF
 }
 
+// wrap returns n wrapped around to fit in a word
+func wrap(v *CGVM, n uint) uint {
+	return uint(v.word.WrapUint(uint64(n)))
+}
+
+// calcBaseIndexAddr returns the sum of the values at baseIndirect and
+// indexIndirect.  If either is outside of memory it returns memSize so
+// that the instruction using it doesn't access memory.
 func calcBaseIndexAddr(v *CGVM, baseIndirect uint, indexIndirect uint) uint {
-	// TODO: Assume always at least 4096 memory to avoid check
+	if baseIndirect >= v.memSize {
+		memoryFault(v, baseIndirect)
+		return v.memSize
+	}
+	if indexIndirect >= v.memSize {
+		memoryFault(v, indexIndirect)
+		return v.memSize
+	}
 	base := v.mem[baseIndirect]
 	index := v.mem[indexIndirect]
 	return base + index
 }
 
+// memoryFault records that addr is outside of memory and halts the VM
+func memoryFault(v *CGVM, addr uint) {
+	if v.err == nil {
+		v.err = &vm.MemoryFault{PC: int64(v.pc), Addr: int64(addr)}
+	}
+	v.hltNow = true
+}
+
+// calcIndirectAddr returns the address pointed to by addr.  If addr is
+// outside of memory it returns memSize so that the instruction using it
+// doesn't access memory.
 func calcIndirectAddr(v *CGVM, addr uint) uint {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return v.memSize
 	}
 	return v.mem[addr]
 }
 
 func op_HLT(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
 	v.hltNow = true
 	v.hltVal = v.mem[addr]
@@ -56,36 +120,36 @@ func op_HLT(v *CGVM, addr uint) {
 }
 
 func op_ADD(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	v.ac = mask32(v.ac + v.mem[addr])
+	v.ac = wrap(v, v.ac+v.mem[addr])
 	v.pc = mask32(v.pc + 1)
 }
 
 func op_SUB(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	v.ac = mask32(v.ac - v.mem[addr])
+	v.ac = wrap(v, v.ac-v.mem[addr])
 	v.pc = mask32(v.pc + 1)
 }
 
 func op_AND(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
 	v.ac = v.ac & v.mem[addr]
 	v.pc = mask32(v.pc + 1)
 }
 
 func op_STA(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
 	v.mem[addr] = v.ac
 	v.pc = mask32(v.pc + 1)
@@ -93,29 +157,29 @@ func op_STA(v *CGVM, addr uint) {
 }
 
 func op_LDA(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
 	v.ac = v.mem[addr]
 	v.pc = mask32(v.pc + 1)
 }
 
 func op_JMP(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
 	// TODO: swap calcAddr and range check for program variant
 	v.pc = addr
 }
 
 func op_JEQ(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	if v.ac == 0 {
+	if wrap(v, v.ac) == 0 {
 		v.pc = addr
 	} else {
 		v.pc = mask32(v.pc + 1)
@@ -123,11 +187,11 @@ func op_JEQ(v *CGVM, addr uint) {
 }
 
 func op_JGT(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	if v.ac != 0 && v.ac <= math.MaxInt32 {
+	if wrap(v, v.ac) != 0 && !v.word.IsNegUint(uint64(v.ac)) {
 		v.pc = addr
 	} else {
 		v.pc = mask32(v.pc + 1)
@@ -135,11 +199,11 @@ func op_JGT(v *CGVM, addr uint) {
 }
 
 func op_DSZ(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	v.mem[addr] = mask32(v.mem[addr] - 1)
+	v.mem[addr] = wrap(v, v.mem[addr]-1)
 	if v.mem[addr] == 0 {
 		v.pc = mask32(v.pc + 2)
 	} else {
@@ -150,11 +214,11 @@ func op_DSZ(v *CGVM, addr uint) {
 }
 
 func op_INC(v *CGVM, addr uint) {
-	if addr >= memSize {
-		// TODO: Implement an error
-		panic("outside memory range")
+	if addr >= v.memSize {
+		memoryFault(v, addr)
+		return
 	}
-	v.mem[addr] = mask32(v.mem[addr] + 1)
+	v.mem[addr] = wrap(v, v.mem[addr]+1)
 	v.pc = mask32(v.pc + 1)
 }
 
@@ -162,8 +226,43 @@ func (v *CGVM) LoadMem(mem []uint) {
 	copy(v.mem[:], mem)
 }
 
-func (v *CGVM) Run(program []func(*CGVM)) {
+// Run executes program until HLT or an error
+func (v *CGVM) Run(program []func(*CGVM)) error {
+	for !v.hltNow {
+		if v.pc >= uint(len(program)) {
+			memoryFault(v, v.pc)
+			break
+		}
+		program[v.pc](v)
+	}
+	return v.err
+}
+
+// RunLimit executes program until HLT, an error, maxSteps instructions
+// have been executed if maxSteps is greater than 0, or ctx is done.  If
+// the budget is used up vm.ErrBudgetExhausted is returned and if ctx is
+// done ctx.Err() is returned.
+// Returns: steps, error
+func (v *CGVM) RunLimit(ctx context.Context, program []func(*CGVM), maxSteps int64) (int64, error) {
+	done := ctx.Done()
+	var steps int64
 	for !v.hltNow {
+		if maxSteps > 0 && steps >= maxSteps {
+			return steps, vm.ErrBudgetExhausted
+		}
+		if done != nil && steps%vm.CtxCheckInterval == 0 {
+			select {
+			case <-done:
+				return steps, ctx.Err()
+			default:
+			}
+		}
+		if v.pc >= uint(len(program)) {
+			memoryFault(v, v.pc)
+			break
+		}
 		program[v.pc](v)
+		steps++
 	}
+	return steps, v.err
 }
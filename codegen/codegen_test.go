@@ -1,7 +1,13 @@
 package codegen
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 type Test struct {
@@ -16,13 +22,18 @@ func addTest(name string, init func() ([]uint, []func(*CGVM)), want map[uint]uin
 	tests = append(tests, Test{name, init, want})
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			mem, program := test.init()
 			v := New()
 			v.LoadMem(mem)
-			v.Run(program)
+			if _, err := v.RunLimit(context.Background(), program, maxTestSteps); err != nil {
+				t.Fatalf("RunLimit() err: %v", err)
+			}
 			for memLoc, wantValue := range test.want {
 				if v.mem[memLoc] != wantValue {
 					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
@@ -32,9 +43,123 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		program []func(*CGVM)
+		want    error
+	}{
+		{"outside memory", []func(*CGVM){
+			func(v *CGVM) { op_LDA(v, 0) },
+			func(v *CGVM) { op_STA(v, 40000) },
+		}, &vm.MemoryFault{PC: 1, Addr: 40000}},
+		{"indirect outside memory", []func(*CGVM){
+			func(v *CGVM) { op_LDA(v, calcIndirectAddr(v, 40000)) },
+		}, &vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"base index outside memory", []func(*CGVM){
+			func(v *CGVM) { op_LDA(v, calcBaseIndexAddr(v, 0, 40000)) },
+		}, &vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"outside program", []func(*CGVM){
+			func(v *CGVM) { op_JMP(v, 5) },
+		}, &vm.MemoryFault{PC: 5, Addr: 5}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := New()
+			err := v.Run(c.program)
+			if !reflect.DeepEqual(err, c.want) {
+				t.Errorf("Run() err got: %v, want: %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestRunLimit(t *testing.T) {
+	loop := []func(*CGVM){
+		func(v *CGVM) { op_INC(v, 0) },
+		func(v *CGVM) { op_JMP(v, 0) },
+	}
+	v := New()
+	steps, err := v.RunLimit(context.Background(), loop, 100)
+	if !errors.Is(err, vm.ErrBudgetExhausted) {
+		t.Errorf("RunLimit() err got: %v, want: %v", err, vm.ErrBudgetExhausted)
+	}
+	if steps != 100 || v.mem[0] != 50 {
+		t.Errorf("RunLimit() steps: %d, mem[0]: %d, want: 100, 50", steps, v.mem[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v = New()
+	if _, err := v.RunLimit(ctx, loop, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunLimit() err got: %v, want: %v", err, context.Canceled)
+	}
+
+	v = New()
+	steps, err = v.RunLimit(context.Background(), []func(*CGVM){
+		func(v *CGVM) { op_INC(v, 0) },
+		func(v *CGVM) { op_HLT(v, 0) },
+	}, 100)
+	if err != nil || steps != 2 {
+		t.Errorf("RunLimit() steps: %d, err: %v, want: 2, nil", steps, err)
+	}
+}
+
+func TestWithWordSize(t *testing.T) {
+	// mem[1] = mem[0] + mem[3], then HLT mem[3] if the sum is positive
+	// otherwise HLT mem[2]
+	program := []func(*CGVM){
+		func(v *CGVM) { op_LDA(v, 0) },
+		func(v *CGVM) { op_ADD(v, 3) },
+		func(v *CGVM) { op_STA(v, 1) },
+		func(v *CGVM) { op_JGT(v, 5) },
+		func(v *CGVM) { op_HLT(v, 2) },
+		func(v *CGVM) { op_HLT(v, 3) },
+	}
+	cases := []struct {
+		word    vm.Word
+		wantSum uint
+		wantHlt uint
+	}{
+		{defaultWord, 2048, 1},
+		{vm.MustWord(0), 2048, 1},
+		{vm.MustWord(12), 2048, 0},
+		{vm.MustWord(16), 2048, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.word.String(), func(t *testing.T) {
+			v := New(WithWordSize(c.word))
+			v.LoadMem([]uint{2047, 0, 0, 1})
+			if err := v.Run(program); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			if v.mem[1] != c.wantSum {
+				t.Errorf("sum got: %d, want: %d", v.mem[1], c.wantSum)
+			}
+			if v.hltVal != c.wantHlt {
+				t.Errorf("hltVal got: %d, want: %d", v.hltVal, c.wantHlt)
+			}
+		})
+	}
+
+	// Unsigned words wrap to 0 rather than going negative
+	v := New(WithWordSize(vm.MustWord(12)))
+	v.LoadMem([]uint{4095})
+	if err := v.Run([]func(*CGVM){
+		func(v *CGVM) { op_INC(v, 0) },
+		func(v *CGVM) { op_HLT(v, 0) },
+	}); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	if v.hltVal != 0 {
+		t.Errorf("hltVal got: %d, want: 0", v.hltVal)
+	}
+}
+
 func BenchmarkRun(t *testing.B) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.B) {
+			t.ReportAllocs()
 			t.StopTimer()
 			mem, program := test.init()
 			for n := 0; n < t.N; n++ {
@@ -42,8 +167,11 @@ func BenchmarkRun(t *testing.B) {
 				v.LoadMem(mem)
 
 				t.StartTimer()
-				v.Run(program)
+				err := v.Run(program)
 				t.StopTimer()
+				if err != nil {
+					t.Fatalf("Run() err: %v", err)
+				}
 
 				for memLoc, wantValue := range test.want {
 					if v.mem[memLoc] != wantValue {
@@ -54,3 +182,36 @@ func BenchmarkRun(t *testing.B) {
 		})
 	}
 }
+
+func TestAssembleListing(t *testing.T) {
+	src := "; Test\n" +
+		"start:  LDA  val\n" +
+		"        JGT  start\n" +
+		"        HLT  II val,neg\n" +
+		".data\n" +
+		"val:    10\n" +
+		"neg:    -1\n" +
+		"ptr:    val\n"
+	listing := &strings.Builder{}
+	opts := vm.AsmOptions{Filename: "test.asm", Listing: listing}
+	if _, err := Assemble(strings.NewReader(src), opts, nil); err != nil {
+		t.Fatalf("Assemble() err: %v", err)
+	}
+	want := "                              ; Test\n" +
+		"0000  code                    start:  LDA  val\n" +
+		"0001  code                            JGT  start\n" +
+		"0002  code                            HLT  II val,neg\n" +
+		"                              .data\n" +
+		"0000  data  a                 val:    10\n" +
+		"0001  data  ffffffffffffffff  neg:    -1\n" +
+		"0002  data  0                 ptr:    val\n" +
+		"\n" +
+		"Symbol  Seg   Addr  Defined  Used\n" +
+		"neg     data  0001  7        4\n" +
+		"ptr     data  0002  8\n" +
+		"start   code  0000  2        3\n" +
+		"val     data  0000  6        2 4 8\n"
+	if listing.String() != want {
+		t.Errorf("listing got:\n%s\nwant:\n%s", listing.String(), want)
+	}
+}
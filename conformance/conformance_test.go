@@ -0,0 +1,225 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/lawrencewoodman/go-vmcomparison/internal/suite"
+	"github.com/lawrencewoodman/go-vmcomparison/internal/target"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// root is the root directory of the repository
+const root = ".."
+
+// coverageFilename is where TestSuiteCoverage expects the routines that
+// each VM implements relative to root
+var coverageFilename = filepath.Join("testdata", "suite_coverage.txt")
+
+var update = flag.Bool("update", false, "rewrite "+coverageFilename)
+
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
+func TestSuite(t *testing.T) {
+	s := loadSuite(t)
+	for _, name := range s.Names() {
+		r := s.Routines[name]
+		for _, vmName := range target.Names() {
+			t.Run(name+"/"+vmName, func(t *testing.T) {
+				if reason, ok := r.Broken[vmName]; ok {
+					t.Skipf("broken: %s", reason)
+				}
+				if !r.Implements(vmName) {
+					t.Skip("not implemented, see " + coverageFilename)
+				}
+				checkRoutine(t, vmName, name, r)
+			})
+		}
+	}
+}
+
+// TestSuiteCoverage checks that coverageFilename lists the routines that
+// each VM implements so that gaps are seen when fixtures or the manifest
+// change.  The file is rewritten if -update is given.
+func TestSuiteCoverage(t *testing.T) {
+	s := loadSuite(t)
+	buf := &bytes.Buffer{}
+	if err := writeCoverage(buf, s); err != nil {
+		t.Fatalf("writeCoverage() err: %v", err)
+	}
+	filename := filepath.Join(root, coverageFilename)
+	if *update {
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("WriteFile() err: %v", err)
+		}
+		return
+	}
+	current, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() err: %v", err)
+	}
+	if !bytes.Equal(current, buf.Bytes()) {
+		t.Errorf("%s is out of date, check the changes and rerun with -update\n%s",
+			coverageFilename, buf)
+	}
+}
+
+// TestSuiteFixtures checks that the manifest and the fixtures agree
+func TestSuiteFixtures(t *testing.T) {
+	s := loadSuite(t)
+	for _, name := range s.Names() {
+		r := s.Routines[name]
+		for _, vmName := range append(r.VMs, sortedKeys(r.Broken)...) {
+			if _, err := target.Get(vmName); err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if _, err := os.Stat(suite.FixtureFilename(root, vmName, name)); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+		for _, vmName := range r.Generated {
+			if _, err := target.Get(vmName); err == nil {
+				t.Errorf("%s: generated VM is a target: %s", name, vmName)
+			}
+			if _, err := os.Stat(suite.FixtureFilename(root, vmName, name)); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+		for vmName := range r.Symbols {
+			if !r.Implements(vmName) {
+				t.Errorf("%s: symbols given for VM not implementing it: %s", name, vmName)
+			}
+		}
+	}
+
+	for _, vmName := range append(target.Names(), s.GeneratedVMs()...) {
+		filenames, err := filepath.Glob(filepath.Join(root, vmName, "fixtures", "*.asm"))
+		if err != nil {
+			t.Fatalf("Glob() err: %v", err)
+		}
+		for _, filename := range filenames {
+			name := strings.TrimSuffix(filepath.Base(filename), ".asm")
+			r, ok := s.Routines[name]
+			if !ok {
+				t.Errorf("%s: routine not in manifest: %s", vmName, name)
+				continue
+			}
+			_, broken := r.Broken[vmName]
+			if !broken && !r.Implements(vmName) && !r.Generates(vmName) {
+				t.Errorf("%s: fixture not in manifest for routine: %s", vmName, name)
+			}
+		}
+	}
+}
+
+// checkRoutine runs routine name on vmName and checks its symbols
+func checkRoutine(t *testing.T, vmName string, name string, r *suite.Routine) {
+	tgt, err := target.Get(vmName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := tgt.LoadFile(suite.FixtureFilename(root, vmName, name))
+	if err != nil {
+		t.Fatalf("LoadFile() err: %v", err)
+	}
+	v := tgt.New()
+	if err := v.LoadRoutine(code); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+		t.Fatalf("RunLimit() err: %v", err)
+	}
+	for _, symbol := range sortedKeys(r.Expect) {
+		want := r.Expect[symbol]
+		if s, ok := r.Symbols[vmName][symbol]; ok {
+			symbol = s
+		}
+		addr, err := code.DataAddr(symbol)
+		if err != nil {
+			t.Errorf("DataAddr() err: %v", err)
+			continue
+		}
+		got, err := v.ReadMem(addr)
+		if err != nil {
+			t.Errorf("ReadMem() err: %v", err)
+			continue
+		}
+		if !got.IsInt64() || got.Int64() != want {
+			t.Errorf("%s got: %s, want: %d", symbol, got, want)
+		}
+	}
+}
+
+// writeCoverage writes a table of the routines that each VM implements
+func writeCoverage(w io.Writer, s *suite.Suite) error {
+	vmNames := append(target.Names(), s.GeneratedVMs()...)
+	fmt.Fprintf(w, "Generated from %s by TestSuiteCoverage in conformance\n", suite.Filename)
+	fmt.Fprintf(w, "x: implemented, g: generated by the VM's own tests, ")
+	fmt.Fprintf(w, "b: broken, -: missing\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "\t%s\n", strings.Join(vmNames, "\t"))
+	for _, name := range s.Names() {
+		r := s.Routines[name]
+		cells := make([]string, len(vmNames))
+		for i, vmName := range vmNames {
+			_, broken := r.Broken[vmName]
+			switch {
+			case r.Implements(vmName):
+				cells[i] = "x"
+			case r.Generates(vmName):
+				cells[i] = "g"
+			case broken:
+				cells[i] = "b"
+			default:
+				cells[i] = "-"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, strings.Join(cells, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	missing := make(map[string][]string)
+	for _, name := range s.Names() {
+		r := s.Routines[name]
+		for _, vmName := range vmNames {
+			if !r.Implements(vmName) && !r.Generates(vmName) {
+				missing[vmName] = append(missing[vmName], name)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\nRoutines that each VM doesn't implement\n")
+	for _, vmName := range vmNames {
+		fmt.Fprintf(w, "%s: %s\n", vmName, strings.Join(missing[vmName], " "))
+	}
+	return nil
+}
+
+func loadSuite(t *testing.T) *suite.Suite {
+	t.Helper()
+	s, err := suite.Load(root)
+	if err != nil {
+		t.Fatalf("Load() err: %v", err)
+	}
+	return s
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
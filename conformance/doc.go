@@ -0,0 +1,17 @@
+/*
+ * Cross-VM conformance tests
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+// Package conformance runs every VM against the routines listed in
+// testdata/suite.json at the root of the repository.  Each routine lists
+// the values its symbols should have after it has run and which VMs have
+// a fixture implementing it.  Fixtures that a VM's own tests turn into
+// Go, such as those of codegen, are listed but not run here.  The
+// routines that each VM implements are listed in
+// testdata/suite_coverage.txt and the tests fail when it is out of date
+// so that gaps are seen.  Run the tests with -update to rewrite it.
+package conformance
@@ -0,0 +1,33 @@
+/*
+ * Helpers shared by the command-line tools
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+// Package cli holds what the command-line tools in cmd have in common
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// Fatal reports err and exits.  Assembler errors are reported one per
+// line.
+func Fatal(err error) {
+	var asmErrs vm.AsmErrors
+	if errors.As(err, &asmErrs) {
+		for _, e := range asmErrs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		fmt.Fprintf(os.Stderr, "%d errors\n", len(asmErrs))
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,112 @@
+/*
+ * The manifest of routines that the VMs implement
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+// Package suite reads testdata/suite.json, which lists each routine,
+// the values its symbols should have after it has run and which VMs
+// have a fixture implementing it
+package suite
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Filename is the location of the manifest relative to the root of the
+// repository
+var Filename = filepath.Join("testdata", "suite.json")
+
+// Routine is an entry in the manifest
+type Routine struct {
+	// Expect is the value of each symbol after the routine has run
+	Expect map[string]int64 `json:"expect"`
+	// VMs are the names of the VMs with a fixture for the routine
+	VMs []string `json:"vms"`
+	// Symbols renames the symbols in Expect for VMs whose fixture
+	// uses a different name: [vm][expect symbol]fixture symbol
+	Symbols map[string]map[string]string `json:"symbols"`
+	// Broken is the reason a VM's fixture can't currently be run
+	Broken map[string]string `json:"broken"`
+	// Generated are the names of the VMs with a fixture for the routine
+	// that their own tests turn into Go, such as codegen, so it can't be
+	// run through a target
+	Generated []string `json:"generated"`
+}
+
+// Suite is the manifest of routines
+type Suite struct {
+	Routines map[string]*Routine `json:"routines"`
+}
+
+// Load reads the manifest from the repository whose root is dir
+func Load(dir string) (*Suite, error) {
+	b, err := os.ReadFile(filepath.Join(dir, Filename))
+	if err != nil {
+		return nil, err
+	}
+	s := &Suite{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Names returns the sorted names of the routines
+func (s *Suite) Names() []string {
+	names := make([]string, 0, len(s.Routines))
+	for name := range s.Routines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GeneratedVMs returns the sorted names of the VMs that generate any
+// routine
+func (s *Suite) GeneratedVMs() []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, r := range s.Routines {
+		for _, n := range r.Generated {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Implements returns whether vmName has a fixture for the routine that
+// can be run through a target
+func (r *Routine) Implements(vmName string) bool {
+	return contains(r.VMs, vmName)
+}
+
+// Generates returns whether vmName has a fixture for the routine that
+// its own tests turn into Go
+func (r *Routine) Generates(vmName string) bool {
+	return contains(r.Generated, vmName)
+}
+
+// FixtureFilename returns the fixture of routine name for vmName in the
+// repository whose root is dir
+func FixtureFilename(dir string, vmName string, name string) string {
+	return filepath.Join(dir, vmName, "fixtures", name+".asm")
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
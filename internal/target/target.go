@@ -0,0 +1,182 @@
+/*
+ * The VMs that the command-line tools and tests can target
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package target
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/lawrencewoodman/go-vmcomparison/bsubleq2"
+	"github.com/lawrencewoodman/go-vmcomparison/bvm2"
+	"github.com/lawrencewoodman/go-vmcomparison/bvmstack"
+	"github.com/lawrencewoodman/go-vmcomparison/subleq"
+	"github.com/lawrencewoodman/go-vmcomparison/subleq2"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm1"
+	"github.com/lawrencewoodman/go-vmcomparison/vm2"
+	"github.com/lawrencewoodman/go-vmcomparison/vmstack"
+)
+
+// Target is a VM that routines can be assembled for
+type Target struct {
+	Name        string
+	Assemble    func(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error)
+	Disassemble func(w io.Writer, routine *vm.Routine) error
+	Save        func(w io.Writer, routine *vm.Routine) error
+	Load        func(r io.Reader) (*vm.Routine, error)
+	New         func() vm.Machine
+	NewWord     func(w vm.Word) vm.Machine // New with the given word size
+}
+
+var targets = map[string]*Target{
+	vm1.Name: {
+		Name:        vm1.Name,
+		Assemble:    vm1.Assemble,
+		Disassemble: vm1.Disassemble,
+		Save:        vm1.Save,
+		Load:        vm1.Load,
+		New:         func() vm.Machine { return vm1.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return vm1.New(vm1.WithWordSize(w)) },
+	},
+	vm2.Name: {
+		Name:        vm2.Name,
+		Assemble:    vm2.Assemble,
+		Disassemble: vm2.Disassemble,
+		Save:        vm2.Save,
+		Load:        vm2.Load,
+		New:         func() vm.Machine { return vm2.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return vm2.New(vm2.WithWordSize(w)) },
+	},
+	bvm2.Name: {
+		Name:        bvm2.Name,
+		Assemble:    bvm2.Assemble,
+		Disassemble: bvm2.Disassemble,
+		Save:        bvm2.Save,
+		Load:        bvm2.Load,
+		New:         func() vm.Machine { return bvm2.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return bvm2.New(bvm2.WithWordSize(w)) },
+	},
+	vmstack.Name: {
+		Name:        vmstack.Name,
+		Assemble:    vmstack.Assemble,
+		Disassemble: vmstack.Disassemble,
+		Save:        vmstack.Save,
+		Load:        vmstack.Load,
+		New:         func() vm.Machine { return vmstack.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return vmstack.New(vmstack.WithWordSize(w)) },
+	},
+	bvmstack.Name: {
+		Name:        bvmstack.Name,
+		Assemble:    bvmstack.Assemble,
+		Disassemble: bvmstack.Disassemble,
+		Save:        bvmstack.Save,
+		Load:        bvmstack.Load,
+		New:         func() vm.Machine { return bvmstack.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return bvmstack.New(bvmstack.WithWordSize(w)) },
+	},
+	subleq.Name: {
+		Name:        subleq.Name,
+		Assemble:    subleq.Assemble,
+		Disassemble: subleq.Disassemble,
+		Save:        subleq.Save,
+		Load:        subleq.Load,
+		New:         func() vm.Machine { return subleq.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return subleq.New(subleq.WithWordSize(w)) },
+	},
+	subleq2.Name: {
+		Name:        subleq2.Name,
+		Assemble:    subleq2.Assemble,
+		Disassemble: subleq2.Disassemble,
+		Save:        subleq2.Save,
+		Load:        subleq2.Load,
+		New:         func() vm.Machine { return subleq2.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return subleq2.New(subleq2.WithWordSize(w)) },
+	},
+	bsubleq2.Name: {
+		Name:        bsubleq2.Name,
+		Assemble:    bsubleq2.Assemble,
+		Disassemble: bsubleq2.Disassemble,
+		Save:        bsubleq2.Save,
+		Load:        bsubleq2.Load,
+		New:         func() vm.Machine { return bsubleq2.New() },
+		NewWord:     func(w vm.Word) vm.Machine { return bsubleq2.New(bsubleq2.WithWordSize(w)) },
+	},
+}
+
+// Get returns the target called name
+func Get(name string) (*Target, error) {
+	t, ok := targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target: %s", name)
+	}
+	return t, nil
+}
+
+// Names returns the sorted names of the targets
+func Names() []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadFile returns the routine in filename, which may be an object or
+// source to assemble
+func (t *Target) LoadFile(filename string) (*vm.Routine, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	routine, err := t.Load(bytes.NewReader(b))
+	if errors.Is(err, vm.ErrNotObject) {
+		return t.Assemble(bytes.NewReader(b), vm.AsmOptions{Filename: filename})
+	}
+	return routine, err
+}
+
+// NewMachine returns a new machine with the word size given by word,
+// which is either a number of bits, 0 or unbounded, or empty for the
+// target's default
+func (t *Target) NewMachine(word string) (vm.Machine, error) {
+	if word == "" {
+		return t.New(), nil
+	}
+	bits := uint64(0)
+	if word != "unbounded" {
+		var err error
+		bits, err = strconv.ParseUint(word, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid word size: %s", word)
+		}
+	}
+	w, err := vm.NewWord(uint(bits))
+	if err != nil {
+		return nil, err
+	}
+	return t.NewWord(w), nil
+}
+
+// DataAddr returns the data memory address given by s, which is either
+// a number or a symbol
+func DataAddr(routine *vm.Routine, s string) (int64, error) {
+	if addr, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return addr, nil
+	}
+	if addr, err := routine.DataAddr(s); err == nil {
+		return addr, nil
+	}
+	return 0, fmt.Errorf("unknown address: %s", s)
+}
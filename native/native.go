@@ -4,22 +4,75 @@
 
 package native
 
-// TODO: Make this configurable
-const memSize = 32000
+import "context"
+
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type Native struct {
-	mem [memSize]uint // Memory
-	pc  uint          // Program Counter
+	mem     []uint          // Memory
+	memSize uint            // Number of words of memory
+	pc      uint            // Program Counter
+	done    <-chan struct{} // Closed when a routine should stop, see RunContext
+	stopped bool            // Whether a routine stopped because done was closed
+}
+
+// Option configures a Native when passed to New
+type Option func(*Native)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n uint) Option {
+	return func(v *Native) {
+		v.memSize = n
+	}
 }
 
-func New() *Native {
-	return &Native{}
+func New(opts ...Option) *Native {
+	v := &Native{memSize: defaultMemSize}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.memSize == 0 {
+		panic("invalid memory size: 0")
+	}
+	v.mem = make([]uint, v.memSize)
+	return v
 }
 
 func (v *Native) LoadMem(mem []uint) {
 	copy(v.mem[:], mem)
 }
 
+// RunContext runs action until it returns or ctx is done.  Native
+// routines aren't made up of instructions so can't be given a step budget.
+// Only actions that check, such as a Routine's Stoppable action, return
+// early when ctx is done, in which case ctx.Err() is returned.  The rest
+// always run to the end.
+func (v *Native) RunContext(ctx context.Context, action func(*Native)) error {
+	v.done, v.stopped = ctx.Done(), false
+	defer func() { v.done = nil }()
+	action(v)
+	if v.stopped {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// shouldStop returns whether a routine should return early because the
+// context passed to RunContext is done.  Stoppable actions call it every
+// vm.CtxCheckInterval iterations as calling it more often would slow them
+// too much.
+func (v *Native) shouldStop() bool {
+	select {
+	case <-v.done:
+		v.stopped = true
+		return true
+	default:
+		return false
+	}
+}
+
 // Returns the lower 12-bits
 func mask12(w uint) uint {
 	return w & 0o7777
@@ -0,0 +1,256 @@
+/*
+ * The routines implemented natively, keyed by the stub names of the VM
+ * fixtures that implement them
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package native
+
+import (
+	"math"
+	"sort"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// Routine is a routine implemented natively to compare with the VMs
+type Routine struct {
+	// Init returns the initial memory and the routine to run on it
+	Init   func() ([]uint, func(v *Native))
+	Want   map[uint]uint // [memloc]value after the routine has run
+	WantPC uint          // The PC after the routine has run
+	// Stoppable is Init's action checking whether RunContext's ctx is
+	// done, nil if the action finishes quickly.  The check is kept out
+	// of Init's action so that it isn't benchmarked.
+	Stoppable func(v *Native)
+}
+
+// routines are keyed by the stub name of the VM fixtures, the part of
+// the fixture's name before the first '_'
+var routines = map[string]*Routine{
+	"add12":     {initAdd12, map[uint]uint{1: 4}, 0, nil},
+	"and":       {initAnd, map[uint]uint{0: 4499}, 0, nil},
+	"tad":       {initTad, map[uint]uint{0: 32}, 0, nil},
+	"isz":       {initIsz, map[uint]uint{0: 24}, 0, nil},
+	"jsr":       {initJsr, map[uint]uint{0: 50}, 0, nil},
+	"loopuntil": {initLoopUntil, map[uint]uint{0: 5000}, 0, stoppableLoopUntil},
+	"subleq":    {initSubleq, map[uint]uint{14: 5000}, 0, stoppableSubleq},
+	"switch":    {initSwitch, map[uint]uint{0: 2255}, 0, nil},
+}
+
+// Get returns the routine for stubName
+func Get(stubName string) (*Routine, bool) {
+	r, ok := routines[stubName]
+	return r, ok
+}
+
+// Names returns the sorted stub names of the routines
+func Names() []string {
+	names := make([]string, 0, len(routines))
+	for name := range routines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func initIsz() ([]uint, func(v *Native)) {
+	mem := []uint{
+		23, // opAddr
+	}
+	action := func(v *Native) {
+		opAddr := 0
+		v.mem[opAddr] = mask12(v.mem[opAddr] + 1)
+		if v.mem[opAddr] == 0 {
+			v.pc = mask12(v.pc + 1)
+		}
+	}
+	return mem, action
+}
+
+func initLoopUntil() ([]uint, func(v *Native)) {
+	mem := []uint{
+		0, // sum
+		0, // cnt
+	}
+	action := func(v *Native) {
+		for v.mem[1] = 5000; v.mem[1] != 0; v.mem[1]-- {
+			v.mem[0] += 1
+		}
+	}
+	return mem, action
+}
+
+// stoppableLoopUntil is the action of initLoopUntil checking whether
+// RunContext's ctx is done every vm.CtxCheckInterval iterations
+func stoppableLoopUntil(v *Native) {
+	for v.mem[1] = 5000; v.mem[1] != 0; v.mem[1]-- {
+		if v.mem[1]%vm.CtxCheckInterval == 0 && v.shouldStop() {
+			return
+		}
+		v.mem[0] += 1
+	}
+}
+
+func initAnd() ([]uint, func(v *Native)) {
+	mem := []uint{
+		4503, // lac
+		3003, // value
+	}
+	action := func(v *Native) {
+		opAddr := 1
+		v.mem[0] &= v.mem[opAddr] | 0o10000
+	}
+	return mem, action
+}
+
+func initTad() ([]uint, func(v *Native)) {
+	mem := []uint{
+		9,  // lac
+		23, // value
+	}
+	action := func(v *Native) {
+		opAddr := 1
+		v.mem[0] = mask13(v.mem[0] + v.mem[opAddr])
+	}
+	return mem, action
+}
+
+func initSubleq() ([]uint, func(v *Native)) {
+	mem := []uint{
+		// loopuntil_v1 from subleq/fixtures/
+		// program
+		15,
+		13,
+		3,
+		16,
+		14,
+		6,
+		16,
+		13,
+		3,
+		16,
+		1000,
+		12,
+		0,
+		0,
+		0, // sum
+		4999,
+		math.MaxUint32, // -1
+	}
+	action := func(v *Native) {
+		var hltVal uint
+		pc := uint(0)
+		for {
+			operandA := v.mem[pc]
+			operandB := v.mem[pc+1]
+			operandC := v.mem[pc+2]
+			v.mem[operandB] = mask32(v.mem[operandB] - v.mem[operandA])
+			// If hlt location
+			if operandB == 1000 {
+				hltVal = v.mem[operandB]
+				break
+			}
+			if v.mem[operandB] == 0 || v.mem[operandB] > math.MaxInt32 {
+				pc = operandC
+			} else {
+				pc += 3
+			}
+		}
+		if hltVal != 1 {
+			panic("htlVal != 1")
+		}
+	}
+	return mem, action
+}
+
+// stoppableSubleq is the action of initSubleq checking whether
+// RunContext's ctx is done every vm.CtxCheckInterval steps
+func stoppableSubleq(v *Native) {
+	var hltVal uint
+	pc := uint(0)
+	for steps := 0; ; steps++ {
+		if steps%vm.CtxCheckInterval == 0 && v.shouldStop() {
+			return
+		}
+		operandA := v.mem[pc]
+		operandB := v.mem[pc+1]
+		operandC := v.mem[pc+2]
+		v.mem[operandB] = mask32(v.mem[operandB] - v.mem[operandA])
+		// If hlt location
+		if operandB == 1000 {
+			hltVal = v.mem[operandB]
+			break
+		}
+		if v.mem[operandB] == 0 || v.mem[operandB] > math.MaxInt32 {
+			pc = operandC
+		} else {
+			pc += 3
+		}
+	}
+	if hltVal != 1 {
+		panic("htlVal != 1")
+	}
+}
+
+func initAdd12() ([]uint, func(v *Native)) {
+	mem := []uint{
+		4094, // a
+		6,    // b
+	}
+	action := func(v *Native) {
+		v.mem[1] = mask12(v.mem[0] + v.mem[1])
+	}
+	return mem, action
+}
+
+// Used by initJsr
+// The go:noinline directive is there so that we actually test a subroutine rather than
+// just having the routine inlined in the code
+//
+//go:noinline
+func setVal(v *Native, n uint) {
+	v.mem[0] = n
+}
+
+func initJsr() ([]uint, func(v *Native)) {
+	mem := []uint{
+		0, // val
+	}
+	action := func(v *Native) {
+		setVal(v, 50)
+	}
+	return mem, action
+}
+
+func initSwitch() ([]uint, func(v *Native)) {
+	mem := []uint{
+		3, // lac
+	}
+	action := func(v *Native) {
+		for i := 8; i != 0; i-- {
+			switch i - 1 {
+			case 0:
+				v.mem[0] += 11
+			case 1:
+				v.mem[0] += 23
+			case 2:
+				v.mem[0] += 56
+			case 3:
+				v.mem[0] += 79
+			case 4:
+				v.mem[0] += 123
+			case 5:
+				v.mem[0] += 367
+			case 6:
+				v.mem[0] += 592
+			case 7:
+				v.mem[0] += 1001
+			}
+		}
+	}
+	return mem, action
+}
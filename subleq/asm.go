@@ -9,213 +9,109 @@
 package subleq
 
 import (
-	"bufio"
-	"fmt"
+	"io"
+	"math/big"
 	"os"
-	"regexp"
-	"strconv"
-)
+	"strings"
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
+var syntax = &asm.Syntax{}
 
-	sc := bufio.NewScanner(f)
+// encoder implements asm.Encoder
+type encoder struct{}
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
+// A statement with one operand is data, otherwise it is an instruction
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	if len(stmt.Operands) == 1 {
+		return 1
 	}
+	return 3
+}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if len(stmt.Operands) == 1 {
+		// If there is a literal value, symbol or expression
+		n, err := syms.Eval(stmt.Operands[0])
+		return []*big.Int{n}, err
 	}
-	return lines, nil
+	code, err := asmInstr(syms, addr, stmt)
+	return asm.Words(code...), err
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
-var reInstr2 = regexp.MustCompile(`^\s*([0-9a-zA-Z\-\+]+)\s+([0-9a-zA-Z\-\+]+)`)
-var reInstr3 = regexp.MustCompile(`^\s*([0-9a-zA-Z\-\+]+)\s+([0-9a-zA-Z\-\+]+)\s+([0-9a-zA-Z\-\+]+)`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+).*`)
-var reSymbol = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*).*`)
-var reExpr = regexp.MustCompile(`^\s*([0-9a-zA-z]+)([\-\+])([0-9a-zA-Z]+)`)
-
-// Build symbol table
-func pass1(srcLines []string) map[string]int {
-	pos := 0
-	symbols := make(map[string]int, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			symbols[label] = pos
-			line = line[matchIndices[1]:]
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return syms.EvalInt64(operand)
+	case asm.Symbol:
+		if v, ok := syms.Lookup(operand.Name); ok {
+			return v, nil
 		}
-		if reInstr3.MatchString(line) || reInstr2.MatchString(line) {
-			// If there is an instruction
-			pos += 3
-		} else if reExpr.MatchString(line) {
-			// If there is an expression
-			pos++
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			pos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			pos++
+	case asm.Binary:
+		// If operand is an expression
+		a, err := resolveOperand(syms, operand.X)
+		if err != nil {
+			return 0, err
 		}
-
-	}
-	return symbols
-}
-
-func pass2(srcLines []string, symbols map[string]int) []int {
-	pos := 0
-	lineNum := 0
-	code := make([]int, 0)
-	for _, line := range srcLines {
-		lineNum++
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
+		b, err := resolveOperand(syms, operand.Y)
+		if err != nil {
+			return 0, err
 		}
-		if reInstr3.MatchString(line) {
-			// If there is a 3 operand instruction
-			operandA := reInstr3.FindStringSubmatch(line)[1]
-			operandB := reInstr3.FindStringSubmatch(line)[2]
-			operandC := reInstr3.FindStringSubmatch(line)[3]
-			matchIndices := reInstr3.FindStringSubmatchIndex(line)
-			line = line[matchIndices[7]:]
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(symbols, operandA, operandB, operandC)...)
-			pos += 3
-		} else if reInstr2.MatchString(line) {
-			// If there is a 2 operand instruction
-			operandA := reInstr2.FindStringSubmatch(line)[1]
-			operandB := reInstr2.FindStringSubmatch(line)[2]
-			operandC := strconv.Itoa(pos + 3)
-			matchIndices := reInstr2.FindStringSubmatchIndex(line)
-			line = line[matchIndices[5]:]
-			if len(line) > 0 {
-				panic(fmt.Sprintf("line number: %d, remaining line: %s", lineNum, line))
-			}
-			code = append(code, asmInstr(symbols, operandA, operandB, operandC)...)
-			pos += 3
-		} else if reExpr.MatchString(line) {
-			// If there is an expression
-			a := reExpr.FindStringSubmatch(line)[1]
-			op := reExpr.FindStringSubmatch(line)[2]
-			b := reExpr.FindStringSubmatch(line)[3]
-			code = append(code, resolveExpr(symbols, a, op, b))
-			pos++
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			i64, err := strconv.ParseInt(lit, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			code = append(code, int(i64))
-			pos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			v, ok := symbols[sym]
-			if !ok {
-				panic(fmt.Sprintf("unknown symbol: %s", sym))
-			}
-
-			code = append(code, v)
+		if operand.Op == '-' {
+			return a - b, nil
 		}
-
+		return a + b, nil
 	}
-	return code
+	return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func resolveOperand(symbols map[string]int, operand string) int {
-	if reExpr.MatchString(operand) {
-		// If operand is an expression
-		a := reExpr.FindStringSubmatch(operand)[1]
-		op := reExpr.FindStringSubmatch(operand)[2]
-		b := reExpr.FindStringSubmatch(operand)[3]
-		return resolveExpr(symbols, a, op, b)
-	} else if reLiteral.MatchString(operand) {
-		// If operand is a literal value
-		i64, err := strconv.ParseUint(operand, 10, 64)
+// If operand C is missing it is set to the address of the next instruction
+func asmInstr(syms *asm.Symbols, addr int64, stmt *asm.Stmt) ([]int64, error) {
+	code := []int64{0, 0, addr + 3}
+	if err := stmt.CheckOperands(2, 3); err != nil {
+		return code, err
+	}
+	for i, operand := range stmt.Operands {
+		n, err := resolveOperand(syms, operand)
 		if err != nil {
-			panic(err)
+			return code, err
 		}
-		return int(i64)
-	}
-	v, ok := symbols[operand]
-	if !ok {
-		panic(fmt.Sprintf("unknown operand: %s", operand))
+		code[i] = n
 	}
-	return v
+	return code, nil
 }
 
-func resolveExpr(symbols map[string]int, a, op, b string) int {
-	aVal := resolveOperand(symbols, a)
-	bVal := resolveOperand(symbols, b)
-	switch op {
-	case "+":
-		return aVal + bVal
-	case "-":
-		return aVal - bVal
-	default:
-		panic(fmt.Sprintf("unknown op: %s", op))
-	}
-}
-
-func asmInstr(symbols map[string]int, operandA string, operandB string, operandC string) []int {
-	code := []int{
-		resolveOperand(symbols, operandA),
-		resolveOperand(symbols, operandB),
-		resolveOperand(symbols, operandC),
-	}
-	return code
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
 }
 
-func printCode(code []int) {
-	fmt.Printf("\nCODE\n====")
-	for i, v := range code {
-		if i%10 == 0 {
-			fmt.Printf("\n%03d: ", i)
-		}
-		fmt.Printf("%4d ", v)
-	}
-	fmt.Printf("\n")
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func printSymbols(symbols map[string]int) {
-	fmt.Printf("Symbols\n=======\n")
-	for k, v := range symbols {
-		fmt.Printf("%s: %d\n", k, v)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("\n")
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
 }
 
-func asm(filename string) ([]int, map[string]int, error) {
-	srcLines, err := readFile(filename)
-	if err != nil {
-		return []int{}, map[string]int{}, err
-	}
-	symbols := pass1(srcLines)
+// Name identifies this VM in object files
+const Name = "subleq"
 
-	code := pass2(srcLines, symbols)
-	//	printSymbols(symbols)
-	//	printCode(code)
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
 
-	return code, symbols, nil
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
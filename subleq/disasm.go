@@ -0,0 +1,38 @@
+/*
+ * A disassembler for this VM
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package subleq
+
+import (
+	"io"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// decoder implements asm.Decoder
+type decoder struct{}
+
+// An instruction is operands A B C, where C is left out if it is the
+// address of the next instruction
+func (decoder) Decode(code []int64, addr int64, names *asm.Names) (asm.Instr, int64, bool) {
+	if addr+2 >= int64(len(code)) {
+		return asm.Instr{}, 0, false
+	}
+	a, b, c := code[addr], code[addr+1], code[addr+2]
+	instr := asm.Instr{Operands: []string{names.Data(a), names.Data(b)}}
+	if c != addr+3 {
+		instr.Operands = append(instr.Operands, names.Code(c))
+	}
+	return instr, 3, true
+}
+
+// Disassemble writes the source for routine to w
+func Disassemble(w io.Writer, routine *vm.Routine) error {
+	return asm.Disassemble(w, routine, decoder{})
+}
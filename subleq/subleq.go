@@ -8,105 +8,248 @@
 
 package subleq
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
 
-// TODO: Make this configurable
-const memSize = 32000
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
+
+// The width of words unless set with WithWordSize
+var defaultWord = vm.MustWord(32)
 
 // Location in memory of hltVal
 // If this is used as a destination location then a HLT is executed
 const hltLoc = 1000
 
 type SUBLEQ struct {
-	mem     [memSize]int   // Memory
-	pc      int            // Program Counter
-	hltVal  int            // A value returned by HLT
-	symbols map[string]int // The symbols table from the assembler - added because of difficulty debugging
+	mem     []int64     // Memory
+	memSize int64       // Number of words of memory
+	pc      int64       // Program Counter
+	hltVal  int64       // A value returned by HLT
+	word    vm.Word     // Width of words, results of SUBLEQ wrap to fit
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*SUBLEQ)(nil)
+
+// Option configures a SUBLEQ when passed to New
+type Option func(*SUBLEQ)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *SUBLEQ) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *SUBLEQ) {
+		v.stats = vm.NewStats()
+	}
+}
+
+// WithWordSize sets the width of words, which is 32 bits by default.
+// The result of each subtraction wraps around to fit and is signed when
+// compared with 0.  Words loaded from a routine are stored as they are
+// but are still signed when compared.
+func WithWordSize(w vm.Word) Option {
+	return func(v *SUBLEQ) {
+		v.word = w
+	}
 }
 
-func New() *SUBLEQ {
-	return &SUBLEQ{}
+func New(opts ...Option) *SUBLEQ {
+	v := &SUBLEQ{memSize: defaultMemSize, word: defaultWord}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.mem = make([]int64, v.memSize)
+	return v
 }
 
+// Step executes a single instruction
+// Returns: hlt, error
 func (v *SUBLEQ) Step() (bool, error) {
-	operandA, operandB, operandC, err := v.fetch()
-	if err != nil {
-		return false, err
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
 	}
-	return v.execute(operandA, operandB, operandC), nil
+	return v.step()
 }
 
-func (v *SUBLEQ) Run() error {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
-			return err
-		}
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *SUBLEQ) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of operands A and B
+func (v *SUBLEQ) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.mem, v.pc, v.names)
+	operandA, operandB, _, err := v.fetch()
+	if err != nil {
+		return instr, nil
 	}
+	return instr, []int64{operandA, operandB}
+}
+
+// Registers returns the value of each register other than the PC, of
+// which there are none
+func (v *SUBLEQ) Registers() []vm.Register {
 	return nil
 }
 
-func (v *SUBLEQ) LoadRoutine(routine []int, symbols map[string]int) {
-	copy(v.mem[:], routine)
-	v.symbols = symbols
+// step executes a single instruction.  It fetches the operands itself,
+// rather than calling fetch, so that the compiler can see that they are in
+// range and drop its own checks.  This is noticeably quicker.
+// Returns: hlt, error
+func (v *SUBLEQ) step() (bool, error) {
+	mem := v.mem
+	pc := v.pc
+	if pc < 0 || pc+2 >= int64(len(mem)) {
+		return false, &vm.MemoryFault{PC: pc, Addr: pc + 2}
+	}
+	operandA := mem[pc]
+	operandB := mem[pc+1]
+	operandC := mem[pc+2]
+	if operandA < 0 || operandA >= int64(len(mem)) {
+		return false, &vm.MemoryFault{PC: pc, Addr: operandA}
+	}
+	if operandB < 0 || operandB >= int64(len(mem)) {
+		return false, &vm.MemoryFault{PC: pc, Addr: operandB}
+	}
+	if operandC < 0 || operandC >= int64(len(mem)) {
+		return false, &vm.MemoryFault{PC: pc, Addr: operandC}
+	}
+	result := v.word.Wrap(mem[operandB] - mem[operandA])
+	mem[operandB] = result
+	if operandB == hltLoc {
+		v.hltVal = result
+		return true, nil
+	}
+	if result <= 0 {
+		v.pc = operandC
+	} else {
+		v.pc = pc + 3
+	}
+	return false, nil
+}
+
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
+func (v *SUBLEQ) Run() (bool, error) {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
+			return hlt, err
+		}
+	}
 }
 
-// fetch gets the next instruction from memory
-// Returns: A, B, C
-// NOTE: this routine doesn't use mask32
-func (v *SUBLEQ) fetch() (int, int, int, error) {
-	if v.pc+2 >= memSize {
-		return 0, 0, 0, fmt.Errorf("outside memory range: %d", v.pc)
+func (v *SUBLEQ) LoadRoutine(r *vm.Routine) error {
+	if len(r.Data) > 0 {
+		return fmt.Errorf("routine has separate data, not supported")
+	}
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine too big for memory: %d", len(r.Code))
 	}
-	operandA := v.mem[v.pc]
-	operandB := v.mem[v.pc+1]
-	operandC := v.mem[v.pc+2]
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
+}
 
-	if operandA < 0 || operandA >= memSize {
-		return 0, 0, 0, fmt.Errorf("outside memory range: %d", operandA)
+func (v *SUBLEQ) Reset() {
+	for i := range v.mem {
+		v.mem[i] = 0
 	}
-	if operandB < 0 || operandB >= memSize {
-		return 0, 0, 0, fmt.Errorf("outside memory range: %d", operandB)
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.mem[:], v.routine.Code)
+		v.pc = v.routine.Entry
 	}
-	if operandC < 0 || operandC >= memSize {
-		return 0, 0, 0, fmt.Errorf("outside memory range: %d", operandC)
+	v.hltVal = 0
+	if v.stats != nil {
+		v.stats = vm.NewStats()
 	}
+}
 
-	return operandA, operandB, operandC, nil
+func (v *SUBLEQ) HltVal() *big.Int {
+	return big.NewInt(v.hltVal)
 }
 
-// Maintain 32 bits
-// Used rather than basing on int32 to maintain parity across other language platforms
-func maintain32(n int) int {
-	return int(int32(n))
+func (v *SUBLEQ) PC() int64 {
+	return v.pc
 }
 
-func (v *SUBLEQ) addr2symbol(addr int) string {
-	for k, v := range v.symbols {
-		if v == addr {
-			return k
-		}
+func (v *SUBLEQ) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *SUBLEQ) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
 	}
-	return fmt.Sprintf("%d", addr)
+	return big.NewInt(v.mem[addr]), nil
 }
 
-// execute executes the supplied instruction
-// Returns: hlt, error
-func (v *SUBLEQ) execute(operandA int, operandB int, operandC int) bool {
-	//	fmt.Printf("PC: %7s    SUBLEQ %7s, %7s, %7s\n", v.addr2symbol(v.pc), v.addr2symbol(operandA), v.addr2symbol(operandB), v.addr2symbol(operandC))
-	//	fmt.Printf("           %d (%b) - %d (%b) = ", v.mem[operandB], v.mem[operandB], v.mem[operandA], v.mem[operandA])
-	v.mem[operandB] = maintain32(v.mem[operandB] - v.mem[operandA])
-	//	fmt.Printf("%d (%b)\n", v.mem[operandB], v.mem[operandB])
-	if operandB == hltLoc {
-		v.hltVal = v.mem[operandB]
-		return true
+func (v *SUBLEQ) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
 	}
-	if v.mem[operandB] <= 0 {
-		v.pc = operandC
-	} else {
-		v.pc = v.pc + 3
+	if !n.IsInt64() {
+		return fmt.Errorf("value not int64: %s", n)
+	}
+	v.mem[addr] = v.word.Wrap(n.Int64())
+	return nil
+}
+
+// fetch gets the next instruction from memory for Decode, step fetches
+// its own operands
+// Returns: A, B, C
+// NOTE: the operands are addresses so aren't wrapped to the word size
+func (v *SUBLEQ) fetch() (int64, int64, int64, error) {
+	mem := v.mem
+	pc := v.pc
+	if pc < 0 || pc+2 >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: pc, Addr: pc + 2}
+	}
+	operandA := mem[pc]
+	operandB := mem[pc+1]
+	operandC := mem[pc+2]
+
+	if operandA < 0 || operandA >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: pc, Addr: operandA}
 	}
-	return false
+	if operandB < 0 || operandB >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: pc, Addr: operandB}
+	}
+	if operandC < 0 || operandC >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: pc, Addr: operandC}
+	}
+
+	return operandA, operandB, operandC, nil
 }
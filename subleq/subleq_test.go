@@ -1,77 +1,256 @@
 package subleq
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var tests = []struct {
 	filename string
-	want     map[int]int // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"loopuntil_v1.asm", map[int]int{14: 5000}},
-	{"add12_v1.asm", map[int]int{29: 4}},
-	{"isz_v1.asm", map[int]int{116: 9, 117: 24}},
-	{"jsr_v1.asm", map[int]int{22: 50}},
-	{"tad_v1.asm", map[int]int{43: 32}},
-	{"subleq_v1.asm", map[int]int{171: 5000}},
-	{"subleq_v2.asm", map[int]int{160: 5000}},
-	{"switch_v1.asm", map[int]int{138: 2255}},
-	{"switch_v2.asm", map[int]int{98: 2255}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v2.asm", map[string]int64{"sum": 5000}},
+	{"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.filename, func(t *testing.T) {
-			routine, symbols, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(routine, symbols)
-			if err := v.Run(); err != nil {
-				t.Fatalf("Run() err: %v", err)
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+				t.Fatalf("RunLimit() err: %v", err)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc] != wantValue {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr] != wantValue {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 				}
 			}
 		})
 	}
 }
 
+func TestDisassemble(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("AssembleFile() err: %v", err)
+			}
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+		})
+	}
+}
+
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "n n", "[]", "[]"},
+		{3, "lm50 n", "[]", "[{38 0 50}]"},
+		{6, "25 25", "[]", "[]"},
+		{9, "lmdone 25", "[]", "[{25 0 15}]"},
+		{12, "z z setVal", "[]", "[]"},
+		{26, "val val", "[]", "[]"},
+		{29, "n z", "[]", "[{18 0 -50}]"},
+		{32, "z val", "[]", "[{22 0 50}]"},
+		{35, "z z sret", "[]", "[{18 -50 0}]"},
+		{23, "z z done", "[]", "[]"},
+		{15, "lm1 1000", "[]", "[{1000 0 -1}]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps:          11,
+		Opcodes:        map[string]int64{"SUBLEQ": 11},
+		Reads:          22,
+		Writes:         11,
+		Taken:          3,
+		NotTaken:       7,
+		StackHighWater: map[string]int64{},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+}
+
 func BenchmarkRun(b *testing.B) {
 	for _, test := range tests {
-		routine, symbols, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(routine, symbols)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
-				err := v.Run()
+				_, err := v.Run()
 				b.StopTimer()
 
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc] != wantValue {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr] != wantValue {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(routine))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
+	}
+}
+
+func TestWithWordSize(t *testing.T) {
+	// b -= a, then HLT 1 if b <= 0 otherwise HLT 0
+	routine := &vm.Routine{
+		Code: []int64{
+			9, 10, 6,
+			11, hltLoc, 0,
+			12, hltLoc, 0,
+			1, -2048, 0, -1,
+		},
+	}
+	cases := []struct {
+		word    vm.Word
+		wantB   int64
+		wantHlt int64
+	}{
+		{New().word, -2049, 1},
+		{vm.MustWord(0), -2049, 1},
+		{vm.MustWord(12), 2047, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.word.String(), func(t *testing.T) {
+			v := New(WithWordSize(c.word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			if v.mem[10] != c.wantB {
+				t.Errorf("b got: %d, want: %d", v.mem[10], c.wantB)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
+		})
 	}
 }
 
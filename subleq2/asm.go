@@ -9,228 +9,92 @@
 package subleq2
 
 import (
-	"bufio"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
-	"regexp"
-	"sort"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
+var syntax = &asm.Syntax{SplitData: true}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
+// encoder implements asm.Encoder
+type encoder struct{}
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
+// A statement with one operand is data, otherwise it is an instruction
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	isInstr := len(stmt.Operands) != 1
+	if isInstr && seg == asm.CodeSegment {
+		return 3
+	} else if !isInstr && seg == asm.DataSegment {
+		return 1
 	}
-
-	if err := sc.Err(); err != nil {
-		return []string{}, err
-	}
-	return lines, nil
+	return 0
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-z]*):`)
-var reInstr2 = regexp.MustCompile(`^\s*([\[\]0-9a-zA-Z\-\+]+)\s+([\[\]0-9a-zA-Z\-\+]+)`)
-var reInstr3 = regexp.MustCompile(`^\s*([\[\]0-9a-zA-Z\-\+]+)\s+([\[\]0-9a-zA-Z\-\+]+)\s+([\[\]0-9a-zA-Z\-\+]+)`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+).*`)
-var reExpr = regexp.MustCompile(`^\s*([0-9a-zA-z]+)([\-\+])([0-9a-zA-Z]+)`)
-var reDirective = regexp.MustCompile(`^\.([a-zA-Z]+)$`)
-var reIndirect = regexp.MustCompile(`^\s*(\[([0-9a-zA-z\-\+]+)\])`)
-
-// Build symbol tables
-func pass1(srcLines []string) (map[string]int64, map[string]int64) {
-	symbolType := "c"
-	var dataPos int64 = 0
-	var codePos int64 = 0
-	codeSymbols := make(map[string]int64, 0)
-	dataSymbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				symbolType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
-		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			if symbolType == "c" {
-				codeSymbols[label] = codePos
-			} else {
-				dataSymbols[label] = dataPos
-			}
-			line = line[matchIndices[1]:]
-		}
-		if reInstr3.MatchString(line) || reInstr2.MatchString(line) {
-			// If there is an instruction
-			codePos += 3
-		} else if reExpr.MatchString(line) {
-			// If there is an expression
-			dataPos++
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			dataPos++
-		}
-
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if len(stmt.Operands) == 1 {
+		return asmData(seg, syms, stmt.Operands[0])
 	}
-	return codeSymbols, dataSymbols
+	if seg != asm.CodeSegment {
+		return nil, vm.NewAsmError(stmt.Operands[0].Pos, stmt.Operands[0].Text, "instruction inside .data")
+	}
+	code, err := asmInstr(syms, addr, stmt)
+	return asm.Words(code...), err
 }
 
-func pass2(srcLines []string, codeSymbols, dataSymbols map[string]int64) ([]int64, []int64) {
-	outputType := "c"
-	code := make([]int64, 0)
-	data := make([]int64, 0)
-	codePos := 0
-	lineNum := 0
-
-	for _, line := range srcLines {
-		// fmt.Printf("%s\n", line)
-		lineNum++
-		// If there is a directive
-		if reDirective.MatchString(line) {
-			directive := reDirective.FindStringSubmatch(line)[1]
-			if directive == "data" {
-				outputType = "d"
-			} else {
-				panic(fmt.Sprintf("unknown directive: .%s", directive))
-			}
+// asmData assembles a literal value or expression
+func asmData(seg asm.Segment, syms *asm.Symbols, operand *asm.Expr) ([]*big.Int, error) {
+	if seg != asm.DataSegment {
+		if operand.Kind == asm.Literal {
+			return nil, vm.NewAsmError(operand.Pos, operand.Text, "literal outside of .data")
 		}
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		if reInstr3.MatchString(line) {
-			// If there is a 3 operand instruction
-			operandA := reInstr3.FindStringSubmatch(line)[1]
-			operandB := reInstr3.FindStringSubmatch(line)[2]
-			operandC := reInstr3.FindStringSubmatch(line)[3]
-			matchIndices := reInstr3.FindStringSubmatchIndex(line)
-			line = line[matchIndices[7]:]
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(codeSymbols, dataSymbols, operandA, operandB, operandC)...)
-			codePos += 3
-		} else if reInstr2.MatchString(line) {
-			// If there is a 2 operand instruction
-			operandA := reInstr2.FindStringSubmatch(line)[1]
-			operandB := reInstr2.FindStringSubmatch(line)[2]
-			operandC := strconv.Itoa(codePos + 3)
-			matchIndices := reInstr2.FindStringSubmatchIndex(line)
-			line = line[matchIndices[5]:]
-			if len(line) > 0 {
-				panic(fmt.Sprintf("line number: %d, remaining line: %s", lineNum, line))
-			}
-			code = append(code, asmInstr(codeSymbols, dataSymbols, operandA, operandB, operandC)...)
-			codePos += 3
-		} else if reExpr.MatchString(line) {
-			// If there is an expression
-			a := reExpr.FindStringSubmatch(line)[1]
-			op := reExpr.FindStringSubmatch(line)[2]
-			b := reExpr.FindStringSubmatch(line)[3]
-			if outputType == "d" {
-				data = append(data, resolveExpr(codeSymbols, dataSymbols, a, op, b))
-			} else {
-				panic("expression shouldn't appear here")
-			}
-
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			num, err := strconv.ParseInt(lit, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			if outputType == "d" {
-				data = append(data, num)
-			} else {
-				panic("literal shouldn't appear here")
-			}
-		}
-
+		return nil, vm.NewAsmError(operand.Pos, operand.Text, "expression outside of .data")
 	}
-
-	// Add an infinite loop at the end
-	// TODO: consider an instruction which will raise an error / exception
-	// TODO: do we need this guard, look at alternative
-	code = append(code, asmInstr(codeSymbols, dataSymbols, "0", "0", fmt.Sprintf("%d", codePos))...)
-	return code, data
+	n, err := syms.EvalInt64(operand)
+	return asm.Words(n), err
 }
 
-func resolveOperand(codeSymbols, dataSymbols map[string]int64, operand string) int64 {
-	if reIndirect.MatchString(operand) {
-		s := reIndirect.FindStringSubmatch(operand)[2]
-		return 0 - resolveOperand(codeSymbols, dataSymbols, s)
-	} else if reExpr.MatchString(operand) {
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Indirect:
+		n, err := resolveOperand(syms, operand.X)
+		return 0 - n, err
+	case asm.Binary:
 		// If operand is an expression
-		a := reExpr.FindStringSubmatch(operand)[1]
-		op := reExpr.FindStringSubmatch(operand)[2]
-		b := reExpr.FindStringSubmatch(operand)[3]
-		return resolveExpr(codeSymbols, dataSymbols, a, op, b)
-	} else if reLiteral.MatchString(operand) {
-		// If operand is a literal value
-		i64, err := strconv.ParseInt(operand, 10, 64)
+		a, err := resolveOperand(syms, operand.X)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		return i64
-	}
-	addr, err := resolveSymbol(codeSymbols, dataSymbols, operand)
-	if err != nil {
-		panic(err)
-	}
-	return addr
-}
-
-func resolveSymbol(codeSymbols, dataSymbols map[string]int64, sym string) (int64, error) {
-	v, ok := codeSymbols[sym]
-	if !ok {
-		v, ok = dataSymbols[sym]
-		if !ok {
-			return v, fmt.Errorf("unknown symbol: %s", sym)
+		b, err := resolveOperand(syms, operand.Y)
+		if err != nil {
+			return 0, err
+		}
+		if operand.Op == '-' {
+			return a - b, nil
 		}
+		return a + b, nil
 	}
-	return v, nil
-
+	return syms.EvalInt64(operand)
 }
 
-func resolveExpr(codeSymbols, dataSymbols map[string]int64, a, op, b string) int64 {
-	aVal := resolveOperand(codeSymbols, dataSymbols, a)
-	bVal := resolveOperand(codeSymbols, dataSymbols, b)
-	switch op {
-	case "+":
-		return aVal + bVal
-	case "-":
-		return aVal - bVal
-	default:
-		panic(fmt.Sprintf("unknown op: %s", op))
+// If operand C is missing it is set to the address of the next instruction
+func asmInstr(syms *asm.Symbols, addr int64, stmt *asm.Stmt) ([]int64, error) {
+	code := []int64{0, 0, addr + 3}
+	if err := stmt.CheckOperands(2, 3); err != nil {
+		return code, err
 	}
-}
-
-func asmInstr(codeSymbols, dataSymbols map[string]int64, operandA string, operandB string, operandC string) []int64 {
-	code := []int64{
-		resolveOperand(codeSymbols, dataSymbols, operandA),
-		resolveOperand(codeSymbols, dataSymbols, operandB),
-		resolveOperand(codeSymbols, dataSymbols, operandC),
+	for i, operand := range stmt.Operands {
+		n, err := resolveOperand(syms, operand)
+		if err != nil {
+			return code, err
+		}
+		code[i] = n
 	}
-	return code
+	return code, nil
 }
 
 func checkJumpsInRange(code []int64) error {
@@ -243,7 +107,7 @@ func checkJumpsInRange(code []int64) error {
 	return nil
 }
 
-func checkMemInRange(code []int64, data []int64) error {
+func checkMemInRange(code []int64, data []*big.Int) error {
 	for i := 0; i < len(code); i += 3 {
 		a := code[i]
 		b := code[i+1]
@@ -258,34 +122,51 @@ func checkMemInRange(code []int64, data []int64) error {
 	return nil
 }
 
-func printSymbols(symbols map[string]int64) {
-	labels := make([]string, 0, len(symbols))
-	for l := range symbols {
-		labels = append(labels, l)
-	}
-	sort.Strings(labels)
+// Finish adds a guard to the end of the code and checks that the
+// jumps and memory accesses are in range
+func (encoder) Finish(routine *vm.Routine) error {
+	// Add an infinite loop at the end
+	// TODO: consider an instruction which will raise an error / exception
+	// TODO: do we need this guard, look at alternative
+	codePos := int64(len(routine.Code))
+	routine.Code = append(routine.Code, 0, 0, codePos)
+	routine.SourceMap.Record(0, len(routine.Code), len(routine.Data))
 
-	fmt.Printf("Symbols\n=======\n")
-	for _, l := range labels {
-		fmt.Printf("%s: %d\n", l, symbols[l])
+	if err := checkJumpsInRange(routine.Code); err != nil {
+		return err
 	}
-	fmt.Printf("\n")
+	return checkMemInRange(routine.Code, routine.Data)
 }
 
-func asm(filename string) ([]int64, []int64, map[string]int64, map[string]int64, error) {
-	srcLines, err := readFile(filename)
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
+}
+
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
+}
+
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, []int64{}, map[string]int64{}, map[string]int64{}, err
-	}
-	codeSymbols, dataSymbols := pass1(srcLines)
-	code, data := pass2(srcLines, codeSymbols, dataSymbols)
-	if err := checkJumpsInRange(code); err != nil {
-		return []int64{}, []int64{}, map[string]int64{}, map[string]int64{}, err
-	}
-	if err := checkMemInRange(code, data); err != nil {
-		return []int64{}, []int64{}, map[string]int64{}, map[string]int64{}, err
+		return nil, err
 	}
-	// printSymbols(symbols)
-	// fmt.Printf("%v\n", code)
-	return code, data, codeSymbols, dataSymbols, nil
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "subleq2"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
+
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
@@ -13,31 +13,112 @@ package subleq2
 
 import (
 	"fmt"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 // Location in memory of hltVal
 // If this is used as a destination location then a HLT is executed
 const hltLoc = 1000
 
 type SUBLEQ struct {
-	code        [memSize]int64   // Code / Program
-	mem         [memSize]int64   // Memory
-	pc          int64            // Program Counter
-	hltVal      int64            // A value returned by HLT
-	codeSymbols map[string]int64 // The code symbols table from the assembler - to aid debugging
-	dataSymbols map[string]int64 // The data symbols table from the assembler - to aid debugging
-	codeSize    int64            // The size of the code / program
+	code     []int64     // Code / Program
+	mem      []int64     // Memory
+	memSize  int64       // Number of words of memory
+	pc       int64       // Program Counter
+	hltVal   int64       // A value returned by HLT
+	codeSize int64       // The size of the code / program
+	word     vm.Word     // Width of words, results of SUBLEQ wrap to fit
+	tracer   vm.Tracer   // Called around each instruction if set
+	stats    *vm.Stats   // Counts of what has been executed if turned on
+	names    *asm.Names  // Names of addresses used when tracing
+	routine  *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*SUBLEQ)(nil)
+
+// Option configures a SUBLEQ when passed to New
+type Option func(*SUBLEQ)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *SUBLEQ) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *SUBLEQ) {
+		v.stats = vm.NewStats()
+	}
+}
 
+// WithWordSize sets the width of words, which is unbounded by default.
+// The result of each subtraction wraps around to fit and is signed when
+// compared with 0.  Words loaded from a routine are stored as they are
+// but are still signed when compared.
+func WithWordSize(w vm.Word) Option {
+	return func(v *SUBLEQ) {
+		v.word = w
+	}
 }
 
-func New() *SUBLEQ {
-	return &SUBLEQ{}
+func New(opts ...Option) *SUBLEQ {
+	v := &SUBLEQ{memSize: defaultMemSize}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.code = make([]int64, v.memSize)
+	v.mem = make([]int64, v.memSize)
+	return v
 }
 
+// Step executes a single instruction
+// Returns: hlt, error
 func (v *SUBLEQ) Step() (bool, error) {
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *SUBLEQ) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of operands A and B
+func (v *SUBLEQ) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.code, v.pc, v.names)
+	operandA, operandB, _, err := v.fetch()
+	if err != nil {
+		return instr, nil
+	}
+	return instr, []int64{operandA, operandB}
+}
+
+// Registers returns the value of each register other than the PC, of
+// which there are none
+func (v *SUBLEQ) Registers() []vm.Register {
+	return nil
+}
+
+func (v *SUBLEQ) step() (bool, error) {
 	operandA, operandB, operandC, err := v.fetch()
 	if err != nil {
 		return false, err
@@ -45,41 +126,110 @@ func (v *SUBLEQ) Step() (bool, error) {
 	return v.execute(operandA, operandB, operandC), nil
 }
 
-func (v *SUBLEQ) Run() error {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
-			return err
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
+func (v *SUBLEQ) Run() (bool, error) {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
+			return hlt, err
 		}
 	}
+}
+
+func (v *SUBLEQ) LoadRoutine(r *vm.Routine) error {
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine code too big for memory: %d", len(r.Code))
+	}
+	if int64(len(r.Data)) > v.memSize {
+		return fmt.Errorf("routine data too big for memory: %d", len(r.Data))
+	}
+	for i, d := range r.Data {
+		if !d.IsInt64() {
+			return fmt.Errorf("routine data not int64 at: %d", i)
+		}
+	}
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
 	return nil
 }
 
-func (v *SUBLEQ) LoadRoutine(code []int64, data []int64, codeSymbols map[string]int64, dataSymbols map[string]int64) {
-	copy(v.code[:], code)
-	copy(v.mem[:], data)
+func (v *SUBLEQ) Reset() {
+	for i := range v.code {
+		v.code[i] = 0
+	}
+	for i := range v.mem {
+		v.mem[i] = 0
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.code[:], v.routine.Code)
+		for i, d := range v.routine.Data {
+			v.mem[i] = d.Int64()
+		}
+		v.pc = v.routine.Entry
+	}
 	v.codeSize = int64(len(v.code))
-	v.codeSymbols = codeSymbols
-	v.dataSymbols = dataSymbols
+	v.hltVal = 0
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *SUBLEQ) HltVal() *big.Int {
+	return big.NewInt(v.hltVal)
+}
+
+func (v *SUBLEQ) PC() int64 {
+	return v.pc
+}
+
+func (v *SUBLEQ) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *SUBLEQ) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return big.NewInt(v.mem[addr]), nil
+}
+
+func (v *SUBLEQ) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	if !n.IsInt64() {
+		return fmt.Errorf("value not int64: %s", n)
+	}
+	v.mem[addr] = v.word.Wrap(n.Int64())
+	return nil
 }
 
 // getOperandAB returns the operand as supplied unless it is negative in which
 // case it returns the value at the location in memory pointed to by the
 // operand.  This is for A or B operands and hence always checks memSize.
 func (v *SUBLEQ) getOperandAB(operand int64) (int64, error) {
+	mem := v.mem
 	if operand < 0 {
-		operand = 0 - operand
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		ptr := -operand
+		if ptr >= int64(len(mem)) {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: ptr}
 		}
-		operand = v.mem[operand]
+		operand = mem[ptr]
 		if operand < 0 {
-			return 0, fmt.Errorf("PC: %d, double indirect not supported", v.pc)
+			return 0, &vm.DoubleIndirect{PC: v.pc, Addr: ptr}
 		}
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		if operand >= int64(len(mem)) {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: operand}
 		}
 	}
 
@@ -92,14 +242,15 @@ func (v *SUBLEQ) getOperandAB(operand int64) (int64, error) {
 // otherwise it assumes that the assembler didn't allow a C operand outside
 // the code size.
 func (v *SUBLEQ) getOperandC(operand int64) (int64, error) {
+	mem := v.mem
 	if operand < 0 {
-		operand = -operand
-		if operand >= memSize {
-			return 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operand)
+		ptr := -operand
+		if ptr >= int64(len(mem)) {
+			return 0, &vm.MemoryFault{PC: v.pc, Addr: ptr}
 		}
-		operand = v.mem[operand]
+		operand = mem[ptr]
 		if operand < 0 {
-			return 0, fmt.Errorf("PC: %d, double indirect not supported", v.pc)
+			return 0, &vm.DoubleIndirect{PC: v.pc, Addr: ptr}
 		}
 	}
 
@@ -111,12 +262,13 @@ func (v *SUBLEQ) getOperandC(operand int64) (int64, error) {
 func (v *SUBLEQ) fetch() (int64, int64, int64, error) {
 	var err error
 
-	if v.pc+2 >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, v.pc)
+	code := v.code
+	if v.pc+2 >= int64(len(code)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: v.pc + 2}
 	}
-	operandA := v.code[v.pc]
-	operandB := v.code[v.pc+1]
-	operandC := v.code[v.pc+2]
+	operandA := code[v.pc]
+	operandB := code[v.pc+1]
+	operandC := code[v.pc+2]
 
 	operandA, err = v.getOperandAB(operandA)
 	if err != nil {
@@ -134,38 +286,18 @@ func (v *SUBLEQ) fetch() (int64, int64, int64, error) {
 	return operandA, operandB, operandC, nil
 }
 
-func (v *SUBLEQ) addr2symbol(addr int64, onlyCode ...bool) string {
-	if len(onlyCode) == 0 {
-		for k, v := range v.dataSymbols {
-			if v == addr {
-				return k
-			}
-		}
-	}
-
-	for k, v := range v.codeSymbols {
-		if v == addr {
-			return k
-		}
-	}
-	return fmt.Sprintf("%d", addr)
-}
-
 // execute executes the supplied instruction
 // Returns: hlt, error
 func (v *SUBLEQ) execute(operandA int64, operandB int64, operandC int64) bool {
-	//fmt.Printf("PC: %7s    SUBLEQ %s, %s, %s\n", v.addr2symbol(v.pc, true), v.addr2symbol(operandA), v.addr2symbol(operandB), v.addr2symbol(operandC, true))
-	//fmt.Printf("                      %d - %d = ", v.mem[operandB], v.mem[operandA])
-
+	mem := v.mem
 	if operandB == hltLoc {
-		v.hltVal = -v.mem[operandB]
+		v.hltVal = v.word.Wrap(-mem[operandB])
 		return true
 	} else {
-		v.mem[operandB] = v.mem[operandB] - v.mem[operandA]
+		mem[operandB] = v.word.Wrap(mem[operandB] - mem[operandA])
 	}
-	//fmt.Printf("%d\n", v.mem[operandB])
 
-	if v.mem[operandB] <= 0 {
+	if mem[operandB] <= 0 {
 		v.pc = operandC
 	} else {
 		v.pc = v.pc + 3
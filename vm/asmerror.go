@@ -0,0 +1,86 @@
+/*
+ * Errors returned by the assemblers
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AsmError is an error found while assembling a source file
+type AsmError struct {
+	Filename string // Name of the source file
+	Line     int    // Line number, starting at 1
+	Column   int    // Column number, starting at 1
+	Token    string // The offending token, if there is one
+	Msg      string // Description of the error
+}
+
+// NewAsmError returns an AsmError for token, which starts at byte offset
+// pos of the source line.  The rest of the position is set later with
+// SetPos.
+func NewAsmError(pos int, token string, format string, a ...any) *AsmError {
+	return &AsmError{Column: pos + 1, Token: token, Msg: fmt.Sprintf(format, a...)}
+}
+
+// SetPos sets the filename and line number of the error.  The column is
+// set to 1 if it isn't already known.
+func (e *AsmError) SetPos(filename string, lineNum int) {
+	e.Filename = filename
+	e.Line = lineNum
+	if e.Column < 1 {
+		e.Column = 1
+	}
+}
+
+func (e *AsmError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.Filename, e.Line, e.Column, e.Msg, e.Token)
+}
+
+// AsmErrors is a list of errors found while assembling, so that more
+// than one error can be reported for each run of the assembler
+type AsmErrors []*AsmError
+
+// Add adds err to the list setting its position if it is an AsmError
+func (e *AsmErrors) Add(err error, filename string, lineNum int) {
+	asmErr, ok := err.(*AsmError)
+	if !ok {
+		asmErr = &AsmError{Msg: err.Error()}
+	}
+	asmErr.SetPos(filename, lineNum)
+	*e = append(*e, asmErr)
+}
+
+// Sort sorts the list by line number keeping the order of errors on
+// the same line
+func (e AsmErrors) Sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Line < e[j].Line
+	})
+}
+
+// Err returns the list as an error or nil if the list is empty
+func (e AsmErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e AsmErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,24 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAsmErrorsError(t *testing.T) {
+	errs := AsmErrors{}
+	if err := errs.Err(); err != nil {
+		t.Errorf("Err() got: %v, want: nil", err)
+	}
+	errs.Add(NewAsmError(7, "foo", "unknown symbol"), "a.asm", 3)
+	errs.Add(errors.New("bad thing"), "a.asm", 5)
+
+	want := "a.asm:3:8: unknown symbol: foo\na.asm:5:1: bad thing"
+	err := errs.Err()
+	if err == nil {
+		t.Fatalf("Err() got: nil, want: %s", want)
+	}
+	if got := err.Error(); got != want {
+		t.Errorf("Error() got: %q, want: %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Errors returned by the virtual machines when executing a routine
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// MemoryFault is returned when an instruction accesses an address outside
+// of memory
+type MemoryFault struct {
+	PC   int64 // The address of the instruction
+	Addr int64 // The address accessed
+}
+
+func (e *MemoryFault) Error() string {
+	return fmt.Sprintf("PC: %d, outside memory range: %d", e.PC, e.Addr)
+}
+
+// InvalidOpcode is returned when an instruction can't be decoded
+type InvalidOpcode struct {
+	PC     int64 // The address of the instruction
+	Addr   int64 // The address of the word holding the opcode
+	Opcode int64 // The opcode found
+}
+
+func (e *InvalidOpcode) Error() string {
+	return fmt.Sprintf("PC: %d, unknown opcode: %d at: %d", e.PC, e.Opcode, e.Addr)
+}
+
+// StackOverflow is returned when an item is pushed onto a full stack
+type StackOverflow struct {
+	PC    int64  // The address of the instruction
+	Addr  int64  // The depth of the stack when it overflowed
+	Stack string // The name of the stack
+}
+
+func (e *StackOverflow) Error() string {
+	return fmt.Sprintf("PC: %d, %s stack overflow, depth: %d", e.PC, e.Stack, e.Addr)
+}
+
+// StackUnderflow is returned when an item is needed from an empty stack
+type StackUnderflow struct {
+	PC    int64  // The address of the instruction
+	Addr  int64  // The depth of the stack when it underflowed
+	Stack string // The name of the stack
+}
+
+func (e *StackUnderflow) Error() string {
+	return fmt.Sprintf("PC: %d, %s stack underflow, depth: %d", e.PC, e.Stack, e.Addr)
+}
+
+// DoubleIndirect is returned when an indirect operand points to another
+// indirect operand, which isn't supported
+type DoubleIndirect struct {
+	PC   int64 // The address of the instruction
+	Addr int64 // The address of the second indirect operand
+}
+
+func (e *DoubleIndirect) Error() string {
+	return fmt.Sprintf("PC: %d, double indirect not supported: %d", e.PC, e.Addr)
+}
+
+// InvalidOperand is returned when the value of an operand is outside of
+// the range that an instruction accepts, such as a negative shift
+type InvalidOperand struct {
+	PC    int64    // The address of the instruction
+	Addr  int64    // The address of the value
+	Value *big.Int // The value found
+}
+
+func (e *InvalidOperand) Error() string {
+	return fmt.Sprintf("PC: %d, invalid operand: %s at: %d", e.PC, e.Value, e.Addr)
+}
+
+// BigAddr returns n as an address for an error.  Addresses too big for
+// an int64 are clamped as they are outside of memory whatever their size.
+func BigAddr(n *big.Int) int64 {
+	switch {
+	case n.IsInt64():
+		return n.Int64()
+	case n.Sign() < 0:
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
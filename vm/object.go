@@ -0,0 +1,259 @@
+/*
+ * Object file format for assembled routines
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// The object format is big-endian and laid out as:
+//
+//	magic       "VMOB"
+//	version     uint16
+//	target      string
+//	entry       int64
+//	flags       uint8, bit 0 set if code and data share one memory
+//	code        uint64 count, then an int64 for each word
+//	data        uint64 count, then a bigint for each word
+//	codeSymbols uint64 count, then a string and int64 for each symbol
+//	dataSymbols uint64 count, then a string and int64 for each symbol
+//
+// A string is a uint32 length followed by its bytes.  A bigint is a sign
+// byte of 0 or 1 for negative followed by its absolute value as a string.
+// The source map isn't saved.
+
+const objectMagic = "VMOB"
+
+// ObjectVersion is the version of the object format written by
+// WriteObject
+const ObjectVersion = 2
+
+// Flags in an object
+const objectSingleMem = 1 << 0
+
+// ErrNotObject is returned by ReadObject if the input isn't an object
+var ErrNotObject = errors.New("not an object file")
+
+// WriteObject writes routine to w as an object for the target VM
+func WriteObject(w io.Writer, target string, routine *Routine) error {
+	ow := &objectWriter{w: bufio.NewWriter(w)}
+	ow.write([]byte(objectMagic))
+	ow.write(uint16(ObjectVersion))
+	ow.writeString(target)
+	ow.write(routine.Entry)
+	var flags uint8
+	if routine.SingleMem {
+		flags |= objectSingleMem
+	}
+	ow.write(flags)
+	ow.write(uint64(len(routine.Code)))
+	ow.write(routine.Code)
+	ow.write(uint64(len(routine.Data)))
+	for _, n := range routine.Data {
+		ow.writeBigInt(n)
+	}
+	ow.writeSymbols(routine.CodeSymbols)
+	ow.writeSymbols(routine.DataSymbols)
+	if ow.err != nil {
+		return ow.err
+	}
+	return ow.w.Flush()
+}
+
+// ReadObject reads an object from r
+// Returns: target, routine, error
+func ReadObject(r io.Reader) (string, *Routine, error) {
+	or := &objectReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(objectMagic))
+	or.read(magic)
+	if or.err != nil || string(magic) != objectMagic {
+		return "", nil, ErrNotObject
+	}
+	var version uint16
+	or.read(&version)
+	if or.err == nil && version != ObjectVersion {
+		return "", nil, fmt.Errorf("unsupported object version: %d", version)
+	}
+	target := or.readString()
+	routine := &Routine{}
+	or.read(&routine.Entry)
+	var flags uint8
+	or.read(&flags)
+	routine.SingleMem = flags&objectSingleMem != 0
+	if n := or.readCount(); n > 0 {
+		routine.Code = or.readCode(n)
+	}
+	if n := or.readCount(); n > 0 {
+		routine.Data = make([]*big.Int, 0, chunkLen(n))
+		for len(routine.Data) < n && or.err == nil {
+			routine.Data = append(routine.Data, or.readBigInt())
+		}
+	}
+	routine.CodeSymbols = or.readSymbols()
+	routine.DataSymbols = or.readSymbols()
+	if or.err != nil {
+		if or.err == io.EOF {
+			or.err = io.ErrUnexpectedEOF
+		}
+		return "", nil, fmt.Errorf("invalid object: %w", or.err)
+	}
+	return target, routine, nil
+}
+
+// LoadObject reads an object from r checking that it is for target
+func LoadObject(r io.Reader, target string) (*Routine, error) {
+	objTarget, routine, err := ReadObject(r)
+	if err != nil {
+		return nil, err
+	}
+	if objTarget != target {
+		return nil, fmt.Errorf("object is for %s not %s", objTarget, target)
+	}
+	return routine, nil
+}
+
+// objectWriter records the first error so that it only needs checking
+// at the end
+type objectWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (ow *objectWriter) write(data any) {
+	if ow.err == nil {
+		ow.err = binary.Write(ow.w, binary.BigEndian, data)
+	}
+}
+
+func (ow *objectWriter) writeString(s string) {
+	ow.write(uint32(len(s)))
+	ow.write([]byte(s))
+}
+
+func (ow *objectWriter) writeBigInt(n *big.Int) {
+	var sign uint8 = 0
+	if n.Sign() < 0 {
+		sign = 1
+	}
+	ow.write(sign)
+	ow.writeString(string(n.Bytes()))
+}
+
+// writeSymbols writes the symbols sorted by name so that the same routine
+// always gives the same object
+func (ow *objectWriter) writeSymbols(symbols map[string]int64) {
+	names := make([]string, 0, len(symbols))
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ow.write(uint64(len(names)))
+	for _, name := range names {
+		ow.writeString(name)
+		ow.write(symbols[name])
+	}
+}
+
+// objectReader records the first error so that it only needs checking
+// at the end
+type objectReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (or *objectReader) read(data any) {
+	if or.err == nil {
+		or.err = binary.Read(or.r, binary.BigEndian, data)
+	}
+}
+
+// maxObjectLen limits lengths read from an object so that a corrupt file
+// can't claim more than a routine could sensibly need
+const maxObjectLen = 1 << 24
+
+// objectChunk is the most words or bytes allocated at once when reading
+// an object so that a corrupt length fails at the end of the file rather
+// than allocating all that it claims
+const objectChunk = 4096
+
+// chunkLen returns n limited to objectChunk
+func chunkLen(n int) int {
+	if n > objectChunk {
+		return objectChunk
+	}
+	return n
+}
+
+func (or *objectReader) readLen(n uint64) int {
+	if or.err == nil && n > maxObjectLen {
+		or.err = fmt.Errorf("length too big: %d", n)
+	}
+	if or.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (or *objectReader) readCount() int {
+	var n uint64
+	or.read(&n)
+	return or.readLen(n)
+}
+
+// readCode reads n words of code a chunk at a time
+func (or *objectReader) readCode(n int) []int64 {
+	code := make([]int64, 0, chunkLen(n))
+	for len(code) < n && or.err == nil {
+		chunk := make([]int64, chunkLen(n-len(code)))
+		or.read(chunk)
+		code = append(code, chunk...)
+	}
+	return code
+}
+
+func (or *objectReader) readString() string {
+	var n uint32
+	or.read(&n)
+	l := or.readLen(uint64(n))
+	b := make([]byte, 0, chunkLen(l))
+	for len(b) < l && or.err == nil {
+		chunk := make([]byte, chunkLen(l-len(b)))
+		or.read(chunk)
+		b = append(b, chunk...)
+	}
+	return string(b)
+}
+
+func (or *objectReader) readBigInt() *big.Int {
+	var sign uint8
+	or.read(&sign)
+	n := new(big.Int).SetBytes([]byte(or.readString()))
+	if sign == 1 {
+		n.Neg(n)
+	}
+	return n
+}
+
+func (or *objectReader) readSymbols() map[string]int64 {
+	n := or.readCount()
+	symbols := make(map[string]int64, chunkLen(n))
+	for i := 0; i < n && or.err == nil; i++ {
+		name := or.readString()
+		var addr int64
+		or.read(&addr)
+		symbols[name] = addr
+	}
+	return symbols
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWriteReadObject(t *testing.T) {
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	routine := &Routine{
+		Code:        []int64{1, -2, 3},
+		Data:        []*big.Int{big.NewInt(0), big.NewInt(-5), huge},
+		CodeSymbols: map[string]int64{"start": 0, "loop": 3},
+		DataSymbols: map[string]int64{"n": 1},
+		Entry:       3,
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteObject(buf, "bvm2", routine); err != nil {
+		t.Fatalf("WriteObject() err: %v", err)
+	}
+	target, got, err := ReadObject(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadObject() err: %v", err)
+	}
+	if target != "bvm2" {
+		t.Errorf("ReadObject() target got: %s, want: bvm2", target)
+	}
+	if !reflect.DeepEqual(got.Code, routine.Code) ||
+		!reflect.DeepEqual(got.CodeSymbols, routine.CodeSymbols) ||
+		!reflect.DeepEqual(got.DataSymbols, routine.DataSymbols) ||
+		got.Entry != routine.Entry || got.SingleMem {
+		t.Errorf("ReadObject() got: %v, want: %v", got, routine)
+	}
+	if len(got.Data) != len(routine.Data) {
+		t.Fatalf("ReadObject() Data got: %v, want: %v", got.Data, routine.Data)
+	}
+	for i, n := range got.Data {
+		if n.Cmp(routine.Data[i]) != 0 {
+			t.Errorf("ReadObject() Data[%d] got: %d, want: %d", i, n, routine.Data[i])
+		}
+	}
+
+	if _, err := LoadObject(bytes.NewReader(buf.Bytes()), "vm1"); err == nil {
+		t.Errorf("LoadObject() err: nil, want: wrong target")
+	}
+	truncated := buf.Bytes()[:buf.Len()-4]
+	if _, _, err := ReadObject(bytes.NewReader(truncated)); err == nil {
+		t.Errorf("ReadObject() err: nil, want: invalid object")
+	}
+	if _, _, err := ReadObject(strings.NewReader("start: LDA 5")); err != ErrNotObject {
+		t.Errorf("ReadObject() err: %v, want: %v", err, ErrNotObject)
+	}
+
+	single := &Routine{
+		Code:        []int64{1, 2},
+		CodeSymbols: map[string]int64{"sum": 1},
+		SingleMem:   true,
+	}
+	buf.Reset()
+	if err := WriteObject(buf, "vm1", single); err != nil {
+		t.Fatalf("WriteObject() err: %v", err)
+	}
+	got, err = LoadObject(bytes.NewReader(buf.Bytes()), "vm1")
+	if err != nil {
+		t.Fatalf("LoadObject() err: %v", err)
+	}
+	if !got.SingleMem {
+		t.Errorf("LoadObject() SingleMem got: false, want: true")
+	}
+	if addr, err := got.DataAddr("sum"); err != nil || addr != 1 {
+		t.Errorf("DataAddr(\"sum\") got: %d, %v, want: 1", addr, err)
+	}
+}
+
+func TestReadObjectCorrupt(t *testing.T) {
+	// header returns the start of an object up to the code count
+	header := func(codeCount uint64) []byte {
+		buf := &bytes.Buffer{}
+		buf.WriteString(objectMagic)
+		binary.Write(buf, binary.BigEndian, uint16(ObjectVersion))
+		binary.Write(buf, binary.BigEndian, uint32(3))
+		buf.WriteString("vm1")
+		binary.Write(buf, binary.BigEndian, int64(0))
+		binary.Write(buf, binary.BigEndian, uint8(0))
+		binary.Write(buf, binary.BigEndian, codeCount)
+		binary.Write(buf, binary.BigEndian, []int64{1, 2, 3})
+		return buf.Bytes()
+	}
+	cases := []struct {
+		name      string
+		codeCount uint64
+		wantErr   string
+	}{
+		{"too big", maxObjectLen + 1, "length too big"},
+		{"more than the file", maxObjectLen, "unexpected EOF"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, _, err := ReadObject(bytes.NewReader(header(c.codeCount)))
+			runtime.ReadMemStats(&after)
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("ReadObject() err: %v, want: %s", err, c.wantErr)
+			}
+			// Only the chunk read before the end of the file is allocated
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Errorf("ReadObject() allocated: %d bytes", n)
+			}
+		})
+	}
+}
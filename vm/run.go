@@ -0,0 +1,63 @@
+/*
+ * Running a routine with a limit on how long it can run for
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrBudgetExhausted is returned when the maximum number of steps have
+// been executed without reaching HLT
+var ErrBudgetExhausted = errors.New("instruction budget exhausted")
+
+// CtxCheckInterval is the number of steps between each check of whether
+// a context is done, checking every step would slow execution too much
+const CtxCheckInterval = 1024
+
+// RunLimit executes instructions on m until HLT, an error, maxSteps
+// instructions have been executed if maxSteps is greater than 0, or ctx
+// is done.  If the budget is used up ErrBudgetExhausted is returned and
+// if ctx is done ctx.Err() is returned.
+// Returns: steps, error
+func RunLimit(ctx context.Context, m Machine, maxSteps int64) (int64, error) {
+	done := ctx.Done()
+	var steps int64
+	for maxSteps <= 0 || steps < maxSteps {
+		if done != nil && steps%CtxCheckInterval == 0 {
+			select {
+			case <-done:
+				return steps, ctx.Err()
+			default:
+			}
+		}
+		hlt, err := m.Step()
+		steps++
+		if err != nil {
+			return steps, err
+		}
+		if hlt {
+			return steps, nil
+		}
+	}
+	return steps, ErrBudgetExhausted
+}
+
+// RunSteps calls step until HLT or an error.  It is used by a machine's
+// Run when tracing or counting, which is decided once by Run rather than
+// for every instruction so that the loop without them stays tight.
+// Returns: hlt, error
+func RunSteps(step func() (bool, error)) (bool, error) {
+	for {
+		hlt, err := step()
+		if hlt || err != nil {
+			return hlt, err
+		}
+	}
+}
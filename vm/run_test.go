@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// countMachine halts after hltAfter steps or never if hltAfter is 0
+type countMachine struct {
+	hltAfter int64
+	steps    int64
+}
+
+func (m *countMachine) LoadRoutine(r *Routine) error { return nil }
+func (m *countMachine) Run() (bool, error)           { return true, nil }
+func (m *countMachine) Reset()                       { m.steps = 0 }
+func (m *countMachine) HltVal() *big.Int             { return big.NewInt(0) }
+func (m *countMachine) PC() int64                    { return m.steps }
+func (m *countMachine) MemSize() int64               { return 0 }
+func (m *countMachine) SetTracer(t Tracer)           {}
+func (m *countMachine) Stats() *Stats                { return nil }
+
+func (m *countMachine) ReadMem(addr int64) (*big.Int, error) {
+	return nil, errors.New("no memory")
+}
+
+func (m *countMachine) WriteMem(addr int64, n *big.Int) error {
+	return errors.New("no memory")
+}
+
+func (m *countMachine) Step() (bool, error) {
+	m.steps++
+	return m.steps == m.hltAfter, nil
+}
+
+func TestRunLimit(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name      string
+		ctx       context.Context
+		hltAfter  int64
+		maxSteps  int64
+		wantSteps int64
+		wantErr   error
+	}{
+		{"halts", context.Background(), 50, 100, 50, nil},
+		{"halts on last step", context.Background(), 100, 100, 100, nil},
+		{"no limit", context.Background(), 5000, 0, 5000, nil},
+		{"budget exhausted", context.Background(), 0, 100, 100, ErrBudgetExhausted},
+		{"cancelled", cancelled, 0, 0, 0, context.Canceled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &countMachine{hltAfter: c.hltAfter}
+			steps, err := RunLimit(c.ctx, m, c.maxSteps)
+			if !errors.Is(err, c.wantErr) {
+				t.Errorf("RunLimit() err got: %v, want: %v", err, c.wantErr)
+			}
+			if steps != c.wantSteps {
+				t.Errorf("RunLimit() steps got: %d, want: %d", steps, c.wantSteps)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Counts of what a machine has done while executing a routine
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stats are counts of what a Machine has done since it was last reset
+type Stats struct {
+	Steps     int64            // Instructions executed
+	Opcodes   map[string]int64 // Instructions executed for each mnemonic
+	Reads     int64            // Reads of data memory by instructions
+	Writes    int64            // Writes to data memory by instructions
+	Indirects int64            // Reads of memory to dereference addresses
+	Taken     int64            // Branches that didn't go to the next instruction
+	NotTaken  int64            // Branches that went to the next instruction
+	// StackHighWater is the greatest depth reached by each stack
+	StackHighWater map[string]int64
+}
+
+// OpInfo describes what an instruction does for recording in Stats
+type OpInfo struct {
+	Mnemonic string
+	Reads    int64 // Reads of data memory, excluding indirection
+	Writes   int64 // Writes to data memory
+	Branch   bool  // Whether the instruction can change the flow of control
+}
+
+// NewStats returns Stats with nothing counted
+func NewStats() *Stats {
+	return &Stats{
+		Opcodes:        make(map[string]int64),
+		StackHighWater: make(map[string]int64),
+	}
+}
+
+// Record records the execution of an instruction, which needed indirects
+// memory reads to dereference its operands.  taken is whether a branch
+// was taken and is ignored if op isn't a branch.
+func (s *Stats) Record(op OpInfo, indirects int64, taken bool) {
+	s.Steps++
+	s.Opcodes[op.Mnemonic]++
+	s.Reads += op.Reads
+	s.Writes += op.Writes
+	s.Indirects += indirects
+	if op.Branch {
+		if taken {
+			s.Taken++
+		} else {
+			s.NotTaken++
+		}
+	}
+}
+
+// StackDepth records the depth of a stack to keep its high-water mark
+func (s *Stats) StackDepth(name string, depth int) {
+	if int64(depth) > s.StackHighWater[name] {
+		s.StackHighWater[name] = int64(depth)
+	}
+}
+
+// String returns the counts on a single line with the opcodes and
+// stacks in name order
+func (s *Stats) String() string {
+	str := fmt.Sprintf("steps: %d reads: %d writes: %d indirects: %d taken: %d not-taken: %d",
+		s.Steps, s.Reads, s.Writes, s.Indirects, s.Taken, s.NotTaken)
+	str += " ops: " + joinCounts(s.Opcodes)
+	if len(s.StackHighWater) > 0 {
+		str += " stacks: " + joinCounts(s.StackHighWater)
+	}
+	return str
+}
+
+// joinCounts returns counts as name=count pairs in name order
+func joinCounts(counts map[string]int64) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(pairs, ",")
+}
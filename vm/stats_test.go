@@ -0,0 +1,19 @@
+package vm
+
+import "testing"
+
+func TestStatsString(t *testing.T) {
+	s := NewStats()
+	s.Record(OpInfo{Mnemonic: "LDA", Reads: 1}, 1, false)
+	s.Record(OpInfo{Mnemonic: "JNZ", Branch: true}, 0, true)
+	s.Record(OpInfo{Mnemonic: "JNZ", Branch: true}, 0, false)
+	s.Record(OpInfo{Mnemonic: "STA", Writes: 1}, 0, true)
+	s.StackDepth("data", 3)
+	s.StackDepth("data", 2)
+	s.StackDepth("return", 1)
+	want := "steps: 4 reads: 1 writes: 1 indirects: 1 taken: 1 not-taken: 1" +
+		" ops: JNZ=2,LDA=1,STA=1 stacks: data=3,return=1"
+	if got := s.String(); got != want {
+		t.Errorf("String() got: %s, want: %s", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Tracing of instructions as they are executed
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// Tracer is called before and after each instruction is executed by a
+// Machine that it has been set on with SetTracer
+type Tracer interface {
+	// Before is called before the instruction is executed, the changes
+	// and result fields of e aren't set
+	Before(e *TraceEvent)
+	// After is called after the instruction is executed
+	After(e *TraceEvent)
+}
+
+// TraceEvent describes an instruction being executed
+type TraceEvent struct {
+	PC    int64       `json:"pc"`    // The address of the instruction
+	Instr string      `json:"instr"` // The decoded instruction
+	Addrs []int64     `json:"addrs"` // The effective addresses of the operands
+	Regs  []RegChange `json:"regs"`  // The registers that changed
+	Mem   []MemChange `json:"mem"`   // The memory that changed
+	Hlt   bool        `json:"hlt"`   // Whether the instruction halted
+	Err   error       `json:"-"`     // The error returned by the instruction
+}
+
+// Register is the value of a register
+type Register struct {
+	Name  string
+	Value *big.Int
+}
+
+// Stack is the contents of a stack with the top item first
+type Stack struct {
+	Name  string
+	Items []*big.Int
+}
+
+// StackInspector is implemented by Machines with stacks so that their
+// contents can be inspected
+type StackInspector interface {
+	Stacks() []Stack
+}
+
+// RegChange records the change in value of a register
+type RegChange struct {
+	Name string   `json:"name"`
+	Old  *big.Int `json:"old"`
+	New  *big.Int `json:"new"`
+}
+
+// MemChange records the change in value of a memory location
+type MemChange struct {
+	Addr int64    `json:"addr"`
+	Old  *big.Int `json:"old"`
+	New  *big.Int `json:"new"`
+}
+
+// Traceable is implemented by Machines so that TraceStep can trace them
+type Traceable interface {
+	Machine
+	// Decode returns the instruction at the PC and the effective addresses
+	// of its operands in data memory
+	Decode() (string, []int64)
+	// Registers returns the value of each register apart from the PC
+	Registers() []Register
+}
+
+// TraceStep calls step to execute an instruction of m calling t.Before
+// and t.After around it.  Changes to memory are only looked for at the
+// effective addresses returned by m.Decode.
+// Returns: hlt, error
+func TraceStep(t Tracer, m Traceable, step func() (bool, error)) (bool, error) {
+	e := &TraceEvent{PC: m.PC()}
+	e.Instr, e.Addrs = m.Decode()
+	regs := copyRegisters(m.Registers())
+	mem := readAddrs(m, e.Addrs)
+	t.Before(e)
+
+	e.Hlt, e.Err = step()
+
+	for i, r := range m.Registers() {
+		if r.Value.Cmp(regs[i].Value) != 0 {
+			e.Regs = append(e.Regs, RegChange{r.Name, regs[i].Value, new(big.Int).Set(r.Value)})
+		}
+	}
+	for i, n := range readAddrs(m, e.Addrs) {
+		if mem[i] != nil && n != nil && n.Cmp(mem[i]) != 0 {
+			e.Mem = appendMemChange(e.Mem, MemChange{e.Addrs[i], mem[i], n})
+		}
+	}
+	t.After(e)
+	return e.Hlt, e.Err
+}
+
+func copyRegisters(regs []Register) []Register {
+	c := make([]Register, len(regs))
+	for i, r := range regs {
+		c[i] = Register{r.Name, new(big.Int).Set(r.Value)}
+	}
+	return c
+}
+
+// readAddrs returns a copy of the value at each address, which is nil
+// if the address is outside of memory
+func readAddrs(m Machine, addrs []int64) []*big.Int {
+	vals := make([]*big.Int, len(addrs))
+	for i, addr := range addrs {
+		if n, err := m.ReadMem(addr); err == nil {
+			vals[i] = new(big.Int).Set(n)
+		}
+	}
+	return vals
+}
+
+// appendMemChange appends c unless its address is already recorded
+func appendMemChange(changes []MemChange, c MemChange) []MemChange {
+	for _, o := range changes {
+		if o.Addr == c.Addr {
+			return changes
+		}
+	}
+	return append(changes, c)
+}
+
+// textTracer writes a line of text for each instruction executed
+type textTracer struct {
+	w io.Writer
+}
+
+// NewTextTracer returns a Tracer that writes a line to w for each
+// instruction showing its PC, the instruction, the effective addresses
+// and what changed
+func NewTextTracer(w io.Writer) Tracer {
+	return &textTracer{w: w}
+}
+
+func (t *textTracer) Before(e *TraceEvent) {}
+
+func (t *textTracer) After(e *TraceEvent) {
+	addrs := make([]string, len(e.Addrs))
+	for i, addr := range e.Addrs {
+		addrs[i] = fmt.Sprintf("%d", addr)
+	}
+	changes := make([]string, 0, len(e.Regs)+len(e.Mem))
+	for _, r := range e.Regs {
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", r.Name, r.Old, r.New))
+	}
+	for _, m := range e.Mem {
+		changes = append(changes, fmt.Sprintf("[%d]: %s -> %s", m.Addr, m.Old, m.New))
+	}
+	if e.Hlt {
+		changes = append(changes, "HLT")
+	}
+	if e.Err != nil {
+		changes = append(changes, fmt.Sprintf("error: %s", e.Err))
+	}
+	line := fmt.Sprintf("%6d: %-24s [%s]  %s", e.PC, e.Instr,
+		strings.Join(addrs, " "), strings.Join(changes, ", "))
+	fmt.Fprintln(t.w, strings.TrimRight(line, " "))
+}
+
+// jsonTracer writes a JSON object on a line for each instruction executed
+type jsonTracer struct {
+	enc *json.Encoder
+}
+
+// NewJSONTracer returns a Tracer that writes a TraceEvent as a JSON
+// object on a line to w for each instruction executed
+func NewJSONTracer(w io.Writer) Tracer {
+	return &jsonTracer{enc: json.NewEncoder(w)}
+}
+
+func (t *jsonTracer) Before(e *TraceEvent) {}
+
+func (t *jsonTracer) After(e *TraceEvent) {
+	type event struct {
+		*TraceEvent
+		Err string `json:"err,omitempty"`
+	}
+	je := event{TraceEvent: e}
+	if e.Err != nil {
+		je.Err = e.Err.Error()
+	}
+	t.enc.Encode(je)
+}
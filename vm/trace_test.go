@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+var traceEvents = []*TraceEvent{
+	{
+		PC:    4,
+		Instr: "STA     val",
+		Addrs: []int64{6},
+		Regs:  []RegChange{{"ac", big.NewInt(0), big.NewInt(-50)}},
+		Mem:   []MemChange{{6, big.NewInt(1), big.NewInt(50)}},
+	},
+	{PC: 6, Instr: "HLT     ok", Addrs: []int64{7}, Hlt: true},
+	{PC: 9, Instr: "?", Err: errors.New("unknown opcode: 99")},
+}
+
+func TestTextTracer(t *testing.T) {
+	buf := &strings.Builder{}
+	tracer := NewTextTracer(buf)
+	for _, e := range traceEvents {
+		tracer.Before(e)
+		tracer.After(e)
+	}
+	want := "     4: STA     val              [6]  ac: 0 -> -50, [6]: 1 -> 50\n" +
+		"     6: HLT     ok               [7]  HLT\n" +
+		"     9: ?                        []  error: unknown opcode: 99\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	buf := &strings.Builder{}
+	tracer := NewJSONTracer(buf)
+	for _, e := range traceEvents {
+		tracer.Before(e)
+		tracer.After(e)
+	}
+	want := `{"pc":4,"instr":"STA     val","addrs":[6],"regs":[{"name":"ac","old":0,"new":-50}],"mem":[{"addr":6,"old":1,"new":50}],"hlt":false}` + "\n" +
+		`{"pc":6,"instr":"HLT     ok","addrs":[7],"regs":null,"mem":null,"hlt":true}` + "\n" +
+		`{"pc":9,"instr":"?","addrs":null,"regs":null,"mem":null,"hlt":false,"err":"unknown opcode: 99"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
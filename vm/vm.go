@@ -0,0 +1,125 @@
+/*
+ * Types shared by each of the virtual machines
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Machine is implemented by each of the virtual machines so that they
+// can be driven generically.  Memory values are passed as big numbers so
+// that the big number VMs can be accessed without losing precision.
+type Machine interface {
+	// LoadRoutine loads a routine into the machine and resets it
+	LoadRoutine(r *Routine) error
+	// Step executes a single instruction
+	// Returns: hlt, error
+	Step() (bool, error)
+	// Run executes instructions until HLT
+	// Returns: hlt, error
+	Run() (bool, error)
+	// Reset returns the machine to how it was after the last LoadRoutine
+	Reset()
+	// HltVal returns the value supplied by HLT
+	HltVal() *big.Int
+	// PC returns the Program Counter
+	PC() int64
+	// MemSize returns the number of words of data memory
+	MemSize() int64
+	// ReadMem returns the value at addr in data memory
+	ReadMem(addr int64) (*big.Int, error)
+	// WriteMem sets the value at addr in data memory
+	WriteMem(addr int64, n *big.Int) error
+	// SetTracer sets t to be called around each instruction, nil turns
+	// tracing off
+	SetTracer(t Tracer)
+	// Stats returns the counts since the machine was last reset or nil
+	// if they haven't been turned on with the machine's WithStats option
+	Stats() *Stats
+}
+
+// CheckMemSize returns an error if n isn't a valid number of words of
+// memory for a Machine
+func CheckMemSize(n int64) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid memory size: %d", n)
+	}
+	return nil
+}
+
+// Routine is an assembled routine ready to be loaded into a Machine.
+// Routines for VMs with a single memory space have SingleMem set, load
+// Code at address 0 and have no Data.
+type Routine struct {
+	Code        []int64          // Code / Program
+	Data        []*big.Int       // Data for VMs with separate code and data
+	CodeSymbols map[string]int64 // The code symbols table from the assembler
+	DataSymbols map[string]int64 // The data symbols table from the assembler
+	SourceMap   *SourceMap       // Where each word came from in the source
+	Entry       int64            // The code address execution starts at
+	SingleMem   bool             // Whether code and data share one memory
+}
+
+// Size returns the number of words in the routine
+func (r *Routine) Size() int {
+	return len(r.Code) + len(r.Data)
+}
+
+// DataAddr returns the data memory address of symbol.  Routines with
+// SingleMem set have all their symbols in CodeSymbols.
+func (r *Routine) DataAddr(symbol string) (int64, error) {
+	if addr, ok := r.DataSymbols[symbol]; ok {
+		return addr, nil
+	}
+	if r.SingleMem {
+		if addr, ok := r.CodeSymbols[symbol]; ok {
+			return addr, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown symbol: %s", symbol)
+}
+
+// SourceMap records the source line that each word of a routine was
+// assembled from
+type SourceMap struct {
+	Filename string   // Name of the source file
+	Lines    []string // The source lines
+	Code     []int    // Line number for each word of Code, starting at 1
+	Data     []int    // Line number for each word of Data, starting at 1
+	// Symbols records where each symbol is defined and used
+	Symbols map[string]*SymbolRefs
+}
+
+// SymbolRefs records the lines where a symbol is defined and used
+type SymbolRefs struct {
+	Defined int   // Line number of the definition
+	Used    []int // Line numbers of each use in order
+}
+
+// A line number of 0 in a SourceMap is used for words generated by the
+// assembler rather than assembled from a source line.
+
+// Record records that the words of code and data beyond those already
+// recorded were assembled from lineNum
+func (m *SourceMap) Record(lineNum int, codeSize int, dataSize int) {
+	for len(m.Code) < codeSize {
+		m.Code = append(m.Code, lineNum)
+	}
+	for len(m.Data) < dataSize {
+		m.Data = append(m.Data, lineNum)
+	}
+}
+
+// AsmOptions are the options passed to an assembler
+type AsmOptions struct {
+	Filename string    // Name of the source used when reporting errors
+	Listing  io.Writer // If not nil a listing is written to this
+}
@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestRoutineDataAddr(t *testing.T) {
+	single := &Routine{
+		Code:        []int64{1, 2, 3},
+		CodeSymbols: map[string]int64{"start": 0, "sum": 2},
+		SingleMem:   true,
+	}
+	split := &Routine{
+		Code:        []int64{1, 2},
+		Data:        []*big.Int{big.NewInt(0), big.NewInt(0)},
+		CodeSymbols: map[string]int64{"start": 0},
+		DataSymbols: map[string]int64{"sum": 1},
+	}
+	// Separate code and data but without any data
+	noData := &Routine{
+		Code:        []int64{1, 2},
+		CodeSymbols: map[string]int64{"start": 0},
+	}
+	cases := []struct {
+		name     string
+		routine  *Routine
+		symbol   string
+		wantAddr int64
+		wantErr  bool
+	}{
+		{"single data", single, "sum", 2, false},
+		{"single code", single, "start", 0, false},
+		{"split data", split, "sum", 1, false},
+		{"split code", split, "start", 0, true},
+		{"split no data", noData, "start", 0, true},
+		{"unknown", single, "nowhere", 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, err := c.routine.DataAddr(c.symbol)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("DataAddr(%q) err: %v, wantErr: %t", c.symbol, err, c.wantErr)
+			}
+			if addr != c.wantAddr {
+				t.Errorf("DataAddr(%q) got: %d, want: %d", c.symbol, addr, c.wantAddr)
+			}
+		})
+	}
+}
+
+func TestCheckMemSize(t *testing.T) {
+	for _, n := range []int64{-1, 0} {
+		if err := CheckMemSize(n); err == nil {
+			t.Errorf("CheckMemSize(%d) err: nil, want: invalid memory size", n)
+		}
+	}
+	if err := CheckMemSize(1); err != nil {
+		t.Errorf("CheckMemSize(1) err: %v", err)
+	}
+}
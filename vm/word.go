@@ -0,0 +1,138 @@
+/*
+ * The width of a machine word and how values wrap around within it
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// WordSizes are the supported word sizes in bits other than 0, which
+// means unbounded
+var WordSizes = []uint{12, 16, 18, 32, 36, 64}
+
+// Word is the width of a machine word.  Words are two's complement so
+// the top bit is the sign and results of arithmetic wrap around to fit.
+// The zero value is unbounded, which for a machine using int64 words is
+// the same as 64 bits.
+type Word struct {
+	bits  uint // 0 if unbounded
+	shift uint // 64 - bits if 64 bits or less, otherwise 0
+}
+
+// NewWord returns a Word bits wide, 0 means unbounded
+func NewWord(bits uint) (Word, error) {
+	if bits == 0 {
+		return Word{}, nil
+	}
+	for _, size := range WordSizes {
+		if bits == size {
+			return Word{bits: bits, shift: 64 - bits}, nil
+		}
+	}
+	return Word{}, fmt.Errorf("invalid word size: %d", bits)
+}
+
+// MustWord is like NewWord but panics if bits isn't a valid word size
+func MustWord(bits uint) Word {
+	w, err := NewWord(bits)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+// Bits returns the number of bits in a word, 0 if unbounded
+func (w Word) Bits() uint {
+	return w.bits
+}
+
+func (w Word) String() string {
+	if w.bits == 0 {
+		return "unbounded"
+	}
+	return fmt.Sprintf("%d-bit", w.bits)
+}
+
+// Wrap returns n wrapped around to fit in a word and sign extended
+func (w Word) Wrap(n int64) int64 {
+	return n << w.shift >> w.shift
+}
+
+// WrapUint returns n wrapped around to fit in a word without sign
+// extension, as used by machines with unsigned words
+func (w Word) WrapUint(n uint64) uint64 {
+	return n << w.shift >> w.shift
+}
+
+// IsNegUint returns whether n, wrapped by WrapUint, is negative when its
+// top bit is taken as the sign
+func (w Word) IsNegUint(n uint64) bool {
+	return n<<w.shift>>63 == 1
+}
+
+// WrapBig returns n wrapped around to fit in a word and sign extended.
+// n is returned unchanged if the word is unbounded.
+func (w Word) WrapBig(n *big.Int) *big.Int {
+	if w.bits == 0 {
+		return n
+	}
+	if n.IsInt64() {
+		return n.SetInt64(w.Wrap(n.Int64()))
+	}
+	modulus := new(big.Int).Lsh(big.NewInt(1), w.bits)
+	n.Mod(n, modulus)
+	if n.Bit(int(w.bits)-1) == 1 {
+		n.Sub(n, modulus)
+	}
+	return n
+}
+
+// SignBig returns the sign of n, as -1, 0 or +1, once wrapped around to
+// fit in a word.  n isn't changed.
+func (w Word) SignBig(n *big.Int) int {
+	if w.bits == 0 {
+		return n.Sign()
+	}
+	if n.IsInt64() {
+		return sign(w.Wrap(n.Int64()))
+	}
+	return w.WrapBig(new(big.Int).Set(n)).Sign()
+}
+
+// CmpBig compares a and b, once wrapped around to fit in a word, in the
+// same way as big.Int.Cmp.  Neither a or b are changed.
+func (w Word) CmpBig(a, b *big.Int) int {
+	if w.bits == 0 {
+		return a.Cmp(b)
+	}
+	if a.IsInt64() && b.IsInt64() {
+		x, y := w.Wrap(a.Int64()), w.Wrap(b.Int64())
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	x := w.WrapBig(new(big.Int).Set(a))
+	y := w.WrapBig(new(big.Int).Set(b))
+	return x.Cmp(y)
+}
+
+func sign(n int64) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
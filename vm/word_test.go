@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestNewWord(t *testing.T) {
+	for _, bits := range append([]uint{0}, WordSizes...) {
+		w, err := NewWord(bits)
+		if err != nil {
+			t.Errorf("NewWord(%d) err: %s", bits, err)
+		}
+		if w.Bits() != bits {
+			t.Errorf("NewWord(%d) Bits got: %d", bits, w.Bits())
+		}
+	}
+	for _, bits := range []uint{1, 8, 24, 65, 128} {
+		if _, err := NewWord(bits); err == nil {
+			t.Errorf("NewWord(%d) expected an error", bits)
+		}
+	}
+}
+
+func TestWordWrap(t *testing.T) {
+	cases := []struct {
+		bits uint
+		n    int64
+		want int64
+	}{
+		{12, 2047, 2047},
+		{12, 2048, -2048},
+		{12, 4095, -1},
+		{12, 4096, 0},
+		{12, -2049, 2047},
+		{18, 131072, -131072},
+		{32, math.MaxInt32 + 1, math.MinInt32},
+		{32, -1, -1},
+		{36, 1 << 35, -(1 << 35)},
+		{64, math.MaxInt64, math.MaxInt64},
+		{0, math.MinInt64, math.MinInt64},
+	}
+	for _, c := range cases {
+		w, err := NewWord(c.bits)
+		if err != nil {
+			t.Fatalf("NewWord(%d) err: %s", c.bits, err)
+		}
+		if got := w.Wrap(c.n); got != c.want {
+			t.Errorf("%s Wrap(%d) got: %d, want: %d", w, c.n, got, c.want)
+		}
+		if got := w.WrapBig(big.NewInt(c.n)); got.Cmp(big.NewInt(c.want)) != 0 {
+			t.Errorf("%s WrapBig(%d) got: %s, want: %d", w, c.n, got, c.want)
+		}
+		gotU := w.WrapUint(uint64(c.n))
+		if got := w.Wrap(int64(gotU)); got != c.want {
+			t.Errorf("%s WrapUint(%d) got: %d, want: %d", w, c.n, gotU, c.want)
+		}
+		if got := w.IsNegUint(gotU); got != (c.want < 0) {
+			t.Errorf("%s IsNegUint(%d) got: %t", w, gotU, got)
+		}
+	}
+}
+
+func TestWordWrapBigLarge(t *testing.T) {
+	huge := new(big.Int).Lsh(big.NewInt(1), 100)
+	huge.Add(huge, big.NewInt(4095))
+	cases := []struct {
+		bits uint
+		want *big.Int
+	}{
+		{12, big.NewInt(-1)},
+		{64, big.NewInt(4095)},
+		{0, new(big.Int).Set(huge)},
+	}
+	for _, c := range cases {
+		w, err := NewWord(c.bits)
+		if err != nil {
+			t.Fatalf("NewWord(%d) err: %s", c.bits, err)
+		}
+		if got := w.WrapBig(new(big.Int).Set(huge)); got.Cmp(c.want) != 0 {
+			t.Errorf("%s WrapBig got: %s, want: %s", w, got, c.want)
+		}
+	}
+}
+
+func TestWordSignCmpBig(t *testing.T) {
+	huge := new(big.Int).Lsh(big.NewInt(1), 100)
+	cases := []struct {
+		bits     uint
+		a        *big.Int
+		b        *big.Int
+		wantSign int
+		wantCmp  int
+	}{
+		{12, big.NewInt(4095), big.NewInt(1), -1, -1},
+		{12, big.NewInt(2047), big.NewInt(2048), 1, 1},
+		{12, big.NewInt(4096), big.NewInt(0), 0, 0},
+		{12, new(big.Int).Add(huge, big.NewInt(4095)), big.NewInt(0), -1, -1},
+		{64, new(big.Int).Lsh(big.NewInt(1), 63), big.NewInt(0), -1, -1},
+		{0, big.NewInt(4095), big.NewInt(1), 1, 1},
+		{0, huge, big.NewInt(1), 1, 1},
+	}
+	for _, c := range cases {
+		w, err := NewWord(c.bits)
+		if err != nil {
+			t.Fatalf("NewWord(%d) err: %s", c.bits, err)
+		}
+		a := new(big.Int).Set(c.a)
+		if got := w.SignBig(a); got != c.wantSign {
+			t.Errorf("%s SignBig(%s) got: %d, want: %d", w, c.a, got, c.wantSign)
+		}
+		if got := w.CmpBig(a, c.b); got != c.wantCmp {
+			t.Errorf("%s CmpBig(%s, %s) got: %d, want: %d", w, c.a, c.b, got, c.wantCmp)
+		}
+		if a.Cmp(c.a) != 0 {
+			t.Errorf("%s changed %s to %s", w, c.a, a)
+		}
+	}
+}
@@ -9,11 +9,13 @@
 package vm1
 
 import (
-	"bufio"
-	"fmt"
+	"io"
+	"math/big"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]int64{
@@ -40,180 +42,113 @@ var instructions = map[string]int64{
 	"JGT":   20,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
-
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
-	}
+var syntax = &asm.Syntax{
+	IsMnemonic: isMnemonic,
+	AddrModes:  []string{"I", "II"},
+}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
-	}
-	return lines, nil
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z]+[0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s+`)
-var reAddrMode = regexp.MustCompile(`^\s*([iI]{1,2})\s+`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z,]+).*`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+).*`)
-var reSymbol = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*).*`)
-var reIndexOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+),([0-9a-zA-z]+).*`)
-
-// Build symbol table
-func pass1(srcLines []string) map[string]int64 {
-	var pos int64 = 0
-	symbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			symbols[label] = pos
-			line = line[matchIndices[1]:]
-		}
+// encoder implements asm.Encoder
+type encoder struct{}
 
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			pos += 2
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			pos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			pos++
-		}
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	if stmt.Mnemonic != "" {
+		return 2
 	}
-	return symbols
+	return 1
 }
 
-func pass2(srcLines []string, symbols map[string]int64) []int64 {
-	code := make([]int64, 0)
-	for lineNum, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-			addrMode := ""
-			operand := ""
-			// If there is a possible address mode
-			if reAddrMode.MatchString(line) {
-				addrMode = reAddrMode.FindStringSubmatch(line)[1]
-				matchIndices := reAddrMode.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-			// If there is an operand
-			if reOperand.MatchString(line) {
-				operand = reOperand.FindStringSubmatch(line)[1]
-				matchIndices := reOperand.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			} else {
-				if addrMode != "" {
-					// operand mistaken for address mode
-					operand = addrMode
-				} else {
-					// TODO: replace panic addition to errors
-					panic(fmt.Sprintf("%d: no operand found for instruction: %s", lineNum, line))
-				}
-			}
-			if len(line) > 0 {
-				panic(fmt.Sprintf("%d: remaining line: %s", lineNum, line))
-			}
-			code = append(code, asmInstr(symbols, instr, addrMode, operand)...)
-
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			v, ok := symbols[sym]
-			if !ok {
-				panic(fmt.Sprintf("%d: unknown symbol: %s", lineNum, sym))
-			}
-
-			code = append(code, v)
-
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			i64, err := strconv.ParseInt(lit, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			code = append(code, i64)
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if stmt.Mnemonic == "" {
+		// If there is a literal value or symbol
+		if err := stmt.CheckOperands(1, 1); err != nil {
+			return nil, err
 		}
+		n, err := syms.Eval(stmt.Operands[0])
+		return []*big.Int{n}, err
 	}
-	return code
+	code, err := asmInstr(syms, stmt)
+	return asm.Words(code...), err
 }
 
-func resolveOperand(symbols map[string]int64, operand string) int64 {
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		i64, err := strconv.ParseInt(operand, 10, 64)
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return syms.EvalInt64(operand)
+	case asm.Index:
+		// If operand is an indexed address
+		baseAddr, err := resolveOperand(syms, operand.X)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		return i64
-		// If operand is an indexed address
-	} else if reIndexOperand.MatchString(operand) {
-		base := reIndexOperand.FindStringSubmatch(operand)[1]
-		index := reIndexOperand.FindStringSubmatch(operand)[2]
-		baseAddr := resolveOperand(symbols, base)
-		indexAddr := resolveOperand(symbols, index)
-		return (baseAddr << 12) + indexAddr
+		indexAddr, err := resolveOperand(syms, operand.Y)
+		if err != nil {
+			return 0, err
+		}
+		return (baseAddr << 12) + indexAddr, nil
 		// TODO: error if > 4095
+	case asm.Symbol:
+		if v, ok := syms.Lookup(operand.Name); ok {
+			return v, nil
+		}
 	}
-	v, ok := symbols[operand]
-	if !ok {
-		panic(fmt.Sprintf("unknown operand: %s", operand))
-	}
-	return v
+	return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func asmInstr(symbols map[string]int64, instr string, addrMode string, operand string) []int64 {
-	opcode, ok := instructions[instr]
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) ([]int64, error) {
+	opcode, ok := instructions[stmt.Mnemonic]
 	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
+		return []int64{0, 0}, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
+	}
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return []int64{opcode, 0}, err
 	}
 
-	opA := resolveOperand(symbols, operand)
+	opA, err := resolveOperand(syms, stmt.Operands[0])
+	if err != nil {
+		return []int64{opcode, 0}, err
+	}
 
-	if addrMode == "I" {
+	if stmt.AddrMode == "I" {
 		opA = -opA
 	}
 	code := []int64{opcode, opA}
-	return code
+	return code, nil
+}
+
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
+}
+
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func asm(filename string) ([]int64, error) {
-	srcLines, err := readFile(filename)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, err
+		return nil, err
 	}
-	symbols := pass1(srcLines)
-	/*
-		fmt.Printf("Symbols\n=======\n")
-		for k, v := range symbols {
-			fmt.Printf("%s: %d\n", k, v)
-		}
-	*/
-	code := pass2(srcLines, symbols)
-	//fmt.Printf("%v\n", code)
-	return code, nil
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "vm1"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
+
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
@@ -0,0 +1,51 @@
+/*
+ * A disassembler for this VM
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm1
+
+import (
+	"io"
+	"math"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// mnemonics is the reverse of instructions
+var mnemonics = make(map[int64]string, len(instructions))
+
+func init() {
+	for m, opcode := range instructions {
+		mnemonics[opcode] = m
+	}
+}
+
+// decoder implements asm.Decoder
+type decoder struct{}
+
+// An instruction is an opcode followed by an operand, which is indirect
+// if negative
+func (decoder) Decode(code []int64, addr int64, names *asm.Names) (asm.Instr, int64, bool) {
+	m, ok := mnemonics[code[addr]]
+	if !ok || addr+1 >= int64(len(code)) || code[addr+1] == math.MinInt64 {
+		return asm.Instr{}, 0, false
+	}
+	instr := asm.Instr{Mnemonic: m}
+	operand := code[addr+1]
+	if operand < 0 {
+		instr.AddrMode = "I"
+		operand = -operand
+	}
+	instr.Operands = []string{names.Code(operand)}
+	return instr, 2, true
+}
+
+// Disassemble writes the source for routine to w
+func Disassemble(w io.Writer, routine *vm.Routine) error {
+	return asm.Disassemble(w, routine, decoder{})
+}
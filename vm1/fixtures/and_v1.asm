@@ -9,7 +9,7 @@
         STA     lac
         HLT     ok
 
-memLoc:  0        
+         0
 memBase: 17
 opAddr:  6
 memLoc:  0
@@ -0,0 +1,73 @@
+/*
+ * Counting what is executed for Stats
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm1
+
+import "github.com/lawrencewoodman/go-vmcomparison/vm"
+
+// opInfo describes each instruction for the stats, keyed by opcode
+var opInfo = make(map[int64]vm.OpInfo, len(instructions))
+
+func init() {
+	for _, op := range []vm.OpInfo{
+		{Mnemonic: "HLT", Reads: 1},
+		{Mnemonic: "LDA", Reads: 1},
+		{Mnemonic: "STA", Writes: 1},
+		{Mnemonic: "ADD", Reads: 1},
+		{Mnemonic: "SUB", Reads: 1},
+		{Mnemonic: "AND", Reads: 1},
+		{Mnemonic: "INC", Reads: 1, Writes: 1},
+		{Mnemonic: "JNZ", Branch: true},
+		{Mnemonic: "DSZ", Reads: 1, Writes: 1, Branch: true},
+		{Mnemonic: "JMP", Branch: true},
+		{Mnemonic: "SHL", Reads: 1, Writes: 1},
+		{Mnemonic: "LDX", Reads: 1},
+		{Mnemonic: "LDY", Reads: 1},
+		{Mnemonic: "DYJNZ", Branch: true},
+		{Mnemonic: "JSR", Branch: true},
+		{Mnemonic: "RET", Branch: true},
+		{Mnemonic: "TAY"},
+		{Mnemonic: "STY", Writes: 1},
+		{Mnemonic: "OR", Reads: 1},
+		{Mnemonic: "JEQ", Branch: true},
+		{Mnemonic: "JGT", Branch: true},
+	} {
+		opInfo[instructions[op.Mnemonic]] = op
+	}
+}
+
+// Stats returns the counts since the last reset or nil if they haven't
+// been turned on with WithStats
+func (s *VM1) Stats() *vm.Stats {
+	return s.stats
+}
+
+// countStep executes an instruction and records it in the stats
+// Returns: hlt, error
+func (s *VM1) countStep() (bool, error) {
+	pc := s.pc
+	var op vm.OpInfo
+	var indirects int64
+	if pc >= 0 && pc+1 < s.memSize {
+		op = opInfo[s.mem[pc]]
+		if s.mem[pc+1] < 0 {
+			indirects = 1
+		}
+	}
+	var hlt bool
+	var err error
+	if s.tracer != nil {
+		hlt, err = vm.TraceStep(s.tracer, s, s.step)
+	} else {
+		hlt, err = s.step()
+	}
+	if err == nil {
+		s.stats.Record(op, indirects, s.pc != pc+2)
+	}
+	return hlt, err
+}
@@ -10,26 +10,112 @@ package vm1
 
 import (
 	"fmt"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type VM1 struct {
-	mem    [memSize]int64 // Memory
-	pc     int64          // Program Counter
-	ac     int64          // 32-bit accumulator
-	x      int64          // 32-bit index? register
-	y      int64          // 32-bit index? register
-	r      int64          // 32-bit return register
-	hltVal int64          // A value returned by HLT
+	mem     []int64     // Memory
+	memSize int64       // Number of words of memory
+	pc      int64       // Program Counter
+	ac      int64       // Accumulator
+	x       int64       // Index? register
+	y       int64       // Index? register
+	r       int64       // Return register
+	word    vm.Word     // Width of words, results of arithmetic wrap to fit
+	hltVal  int64       // A value returned by HLT
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*VM1)(nil)
+
+// Option configures a VM1 when passed to New
+type Option func(*VM1)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *VM1) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *VM1) {
+		v.stats = vm.NewStats()
+	}
 }
 
-func New() *VM1 {
-	return &VM1{}
+// WithWordSize sets the width of words, which is unbounded by default.
+// The results of ADD, SUB, INC, DSZ, SHL and DYJNZ wrap around to fit.
+// Words loaded from a routine are stored as they are so JNZ, JEQ and JGT
+// wrap the AC before comparing it.
+func WithWordSize(w vm.Word) Option {
+	return func(v *VM1) {
+		v.word = w
+	}
+}
+
+func New(opts ...Option) *VM1 {
+	v := &VM1{memSize: defaultMemSize}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.mem = make([]int64, v.memSize)
+	return v
 }
 
+// Step executes a single instruction
+// Returns: hlt, error
 func (s *VM1) Step() (bool, error) {
+	if s.stats != nil {
+		return s.countStep()
+	}
+	if s.tracer != nil {
+		return vm.TraceStep(s.tracer, s, s.step)
+	}
+	return s.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (s *VM1) SetTracer(t vm.Tracer) {
+	s.tracer = t
+}
+
+// Decode returns the instruction at the PC and its effective address
+func (s *VM1) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, s.mem, s.pc, s.names)
+	_, addr, err := s.fetch()
+	if err != nil {
+		return instr, nil
+	}
+	return instr, []int64{addr}
+}
+
+// Registers returns the value of each register other than the PC
+func (s *VM1) Registers() []vm.Register {
+	return []vm.Register{
+		{Name: "ac", Value: big.NewInt(s.ac)},
+		{Name: "x", Value: big.NewInt(s.x)},
+		{Name: "y", Value: big.NewInt(s.y)},
+		{Name: "r", Value: big.NewInt(s.r)},
+	}
+}
+
+func (s *VM1) step() (bool, error) {
 	opcode, addr, err := s.fetch()
 	if err != nil {
 		return false, err
@@ -37,96 +123,152 @@ func (s *VM1) Step() (bool, error) {
 	return s.execute(opcode, addr)
 }
 
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
 func (s *VM1) Run() (bool, error) {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = s.Step()
-		if err != nil {
+	switch {
+	case s.stats != nil:
+		return vm.RunSteps(s.countStep)
+	case s.tracer != nil:
+		return vm.RunSteps(s.Step)
+	}
+	for {
+		hlt, err := s.step()
+		if hlt || err != nil {
 			return hlt, err
 		}
 	}
-	return hlt, err
 }
 
-func (s *VM1) Mem() [memSize]int64 {
+func (s *VM1) Mem() []int64 {
 	return s.mem
 }
 
-func (v *VM1) LoadRoutine(routine []int64) {
-	copy(v.mem[:], routine)
+func (v *VM1) LoadRoutine(r *vm.Routine) error {
+	if len(r.Data) > 0 {
+		return fmt.Errorf("routine has separate data, not supported")
+	}
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine too big for memory: %d", len(r.Code))
+	}
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
+}
+
+func (v *VM1) Reset() {
+	for i := range v.mem {
+		v.mem[i] = 0
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.mem[:], v.routine.Code)
+		v.pc = v.routine.Entry
+	}
+	v.ac = 0
+	v.x = 0
+	v.y = 0
+	v.r = 0
+	v.hltVal = 0
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *VM1) HltVal() *big.Int {
+	return big.NewInt(v.hltVal)
+}
+
+func (v *VM1) PC() int64 {
+	return v.pc
+}
+
+func (v *VM1) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *VM1) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return big.NewInt(v.mem[addr]), nil
+}
+
+func (v *VM1) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	if !n.IsInt64() {
+		return fmt.Errorf("value not int64: %s", n)
+	}
+	v.mem[addr] = v.word.Wrap(n.Int64())
+	return nil
 }
 
 // fetch gets the next instruction from memory
 // Returns: opcode, addr
 // TODO: describe instruction format
 func (s *VM1) fetch() (int64, int64, error) {
-	if s.pc+1 >= memSize {
-		return 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", s.pc, s.pc+1)
+	mem := s.mem
+	if s.pc+1 >= int64(len(mem)) {
+		return 0, 0, &vm.MemoryFault{PC: s.pc, Addr: s.pc + 1}
 	}
-	opcode := s.mem[s.pc]
-	operand := s.mem[s.pc+1]
+	opcode := mem[s.pc]
+	operand := mem[s.pc+1]
 
 	// if addressing mode: indirect
 	if operand < 0 {
 		operand = -operand
-		if operand >= memSize {
-			return 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", s.pc, operand)
+		if operand >= int64(len(mem)) {
+			return 0, 0, &vm.MemoryFault{PC: s.pc, Addr: operand}
 		}
-		operand = s.mem[operand]
+		operand = mem[operand]
 	}
-	if operand >= memSize {
-		return 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", s.pc, operand)
+	if operand < 0 || operand >= int64(len(mem)) {
+		return 0, 0, &vm.MemoryFault{PC: s.pc, Addr: operand}
 	}
 
 	return opcode, operand, nil
 }
 
-func (v *VM1) opcode2mnemonic(opcode int64) string {
-	for m, o := range instructions {
-		if o == opcode {
-			return m
-		}
-	}
-	panic("opcode not found")
-}
-
 // execute executes the supplied instruction
 // Returns: hlt, error
 func (s *VM1) execute(opcode, addr int64) (bool, error) {
-	//fmt.Printf("PC: %3d, instruction: %s, addr: %d, pre AC: %d, ", s.pc, s.opcode2mnemonic(opcode), addr, s.ac)
+	mem := s.mem
 	switch opcode {
 	case 0: // HLT
-		s.hltVal = s.mem[addr]
+		s.hltVal = mem[addr]
 		return true, nil
 	case 1: // LDA
-		s.ac = s.mem[addr]
+		s.ac = mem[addr]
 		s.pc += 2
 	case 2: // STA
-		s.mem[addr] = s.ac
+		mem[addr] = s.ac
 		s.pc += 2
 	case 3: // ADD
-		s.ac = s.ac + s.mem[addr]
+		s.ac = s.word.Wrap(s.ac + mem[addr])
 		s.pc += 2
 	case 4: // SUB
-		s.ac = s.ac - s.mem[addr]
+		s.ac = s.word.Wrap(s.ac - mem[addr])
 		s.pc += 2
 	case 5: // AND
-		s.ac &= s.mem[addr]
+		s.ac &= mem[addr]
 		s.pc += 2
 	case 6: // INC
-		s.mem[addr] = s.mem[addr] + 1
+		mem[addr] = s.word.Wrap(mem[addr] + 1)
 		s.pc += 2
 	case 7: // JNZ
 		// TODO: Rename to JNE?
-		if s.ac != 0 {
+		if s.word.Wrap(s.ac) != 0 {
 			s.pc = addr
 		} else {
 			s.pc += 2
 		}
 	case 8: // DSZ
-		s.mem[addr] = s.mem[addr] - 1
-		if s.mem[addr] == 0 {
+		mem[addr] = s.word.Wrap(mem[addr] - 1)
+		if mem[addr] == 0 {
 			s.pc += 4
 		} else {
 			s.pc += 2
@@ -134,16 +276,16 @@ func (s *VM1) execute(opcode, addr int64) (bool, error) {
 	case 9: // JMP
 		s.pc = addr
 	case 10: // SHL
-		s.mem[addr] = s.mem[addr] << 1
+		mem[addr] = s.word.Wrap(mem[addr] << 1)
 		s.pc += 2
 	case 11: // LDX
-		s.x = s.mem[addr]
+		s.x = mem[addr]
 		s.pc += 2
 	case 12: // LDY
-		s.y = s.mem[addr]
+		s.y = mem[addr]
 		s.pc += 2
 	case 13: // DYJNZ
-		s.y = s.y - 1
+		s.y = s.word.Wrap(s.y - 1)
 		if s.y != 0 {
 			s.pc = addr
 		} else {
@@ -161,26 +303,25 @@ func (s *VM1) execute(opcode, addr int64) (bool, error) {
 		s.y = s.ac
 		s.pc += 2
 	case 17: // STY - Store Y
-		s.mem[addr] = s.y
+		mem[addr] = s.y
 		s.pc += 2
 	case 18: // OR
-		s.ac |= s.mem[addr]
+		s.ac |= mem[addr]
 		s.pc += 2
 	case 19: // JEQ
-		if s.ac == 0 {
+		if s.word.Wrap(s.ac) == 0 {
 			s.pc = addr
 		} else {
 			s.pc += 2
 		}
 	case 20: // JGT
-		if s.ac > 0 {
+		if s.word.Wrap(s.ac) > 0 {
 			s.pc = addr
 		} else {
 			s.pc += 2
 		}
 	default:
-		panic(fmt.Sprintf("unknown opcode: %d (%d)", opcode, (opcode&0x3f000000)>>24))
+		return false, &vm.InvalidOpcode{PC: s.pc, Addr: s.pc, Opcode: opcode}
 	}
-	//fmt.Printf("post AC: %d\n", s.ac)
 	return false, nil
 }
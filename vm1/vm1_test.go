@@ -1,61 +1,221 @@
 package vm1
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var VMtests = []struct {
 	filename string
-	want     map[int64]int64 // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"add12_v1.asm", map[int64]int64{12: 4}},
-	{"and_v1.asm", map[int64]int64{21: 4499}},
-	{"tad_v1.asm", map[int64]int64{20: 32}},
-	{"isz_v1.asm", map[int64]int64{30: 9, 32: 24}},
-	{"loopuntil_v1.asm", map[int64]int64{16: 5000}},
-	{"loopuntil_v2.asm", map[int64]int64{12: 5000}},
-	{"subleq_v1.asm", map[int64]int64{87: 5000}},
-	{"switch_v1.asm", map[int64]int64{94: 2255}},
-	{"switch_v2.asm", map[int64]int64{97: 2255}},
-	{"jsr_v1.asm", map[int64]int64{6: 50}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"and_v1.asm", map[string]int64{"lac": 4499}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "tmp": 24}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
+	{"loopuntil_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range VMtests {
 		t.Run(test.filename, func(t *testing.T) {
-			routine, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(routine)
-			_, err = v.Run()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = vm.RunLimit(context.Background(), v, maxTestSteps)
 			if err != nil {
-				t.Fatalf("Run() err: %v", err)
+				t.Fatalf("RunLimit() err: %v", err)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc] != wantValue {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr] != wantValue {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 				}
 			}
 		})
 	}
 }
 
+func TestDisassemble(t *testing.T) {
+	for _, test := range VMtests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("AssembleFile() err: %v", err)
+			}
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+		})
+	}
+}
+
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "LDA     l50", "[{ac 0 50}]", "[]"},
+		{2, "JSR     setVal", "[{r 0 4}]", "[]"},
+		{9, "STA     val", "[]", "[{6 0 50}]"},
+		{11, "RET     0", "[]", "[]"},
+		{4, "HLT     ok", "[]", "[]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		code []int64
+		want error
+	}{
+		{"invalid opcode", []int64{1, 4, 99, 0, 0},
+			&vm.InvalidOpcode{PC: 2, Addr: 2, Opcode: 99}},
+		{"outside memory", []int64{1, 40000},
+			&vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"indirect outside memory", []int64{1, -4, 0, 0, 40000},
+			&vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"fetch outside memory", []int64{9, 31999},
+			&vm.MemoryFault{PC: 31999, Addr: 32000}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := New()
+			if err := v.LoadRoutine(&vm.Routine{Code: c.code}); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err := v.Run()
+			if !reflect.DeepEqual(err, c.want) {
+				t.Errorf("Run() err got: %v, want: %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "loopuntil_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps: 15004,
+		Opcodes: map[string]int64{
+			"ADD": 5000, "DSZ": 5000, "HLT": 1, "JMP": 4999, "LDA": 2, "STA": 2,
+		},
+		Reads:          10003,
+		Writes:         5002,
+		Taken:          5000,
+		NotTaken:       4999,
+		StackHighWater: map[string]int64{},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+
+	v.Reset()
+	if got := v.Stats(); !reflect.DeepEqual(got, vm.NewStats()) {
+		t.Errorf("Stats() after Reset got: %v, want: %v", got, vm.NewStats())
+	}
+	if got := New().Stats(); got != nil {
+		t.Errorf("Stats() without WithStats got: %v, want: nil", got)
+	}
+}
+
 func BenchmarkRun(b *testing.B) {
 	for _, test := range VMtests {
-		routine, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(routine)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
 				_, err = v.Run()
@@ -64,13 +224,218 @@ func BenchmarkRun(b *testing.B) {
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc] != wantValue {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr] != wantValue {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(routine))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
+	}
+}
+
+func TestWithMemSize(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "loopuntil_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+
+	v := New(WithMemSize(4096))
+	if got := v.MemSize(); got != 4096 {
+		t.Errorf("MemSize() got: %d, want: 4096", got)
+	}
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	if v.mem[16] != 5000 {
+		t.Errorf("mem[16] got: %d, want: 5000", v.mem[16])
+	}
+
+	v = New(WithMemSize(int64(len(routine.Code) - 1)))
+	if err := v.LoadRoutine(routine); err == nil {
+		t.Errorf("LoadRoutine() err: nil, want: routine too big")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("New(WithMemSize(-1)) didn't panic")
+		}
+	}()
+	New(WithMemSize(-1))
+}
+
+func TestWithWordSize(t *testing.T) {
+	src := "        LDA  a\n" +
+		"        ADD  b\n" +
+		"        STA  sum\n" +
+		"        JGT  pos\n" +
+		"        HLT  no\n" +
+		"pos:    HLT  yes\n" +
+		"a:      2047\n" +
+		"b:      1\n" +
+		"sum:    0\n" +
+		"no:     0\n" +
+		"yes:    1\n"
+	routine, err := AssembleString(src, vm.AsmOptions{})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	cases := []struct {
+		bits    uint
+		wantSum int64
+		wantHlt int64
+	}{
+		{0, 2048, 1},
+		{12, -2048, 0},
+		{16, 2048, 1},
+	}
+	for _, c := range cases {
+		word, err := vm.NewWord(c.bits)
+		if err != nil {
+			t.Fatalf("NewWord() err: %v", err)
+		}
+		t.Run(word.String(), func(t *testing.T) {
+			v := New(WithWordSize(word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			sum := v.mem[routine.CodeSymbols["sum"]]
+			if sum != c.wantSum {
+				t.Errorf("sum got: %d, want: %d", sum, c.wantSum)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
+		})
+	}
+}
+
+func TestWithWordSizeCompare(t *testing.T) {
+	// big is stored as it is, so is only 0 once wrapped to fit a word.
+	// Each routine HLTs with 1 if big is taken as 0.
+	jeq := "        LDA  big\n" +
+		"        JEQ  zero\n" +
+		"        HLT  no\n" +
+		"zero:   HLT  yes\n"
+	jnz := "        LDA  big\n" +
+		"        JNZ  nz\n" +
+		"        HLT  yes\n" +
+		"nz:     HLT  no\n"
+	jgt := "        LDA  big\n" +
+		"        JGT  pos\n" +
+		"        HLT  yes\n" +
+		"pos:    HLT  no\n"
+	data := "big:    4096\n" +
+		"no:     0\n" +
+		"yes:    1\n"
+	cases := []struct {
+		name    string
+		src     string
+		bits    uint
+		wantHlt int64
+	}{
+		{"jeq", jeq, 0, 0},
+		{"jeq", jeq, 12, 1},
+		{"jeq", jeq, 16, 0},
+		{"jnz", jnz, 0, 0},
+		{"jnz", jnz, 12, 1},
+		{"jnz", jnz, 16, 0},
+		{"jgt", jgt, 0, 0},
+		{"jgt", jgt, 12, 1},
+		{"jgt", jgt, 16, 0},
+	}
+	for _, c := range cases {
+		word := vm.MustWord(c.bits)
+		t.Run(c.name+"/"+word.String(), func(t *testing.T) {
+			routine, err := AssembleString(c.src+data, vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v", err)
+			}
+			v := New(WithWordSize(word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
+		})
+	}
+}
+
+func TestAsmErrors(t *testing.T) {
+	src := "start:  LDA  l1\n" +
+		"        FOO  l1\n" +
+		"        STA  nowhere\n" +
+		"lda:    LDA  ld\n" +
+		"        HLT  l1\n" +
+		"l1:     1\n"
+	filename := "errors.asm"
+	want := []vm.AsmError{
+		{Filename: filename, Line: 2, Column: 9, Token: "FOO", Msg: "unknown instruction"},
+		{Filename: filename, Line: 3, Column: 14, Token: "nowhere", Msg: "unknown operand"},
+		{Filename: filename, Line: 4, Column: 14, Token: "ld", Msg: "unknown operand"},
+	}
+
+	_, err := AssembleString(src, vm.AsmOptions{Filename: filename})
+	errs, ok := err.(vm.AsmErrors)
+	if !ok {
+		t.Fatalf("AssembleString() err: %v, want: vm.AsmErrors", err)
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("AssembleString() got: %d errors, want: %d - %v", len(errs), len(want), errs)
+	}
+	for i, e := range errs {
+		if *e != want[i] {
+			t.Errorf("AssembleString() error %d got: %v, want: %v", i, *e, want[i])
+		}
+	}
+}
+
+func TestAssembleSourceMap(t *testing.T) {
+	src := "        LDA  l1\n" +
+		"        ; A comment\n" +
+		"        HLT  l1\n" +
+		"l1:     7\n"
+	routine, err := AssembleString(src, vm.AsmOptions{Filename: "srcmap.asm"})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	wantCode := []int64{1, 4, 0, 4, 7}
+	if !reflect.DeepEqual(routine.Code, wantCode) {
+		t.Errorf("Code got: %v, want: %v", routine.Code, wantCode)
+	}
+	if routine.CodeSymbols["l1"] != 4 {
+		t.Errorf("CodeSymbols[l1] got: %d, want: 4", routine.CodeSymbols["l1"])
+	}
+	wantLines := []int{1, 1, 3, 3, 4}
+	if !reflect.DeepEqual(routine.SourceMap.Code, wantLines) {
+		t.Errorf("SourceMap.Code got: %v, want: %v", routine.SourceMap.Code, wantLines)
+	}
+	if routine.SourceMap.Filename != "srcmap.asm" {
+		t.Errorf("SourceMap.Filename got: %s, want: srcmap.asm", routine.SourceMap.Filename)
 	}
 }
@@ -9,11 +9,13 @@
 package vm2
 
 import (
-	"bufio"
-	"fmt"
+	"io"
+	"math/big"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]int64{
@@ -33,159 +35,73 @@ var instructions = map[string]int64{
 	"JGT":  13,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
-
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
-	}
+var syntax = &asm.Syntax{
+	IsMnemonic: isMnemonic,
+	AddrModes:  []string{"I", "DI", "II"},
+}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
-	}
-	return lines, nil
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s+`)
-var reAddrMode = regexp.MustCompile(`^\s*([diDI]{1,2})\s+`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+)`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+).*`)
-var reSymbol = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*).*`)
-
-// Build symbol table
-func pass1(srcLines []string) map[string]int64 {
-	var pos int64 = 0
-	symbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			symbols[label] = pos
-			line = line[matchIndices[1]:]
-		}
+// encoder implements asm.Encoder
+type encoder struct{}
 
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			pos += 3
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			pos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			pos++
-		}
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	if stmt.Mnemonic != "" {
+		return 3
 	}
-	return symbols
+	return 1
 }
 
-// Returns: operand, restLine
-func getOperand(line string, addrMode string) (string, string) {
-	operand := ""
-	if reOperand.MatchString(line) {
-		operand = reOperand.FindStringSubmatch(line)[1]
-		matchIndices := reOperand.FindStringSubmatchIndex(line)
-		line = line[matchIndices[3]:]
-	} else {
-		if addrMode != "" {
-			// operand mistaken for address mode
-			operand = addrMode
-		} else {
-			// If operand missing then use '0'
-			operand = "0"
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if stmt.Mnemonic == "" {
+		// If there is a literal value or symbol
+		if err := stmt.CheckOperands(1, 1); err != nil {
+			return nil, err
 		}
+		n, err := syms.Eval(stmt.Operands[0])
+		return []*big.Int{n}, err
 	}
-	return operand, line
+	code, err := asmInstr(syms, stmt)
+	return asm.Words(code...), err
 }
 
-func pass2(srcLines []string, symbols map[string]int64) []int64 {
-	code := make([]int64, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-			addrMode := ""
-
-			// If there is a possible address mode
-			if reAddrMode.MatchString(line) {
-				addrMode = reAddrMode.FindStringSubmatch(line)[1]
-				matchIndices := reAddrMode.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-			// TODO: handle operand being mistaken for addrMode
-			operandA, line := getOperand(line, "")
-			operandB, line := getOperand(line, "")
-
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(symbols, instr, addrMode, operandA, operandB)...)
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			i64, err := strconv.ParseInt(lit, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			code = append(code, i64)
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			v, ok := symbols[sym]
-			if !ok {
-				panic(fmt.Sprintf("unknown symbol: %s", sym))
-			}
-			code = append(code, v)
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return syms.EvalInt64(operand)
+	case asm.Symbol:
+		if v, ok := syms.Lookup(operand.Name); ok {
+			return v, nil
 		}
 	}
-	return code
+	return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func resolveOperand(symbols map[string]int64, operand string) int64 {
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		i64, err := strconv.ParseInt(operand, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		return i64
-	}
-	v, ok := symbols[operand]
+// Missing operands are assembled as 0
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) ([]int64, error) {
+	code := []int64{0, 0, 0}
+	opcode, ok := instructions[stmt.Mnemonic]
 	if !ok {
-		panic(fmt.Sprintf("unknown operand: %s", operand))
+		return code, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
 	}
-	return v
-}
-
-func asmInstr(symbols map[string]int64, instr string, addrMode string, operandA string, operandB string) []int64 {
-	opcode, ok := instructions[instr]
-	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
+	if err := stmt.CheckOperands(0, 2); err != nil {
+		return code, err
 	}
 
-	opA := resolveOperand(symbols, operandA)
-	opB := resolveOperand(symbols, operandB)
+	operands := []int64{0, 0}
+	for i, operand := range stmt.Operands {
+		n, err := resolveOperand(syms, operand)
+		if err != nil {
+			return code, err
+		}
+		operands[i] = n
+	}
+	opA, opB := operands[0], operands[1]
 
-	switch addrMode {
+	switch stmt.AddrMode {
 	case "":
 	case "I":
 		opA = -opA
@@ -195,41 +111,42 @@ func asmInstr(symbols map[string]int64, instr string, addrMode string, operandA
 		opA = -opA
 		opB = -opB
 	default:
-		panic(fmt.Sprintf("unknown addressing mode: %s", addrMode))
+		return code, vm.NewAsmError(stmt.AddrModePos, stmt.AddrMode, "unknown addressing mode")
 	}
 
-	code := []int64{opcode, opA, opB}
-	return code
+	code = []int64{opcode, opA, opB}
+	return code, nil
 }
 
-func printCode(code []int64) {
-	fmt.Printf("\nCODE\n====")
-	for i, v := range code {
-		if i%10 == 0 {
-			fmt.Printf("\n%03d: ", i)
-		}
-		fmt.Printf("%4d ", v)
-	}
-	fmt.Printf("\n")
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
 }
 
-func printSymbols(symbols map[string]int64) {
-	fmt.Printf("Symbols\n=======\n")
-	for k, v := range symbols {
-		fmt.Printf("%s: %d\n", k, v)
-	}
-	fmt.Printf("\n")
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func asm(filename string) ([]int64, map[string]int64, error) {
-	srcLines, err := readFile(filename)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, map[string]int64{}, err
+		return nil, err
 	}
-	symbols := pass1(srcLines)
-	code := pass2(srcLines, symbols)
-	//printSymbols(symbols)
-	//printCode(code)
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "vm2"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
 
-	return code, symbols, nil
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
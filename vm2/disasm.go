@@ -0,0 +1,99 @@
+/*
+ * A disassembler for this VM
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vm2
+
+import (
+	"io"
+	"math"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// mnemonics is the reverse of instructions
+var mnemonics = make(map[int64]string, len(instructions))
+
+func init() {
+	for m, opcode := range instructions {
+		mnemonics[opcode] = m
+	}
+}
+
+// Kinds of operand used to choose the symbol to show for an address
+const (
+	dataOperand = iota
+	codeOperand
+	numOperand
+)
+
+// operandKinds are the kinds of operand A and B for each opcode when they
+// are direct.  Indirect operands are always data.
+var operandKinds = map[string][2]int{
+	"HLT":  {dataOperand, numOperand},
+	"JSR":  {codeOperand, dataOperand},
+	"DJNZ": {dataOperand, codeOperand},
+	"JMP":  {codeOperand, numOperand},
+	"JNZ":  {dataOperand, codeOperand},
+	"JGT":  {dataOperand, codeOperand},
+}
+
+// decoder implements asm.Decoder
+type decoder struct{}
+
+// An instruction is an opcode followed by operands A and B, each of which
+// is indirect if negative.  Trailing operands of 0 that aren't addresses
+// are left out.
+func (decoder) Decode(code []int64, addr int64, names *asm.Names) (asm.Instr, int64, bool) {
+	m, ok := mnemonics[code[addr]]
+	if !ok || addr+2 >= int64(len(code)) {
+		return asm.Instr{}, 0, false
+	}
+	kinds := operandKinds[m]
+	modes := [2]string{"", ""}
+	operands := make([]string, 2)
+	for i, operand := range code[addr+1 : addr+3] {
+		if operand == math.MinInt64 {
+			return asm.Instr{}, 0, false
+		}
+		kind := kinds[i]
+		if operand < 0 {
+			modes[i] = "I"
+			operand = -operand
+			kind = dataOperand
+		}
+		switch kind {
+		case codeOperand:
+			operands[i] = names.Code(operand)
+		case dataOperand:
+			operands[i] = names.Data(operand)
+		default:
+			operands[i] = names.Number(operand)
+		}
+	}
+
+	instr := asm.Instr{Mnemonic: m, Operands: operands}
+	switch modes {
+	case [2]string{"I", ""}:
+		instr.AddrMode = "I"
+	case [2]string{"", "I"}:
+		instr.AddrMode = "DI"
+	case [2]string{"I", "I"}:
+		instr.AddrMode = "II"
+	}
+	for i := 1; i >= 0 && modes[i] == "" && kinds[i] == numOperand &&
+		instr.Operands[i] == "0"; i-- {
+		instr.Operands = instr.Operands[:i]
+	}
+	return instr, 3, true
+}
+
+// Disassemble writes the source for routine to w
+func Disassemble(w io.Writer, routine *vm.Routine) error {
+	return asm.Disassemble(w, routine, decoder{})
+}
@@ -10,23 +10,105 @@ package vm2
 
 import (
 	"fmt"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type VM2 struct {
-	mem     [memSize]int64   // Memory
-	pc      int64            // Program Counter
-	hltVal  int64            // A value returned by HLT
-	symbols map[string]int64 // The symbols table from the assembler - to aid debugging
+	mem     []int64     // Memory
+	memSize int64       // Number of words of memory
+	pc      int64       // Program Counter
+	hltVal  int64       // A value returned by HLT
+	word    vm.Word     // Width of words, results of arithmetic wrap to fit
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*VM2)(nil)
+
+// Option configures a VM2 when passed to New
+type Option func(*VM2)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *VM2) {
+		v.memSize = n
+	}
 }
 
-func New() *VM2 {
-	return &VM2{}
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *VM2) {
+		v.stats = vm.NewStats()
+	}
 }
 
+// WithWordSize sets the width of words, which is unbounded by default.
+// The results of ADD, SUB, DJNZ and SHL wrap around to fit.  Words
+// loaded from a routine are stored as they are so JNZ, SNE, SLE and JGT
+// wrap their operands before comparing them.
+func WithWordSize(w vm.Word) Option {
+	return func(v *VM2) {
+		v.word = w
+	}
+}
+
+func New(opts ...Option) *VM2 {
+	v := &VM2{memSize: defaultMemSize}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.mem = make([]int64, v.memSize)
+	return v
+}
+
+// Step executes a single instruction
+// Returns: hlt, error
 func (v *VM2) Step() (bool, error) {
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *VM2) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of operands A and B
+func (v *VM2) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.mem, v.pc, v.names)
+	_, operandA, operandB, err := v.fetch()
+	if err != nil {
+		return instr, nil
+	}
+	return instr, []int64{operandA, operandB}
+}
+
+// Registers returns the value of each register other than the PC, of
+// which there are none
+func (v *VM2) Registers() []vm.Register {
+	return nil
+}
+
+func (v *VM2) step() (bool, error) {
 	opcode, operandA, operandB, err := v.fetch()
 	if err != nil {
 		return false, err
@@ -34,108 +116,148 @@ func (v *VM2) Step() (bool, error) {
 	return v.execute(opcode, operandA, operandB)
 }
 
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
 func (v *VM2) Run() (bool, error) {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
 			return hlt, err
 		}
 	}
-	return hlt, err
 }
 
-func (v *VM2) Mem() [memSize]int64 {
+func (v *VM2) Mem() []int64 {
 	return v.mem
 }
 
-func (v *VM2) LoadRoutine(routine []int64, symbols map[string]int64) {
-	copy(v.mem[:], routine)
-	v.symbols = symbols
+func (v *VM2) LoadRoutine(r *vm.Routine) error {
+	if len(r.Data) > 0 {
+		return fmt.Errorf("routine has separate data, not supported")
+	}
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine too big for memory: %d", len(r.Code))
+	}
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
+}
+
+func (v *VM2) Reset() {
+	for i := range v.mem {
+		v.mem[i] = 0
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.mem[:], v.routine.Code)
+		v.pc = v.routine.Entry
+	}
+	v.hltVal = 0
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *VM2) HltVal() *big.Int {
+	return big.NewInt(v.hltVal)
+}
+
+func (v *VM2) PC() int64 {
+	return v.pc
+}
+
+func (v *VM2) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *VM2) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return big.NewInt(v.mem[addr]), nil
+}
+
+func (v *VM2) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	if !n.IsInt64() {
+		return fmt.Errorf("value not int64: %s", n)
+	}
+	v.mem[addr] = v.word.Wrap(n.Int64())
+	return nil
 }
 
 // fetch gets the next instruction from memory
 // Returns: opcode, operandA, operandB
 // TODO: describe instruction format
 func (v *VM2) fetch() (int64, int64, int64, error) {
-	if v.pc+2 >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, v.pc+2)
+	mem := v.mem
+	if v.pc+2 >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: v.pc + 2}
 	}
-	opcode := v.mem[v.pc]
-	operandA := v.mem[v.pc+1]
-	operandB := v.mem[v.pc+2]
+	opcode := mem[v.pc]
+	operandA := mem[v.pc+1]
+	operandB := mem[v.pc+2]
 
 	// If addressing mode: operand A indirect
 	if operandA < 0 {
 		operandA = -operandA
-		if operandA >= memSize {
-			return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandA)
+		if operandA >= int64(len(mem)) {
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandA}
 		}
-		operandA = v.mem[operandA]
+		operandA = mem[operandA]
 	}
 
 	// If addressing mode: operand B indirect
 	if operandB < 0 {
 		operandB = 0 - operandB
-		if operandB >= memSize {
-			return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandB)
+		if operandB >= int64(len(mem)) {
+			return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandB}
 		}
-		operandB = v.mem[operandB]
+		operandB = mem[operandB]
 	}
 
-	if operandA >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandA)
+	if operandA < 0 || operandA >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandA}
 	}
-	if operandB >= memSize {
-		return 0, 0, 0, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, operandB)
+	if operandB < 0 || operandB >= int64(len(mem)) {
+		return 0, 0, 0, &vm.MemoryFault{PC: v.pc, Addr: operandB}
 	}
 
 	// TODO: Decide if should increment PC here
 	return opcode, operandA, operandB, nil
 }
 
-func (v *VM2) addr2symbol(addr int64) string {
-	for k, v := range v.symbols {
-		if v == addr {
-			return k
-		}
-	}
-	return fmt.Sprintf("%d", addr)
-}
-
-func (v *VM2) opcode2mnemonic(opcode int64) string {
-	for m, o := range instructions {
-		if o == opcode {
-			return m
-		}
-	}
-	panic(fmt.Sprintf("opcode not found: %d", opcode))
-}
-
 // execute executes the supplied instruction
 // Returns: hlt, error
 func (v *VM2) execute(opcode int64, operandA int64, operandB int64) (bool, error) {
-	//fmt.Printf("%7s:    %s   %s, %s\n", v.addr2symbol(v.pc), v.opcode2mnemonic(opcode), v.addr2symbol(operandA), v.addr2symbol(operandB))
-	//fmt.Printf("            pre:  [%s]: %d, [%s]: %d\n", v.addr2symbol(operandA), v.mem[operandA], v.addr2symbol(operandB), v.mem[operandB])
-
+	mem := v.mem
 	switch opcode {
 	case 0: // HLT
-		v.hltVal = v.mem[operandA]
+		v.hltVal = mem[operandA]
 		// TODO: this wastes the following memory location, should it?
 		return true, nil
 	case 1: // MOV
-		v.mem[operandB] = v.mem[operandA]
+		mem[operandB] = mem[operandA]
 		v.pc += 3
 	case 2: // JSR
-		v.mem[operandB] = v.pc + 3
+		mem[operandB] = v.pc + 3
 		v.pc = operandA
 	case 3: // ADD
-		v.mem[operandB] = v.mem[operandA] + v.mem[operandB]
+		mem[operandB] = v.word.Wrap(mem[operandA] + mem[operandB])
 		v.pc += 3
 	case 4: // DJNZ
-		v.mem[operandA] = v.mem[operandA] - 1
-		if v.mem[operandA] != 0 {
+		mem[operandA] = v.word.Wrap(mem[operandA] - 1)
+		if mem[operandA] != 0 {
 			v.pc = operandB
 		} else {
 			v.pc += 3
@@ -143,46 +265,48 @@ func (v *VM2) execute(opcode int64, operandA int64, operandB int64) (bool, error
 	case 5: // JMP
 		v.pc = operandA + operandB
 	case 6: // AND
-		v.mem[operandB] = v.mem[operandA] & v.mem[operandB]
+		mem[operandB] = mem[operandA] & mem[operandB]
 		v.pc += 3
 	case 7: // OR
-		v.mem[operandB] = v.mem[operandA] | v.mem[operandB]
+		mem[operandB] = mem[operandA] | mem[operandB]
 		v.pc += 3
 	case 8: // SHL
-		v.mem[operandB] = v.mem[operandB] << v.mem[operandA]
+		if mem[operandA] < 0 {
+			return false, &vm.InvalidOperand{PC: v.pc, Addr: operandA, Value: big.NewInt(mem[operandA])}
+		}
+		mem[operandB] = v.word.Wrap(mem[operandB] << mem[operandA])
 		v.pc += 3
 	case 9: // JNZ
-		if v.mem[operandA] != 0 {
+		if v.word.Wrap(mem[operandA]) != 0 {
 			v.pc = operandB
 		} else {
 			v.pc += 3
 		}
 	case 10: // SNE
-		if v.mem[operandA] != v.mem[operandB] {
+		if v.word.Wrap(mem[operandA]) != v.word.Wrap(mem[operandB]) {
 			v.pc += 6
 		} else {
 			v.pc += 3
 		}
 	case 11: // SLE
-		if v.mem[operandA] <= v.mem[operandB] {
+		if v.word.Wrap(mem[operandA]) <= v.word.Wrap(mem[operandB]) {
 			v.pc += 6
 		} else {
 			v.pc += 3
 		}
 	case 12: // SUB
-		v.mem[operandB] = v.mem[operandB] - v.mem[operandA]
+		mem[operandB] = v.word.Wrap(mem[operandB] - mem[operandA])
 		v.pc += 3
 	case 13: // JGT
-		if v.mem[operandA] > 0 {
+		if v.word.Wrap(mem[operandA]) > 0 {
 			v.pc = operandB
 		} else {
 			v.pc += 3
 		}
 
 	default:
-		return false, fmt.Errorf("PC: %d, unknown opcode: %d (%d)", v.pc, opcode, (opcode&0x3f000000)>>24)
+		return false, &vm.InvalidOpcode{PC: v.pc, Addr: v.pc, Opcode: opcode}
 	}
 
-	//	fmt.Printf("            post:  [%s]: %d, [%s]: %d\n", v.addr2symbol(operandA), v.mem[operandA], v.addr2symbol(operandB), v.mem[operandB])
 	return false, nil
 }
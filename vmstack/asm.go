@@ -9,11 +9,13 @@
 package vmstack
 
 import (
-	"bufio"
-	"fmt"
+	"io"
+	"math/big"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var instructions = map[string]int64{
@@ -44,159 +46,109 @@ var instructions = map[string]int64{
 	"OVER":    24 << 24,
 }
 
-func readFile(filename string) ([]string, error) {
-	lines := make([]string, 0)
+var syntax = &asm.Syntax{IsMnemonic: isMnemonic}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return []string{}, err
-	}
-	defer f.Close()
+func isMnemonic(s string) bool {
+	_, ok := instructions[s]
+	return ok
+}
 
-	sc := bufio.NewScanner(f)
+// encoder implements asm.Encoder
+type encoder struct{}
 
-	// Read through 'tokens' until an EOF is encountered.
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
-	}
+func (encoder) Size(seg asm.Segment, stmt *asm.Stmt) int64 {
+	return 1
+}
 
-	if err := sc.Err(); err != nil {
-		return []string{}, err
+func (encoder) Encode(seg asm.Segment, addr int64, stmt *asm.Stmt, syms *asm.Symbols) ([]*big.Int, error) {
+	if stmt.Mnemonic == "" {
+		return asmData(syms, stmt)
 	}
-	return lines, nil
+	instrCode, err := asmInstr(syms, stmt)
+	return asm.Words(instrCode), err
 }
 
-// Regular expressions for parts of a line
-var reLabel = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]*):`)
-var reInstr = regexp.MustCompile(`^\s*([a-zA-Z][0-9a-zA-Z]+)\s*`)
-var reOperand = regexp.MustCompile(`^\s*([0-9a-zA-Z]+)\s*`)
-var reLiteral = regexp.MustCompile(`^\s*([\-]?[0-9]+)\s*`)
-var reSymbol = regexp.MustCompile(`^\s*!([a-zA-Z][0-9a-zA-Z]*).*`)
-var reComment = regexp.MustCompile(`^\s*(;.*)$`)
-
-// Build symbol table
-func pass1(srcLines []string) map[string]int64 {
-	var pos int64 = 0
-	symbols := make(map[string]int64, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			label := reLabel.FindStringSubmatch(line)[1]
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			symbols[label] = pos
-			line = line[matchIndices[1]:]
-		}
-
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			pos++
-			continue
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			pos++
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			pos++
-		}
+// asmData assembles a literal value or a symbol in the form: !symbol
+func asmData(syms *asm.Symbols, stmt *asm.Stmt) ([]*big.Int, error) {
+	if err := stmt.CheckOperands(1, 1); err != nil {
+		return nil, err
+	}
+	operand := stmt.Operands[0]
+	switch operand.Kind {
+	case asm.Literal:
+		n, err := syms.Eval(operand)
+		return []*big.Int{n}, err
+	case asm.AddrOf:
+		n, err := syms.Eval(operand.X)
+		return []*big.Int{n}, err
+	case asm.Symbol:
+		// Without a '!' a symbol is taken to be an instruction
+		return nil, vm.NewAsmError(operand.Pos, operand.Text, "unknown instruction")
 	}
-	return symbols
+	return nil, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func pass2(srcLines []string, symbols map[string]int64) []int64 {
-	code := make([]int64, 0)
-	for _, line := range srcLines {
-		// If there is a label
-		if reLabel.MatchString(line) {
-			// Remove from line
-			matchIndices := reLabel.FindStringSubmatchIndex(line)
-			line = line[matchIndices[1]:]
-		}
-		// If there is an instruction
-		if reInstr.MatchString(line) {
-			instr := reInstr.FindStringSubmatch(line)[1]
-			matchIndices := reInstr.FindStringSubmatchIndex(line)
-			line = line[matchIndices[3]:]
-
-			operand := ""
-			if reOperand.MatchString(line) {
-				operand = reOperand.FindStringSubmatch(line)[1]
-				matchIndices := reOperand.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-
-			if reComment.MatchString(line) {
-				matchIndices := reComment.FindStringSubmatchIndex(line)
-				line = line[matchIndices[3]:]
-			}
-
-			if len(line) > 0 {
-				panic(fmt.Sprintf("remaining line: %s", line))
-			}
-			code = append(code, asmInstr(symbols, instr, operand))
-		} else if reLiteral.MatchString(line) {
-			// If there is a literal value
-			lit := reLiteral.FindStringSubmatch(line)[1]
-			i64, err := strconv.ParseInt(lit, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-
-			code = append(code, i64)
-		} else if reSymbol.MatchString(line) {
-			// If there is a symbol
-			sym := reSymbol.FindStringSubmatch(line)[1]
-			v, ok := symbols[sym]
-			if !ok {
-				panic(fmt.Sprintf("unknown symbol: %s", sym))
-			}
-			code = append(code, v)
+func resolveOperand(syms *asm.Symbols, operand *asm.Expr) (int64, error) {
+	switch operand.Kind {
+	case asm.Literal:
+		return syms.EvalInt64(operand)
+	case asm.Symbol:
+		if v, ok := syms.Lookup(operand.Name); ok {
+			return v, nil
 		}
 	}
-	return code
+	return 0, vm.NewAsmError(operand.Pos, operand.Text, "unknown operand")
 }
 
-func resolveOperand(symbols map[string]int64, operand string) int64 {
-	if operand == "" {
-		return 0
+// The operand is added to the opcode and is 0 if missing
+func asmInstr(syms *asm.Symbols, stmt *asm.Stmt) (int64, error) {
+	opcode, ok := instructions[stmt.Mnemonic]
+	if !ok {
+		return 0, vm.NewAsmError(stmt.MnemonicPos, stmt.Mnemonic, "unknown instruction")
 	}
-	// If operand is a literal value
-	if reLiteral.MatchString(operand) {
-		i64, err := strconv.ParseInt(operand, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		return i64
+	if err := stmt.CheckOperands(0, 1); err != nil {
+		return opcode, err
 	}
-	v, ok := symbols[operand]
-	if !ok {
-		panic(fmt.Sprintf("unknown operand: %s", operand))
+	if len(stmt.Operands) == 0 {
+		return opcode, nil
 	}
-	return v
-}
 
-func asmInstr(symbols map[string]int64, instr string, operand string) int64 {
-	opcode, ok := instructions[instr]
-	if !ok {
-		panic(fmt.Sprintf("unknown instruction: %s", instr))
+	n, err := resolveOperand(syms, stmt.Operands[0])
+	if err != nil {
+		return opcode, err
 	}
+	return opcode + n, nil
+}
+
+// Assemble assembles the source read from r
+func Assemble(r io.Reader, opts vm.AsmOptions) (*vm.Routine, error) {
+	return asm.Assemble(r, opts, syntax, encoder{})
+}
 
-	code := opcode + resolveOperand(symbols, operand)
-	return code
+// AssembleString assembles the source in src
+func AssembleString(src string, opts vm.AsmOptions) (*vm.Routine, error) {
+	return Assemble(strings.NewReader(src), opts)
 }
 
-func asm(filename string) ([]int64, error) {
-	srcLines, err := readFile(filename)
+// AssembleFile assembles the source in filename
+func AssembleFile(filename string) (*vm.Routine, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return []int64{}, err
+		return nil, err
 	}
-	symbols := pass1(srcLines)
-	/*
-		fmt.Printf("Symbols\n=======\n")
-		for k, v := range symbols {
-			fmt.Printf("%s: %d\n", k, v)
-		}
-	*/
-	code := pass2(srcLines, symbols)
-	//fmt.Printf("%v\n", code)
-	return code, nil
+	defer f.Close()
+	return Assemble(f, vm.AsmOptions{Filename: filename})
+}
+
+// Name identifies this VM in object files
+const Name = "vmstack"
+
+// Save writes routine to w as an object
+func Save(w io.Writer, routine *vm.Routine) error {
+	return vm.WriteObject(w, Name, routine)
+}
+
+// Load reads an object from r that was written by Save
+func Load(r io.Reader) (*vm.Routine, error) {
+	return vm.LoadObject(r, Name)
 }
@@ -0,0 +1,78 @@
+/*
+ * A disassembler for this VM
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vmstack
+
+import (
+	"io"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
+
+// mnemonics is the reverse of instructions
+var mnemonics = make(map[int64]string, len(instructions))
+
+func init() {
+	for m, opcode := range instructions {
+		mnemonics[opcode] = m
+	}
+}
+
+// codeOperands are the instructions whose inline operand is a code address
+var codeOperands = map[string]bool{
+	"JNZ":  true,
+	"DJNZ": true,
+	"JMP":  true,
+	"JSR":  true,
+	"JZ":   true,
+	"JGT":  true,
+}
+
+// dataOperands are the instructions whose inline operand is a data
+// address, the operands of the rest are numbers
+var dataOperands = map[string]bool{
+	"FETCH":   true,
+	"STORE":   true,
+	"FETCHBI": true,
+	"ADDBI":   true,
+	"FETCHI":  true,
+}
+
+// decoder implements asm.Decoder
+type decoder struct{}
+
+// An instruction is an 8-bit opcode followed by a 24-bit operand, which
+// is left out if 0.  Only code and data addresses are shown by name.
+func (decoder) Decode(code []int64, addr int64, names *asm.Names) (asm.Instr, int64, bool) {
+	ir := code[addr]
+	if ir < 0 || ir > 0xFFFFFFFF {
+		return asm.Instr{}, 0, false
+	}
+	m, ok := mnemonics[ir&0xFF000000]
+	if !ok {
+		return asm.Instr{}, 0, false
+	}
+	instr := asm.Instr{Mnemonic: m}
+	operand := ir & 0x00FFFFFF
+	switch {
+	case operand == 0:
+	case codeOperands[m]:
+		instr.Operands = []string{names.Code(operand)}
+	case dataOperands[m]:
+		instr.Operands = []string{names.Data(operand)}
+	default:
+		instr.Operands = []string{names.Number(operand)}
+	}
+	return instr, 1, true
+}
+
+// Disassemble writes the source for routine to w
+func Disassemble(w io.Writer, routine *vm.Routine) error {
+	return asm.Disassemble(w, routine, decoder{})
+}
@@ -1,7 +1,6 @@
 /*
- * A limited stack - It will keep pushing and popping but won't error of it
- * reaches the beginning or end of the stack instead it will just keep
- * acting on the same position in the stack.
+ * A limited stack - If an operation would go beyond the beginning or end
+ * of the stack it is ignored and a fault is recorded for the VM to report.
  *
  * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
  *
@@ -9,16 +8,32 @@
  */
 package vmstack
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
+)
 
 // 8 element limited stack
 type LStack struct {
 	// Using 8 as on some platforms AND mask may be quicker than
 	// condition
-	stack [8]int64
-	sp    int
+	stack   [8]int64
+	sp      int
+	fault   stackFault // Set by the first operation that fails
+	faultSP int        // The stack pointer when the fault occurred
 }
 
+// stackFault records why an operation on a stack failed
+type stackFault int
+
+const (
+	noFault stackFault = iota
+	overflow
+	underflow
+)
+
 func NewLStack() *LStack {
 	return &LStack{}
 }
@@ -30,8 +45,7 @@ func (s *LStack) pop() int64 {
 	if s.sp > 0 {
 		s.sp--
 	} else {
-		fmt.Printf("STACK EMPTY\n")
-		//panic("stack empty")
+		s.setFault(underflow)
 	}
 	return ts
 }
@@ -40,14 +54,19 @@ func (s *LStack) push(v int64) {
 	if s.sp < 7 {
 		s.sp++
 	} else {
-		panic("stack full")
+		s.setFault(overflow)
+		return
 	}
 	s.stack[s.sp] = v
 	// NOTE: keep sp at TOS so the we can use peek and replace
 }
 
+// peek returns TOS, or 0 if the stack is empty as pop does
 // TODO: check name
 func (s *LStack) peek() int64 {
+	if s.sp == 0 {
+		s.setFault(underflow)
+	}
 	return s.stack[s.sp]
 }
 
@@ -60,33 +79,35 @@ func (s *LStack) drop() {
 	if s.sp > 0 {
 		s.sp--
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 func (s *LStack) dup() {
-	if s.sp < 7 {
+	if s.sp == 0 {
+		s.setFault(underflow)
+	} else if s.sp < 7 {
 		s.stack[s.sp+1] = s.stack[s.sp]
 		s.sp++
 	} else {
-		panic("stack full")
+		s.setFault(overflow)
 	}
 
 }
 
 func (s *LStack) swap() {
-	if s.sp >= 1 {
+	if s.sp >= 2 {
 		a := s.stack[s.sp-1]
 		b := s.stack[s.sp]
 		s.stack[s.sp-1] = b
 		s.stack[s.sp] = a
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 func (s *LStack) over() {
-	if s.sp >= 1 {
+	if s.sp >= 2 {
 		if s.sp < 7 {
 			a := s.stack[s.sp-1]
 			b := s.stack[s.sp]
@@ -96,16 +117,16 @@ func (s *LStack) over() {
 			s.stack[s.sp+1] = a
 			s.sp++
 		} else {
-			panic("stack full")
+			s.setFault(overflow)
 		}
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
 // rot (a b c -- b c a)
 func (s *LStack) rot() {
-	if s.sp >= 2 {
+	if s.sp >= 3 {
 		a := s.stack[s.sp-2]
 		b := s.stack[s.sp-1]
 		c := s.stack[s.sp]
@@ -114,7 +135,7 @@ func (s *LStack) rot() {
 		s.stack[s.sp-1] = c
 		s.stack[s.sp] = a
 	} else {
-		panic("stack empty")
+		s.setFault(underflow)
 	}
 }
 
@@ -125,3 +146,45 @@ func (s *LStack) nos() string {
 	}
 	return fmt.Sprintf("%d", s.stack[s.sp-1])
 }
+
+// depth returns the number of items on the stack
+func (s *LStack) depth() int {
+	return s.sp
+}
+
+// nth returns the nth item from the top of the stack, where 0 is TOS, or
+// 0 if there aren't enough items
+func (s *LStack) nth(n int) int64 {
+	if n < 0 || n >= s.sp {
+		return 0
+	}
+	return s.stack[s.sp-n]
+}
+
+// items returns the items on the stack with TOS first
+func (s *LStack) items() []*big.Int {
+	items := make([]*big.Int, s.depth())
+	for i := range items {
+		items[i] = big.NewInt(s.nth(i))
+	}
+	return items
+}
+
+func (s *LStack) setFault(fault stackFault) {
+	if s.fault == noFault {
+		s.fault = fault
+		s.faultSP = s.sp
+	}
+}
+
+// err returns the fault recorded, if any, as an error for the
+// instruction at pc
+func (s *LStack) err(pc int64, name string) error {
+	switch s.fault {
+	case overflow:
+		return &vm.StackOverflow{PC: pc, Addr: int64(s.faultSP), Stack: name}
+	case underflow:
+		return &vm.StackUnderflow{PC: pc, Addr: int64(s.faultSP), Stack: name}
+	}
+	return nil
+}
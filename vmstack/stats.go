@@ -0,0 +1,83 @@
+/*
+ * Counting what is executed for Stats
+ *
+ * Copyright (C) 2023 Lawrence Woodman <lwoodman@vlifesystems.com>
+ *
+ * Licensed under an MIT licence.  Please see LICENCE.md for details.
+ */
+
+package vmstack
+
+import "github.com/lawrencewoodman/go-vmcomparison/vm"
+
+// opInfo describes each instruction for the stats, keyed by opcode
+var opInfo = make(map[int64]vm.OpInfo, len(instructions))
+
+func init() {
+	for _, op := range []vm.OpInfo{
+		{Mnemonic: "HLT"},
+		{Mnemonic: "FETCH", Reads: 1},
+		{Mnemonic: "STORE", Writes: 1},
+		{Mnemonic: "ADD"},
+		{Mnemonic: "SUB"},
+		{Mnemonic: "AND"},
+		{Mnemonic: "INC"},
+		{Mnemonic: "JNZ", Branch: true},
+		{Mnemonic: "DJNZ", Branch: true},
+		{Mnemonic: "JMP", Branch: true},
+		{Mnemonic: "SHL"},
+		{Mnemonic: "LIT"},
+		{Mnemonic: "DROP"},
+		{Mnemonic: "SWAP"},
+		{Mnemonic: "FETCHBI", Reads: 1},
+		{Mnemonic: "ADDBI", Reads: 1},
+		{Mnemonic: "FETCHI", Reads: 1},
+		{Mnemonic: "JSR", Branch: true},
+		{Mnemonic: "RET", Branch: true},
+		{Mnemonic: "DUP"},
+		{Mnemonic: "OR"},
+		{Mnemonic: "JZ", Branch: true},
+		{Mnemonic: "JGT", Branch: true},
+		{Mnemonic: "ROT"},
+		{Mnemonic: "OVER"},
+	} {
+		opInfo[instructions[op.Mnemonic]] = op
+	}
+}
+
+// Stats returns the counts since the last reset or nil if they haven't
+// been turned on with WithStats
+func (v *VMStack) Stats() *vm.Stats {
+	return v.stats
+}
+
+// countStep executes an instruction and records it in the stats
+// Returns: hlt, error
+func (v *VMStack) countStep() (bool, error) {
+	pc := v.pc
+	var op vm.OpInfo
+	var indirects int64
+	if pc >= 0 && pc < v.memSize {
+		op = opInfo[v.mem[pc]&0xFF000000]
+		if op.Mnemonic == "FETCHI" {
+			indirects = 1
+		}
+		// The operand is pushed before the instruction takes its items
+		if v.mem[pc]&0x00FFFFFF > 0 {
+			v.stats.StackDepth("data", v.dstack.depth()+1)
+		}
+	}
+	var hlt bool
+	var err error
+	if v.tracer != nil {
+		hlt, err = vm.TraceStep(v.tracer, v, v.step)
+	} else {
+		hlt, err = v.step()
+	}
+	if err == nil {
+		v.stats.Record(op, indirects, v.pc != pc+1)
+		v.stats.StackDepth("data", v.dstack.depth())
+		v.stats.StackDepth("return", v.rstack.depth())
+	}
+	return hlt, err
+}
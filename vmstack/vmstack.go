@@ -11,64 +11,243 @@ package vmstack
 
 import (
 	"fmt"
+	"math/big"
+
+	"github.com/lawrencewoodman/go-vmcomparison/asm"
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
-// TODO: Make this configurable
-const memSize = 32000
+// The number of words of memory unless set with WithMemSize
+const defaultMemSize = 32000
 
 type VMStack struct {
-	mem    [memSize]int64 // Memory
-	pc     int64          // Program Counter
-	dstack *LStack        // 8 element limited data stack
+	mem     []int64 // Memory
+	memSize int64   // Number of words of memory
+	pc      int64   // Program Counter
+	dstack  *LStack // 8 element limited data stack
 	// stack  *CStack // 8 element circular data stack
-	rstack *LStack // 8 element limited return
-	hltVal int64   // A value returned by HLT
+	rstack  *LStack     // 8 element limited return
+	hltVal  int64       // A value returned by HLT
+	word    vm.Word     // Width of words, results of arithmetic wrap to fit
+	tracer  vm.Tracer   // Called around each instruction if set
+	stats   *vm.Stats   // Counts of what has been executed if turned on
+	names   *asm.Names  // Names of addresses used when tracing
+	routine *vm.Routine // The routine last loaded - used by Reset
+}
+
+var _ vm.Traceable = (*VMStack)(nil)
+var _ vm.StackInspector = (*VMStack)(nil)
+
+// Option configures a VMStack when passed to New
+type Option func(*VMStack)
+
+// WithMemSize sets the number of words of memory, which must be positive
+// or New panics
+func WithMemSize(n int64) Option {
+	return func(v *VMStack) {
+		v.memSize = n
+	}
+}
+
+// WithStats turns on counting what is executed, see Stats
+func WithStats() Option {
+	return func(v *VMStack) {
+		v.stats = vm.NewStats()
+	}
+}
+
+// WithWordSize sets the width of words, which is unbounded by default.
+// The results of ADD, SUB, INC, DJNZ, SHL and ADDBI wrap around to fit.
+// Words loaded from a routine and the operands of LIT are stored as they
+// are so JNZ, JZ and JGT wrap the value before comparing it.
+func WithWordSize(w vm.Word) Option {
+	return func(v *VMStack) {
+		v.word = w
+	}
 }
 
-func New() *VMStack {
-	return &VMStack{dstack: NewLStack(), rstack: NewLStack()}
+func New(opts ...Option) *VMStack {
+	v := &VMStack{memSize: defaultMemSize, dstack: NewLStack(), rstack: NewLStack()}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if err := vm.CheckMemSize(v.memSize); err != nil {
+		panic(err)
+	}
+	v.mem = make([]int64, v.memSize)
+	return v
 	// return &VMStack2{stack: NewCStack()}
 }
 
+// Run executes instructions until HLT.  Whether to trace or count is
+// decided once here so that the loop is tight without them.
+// Returns: hlt, error
 func (v *VMStack) Run() (bool, error) {
-	var err error
-	hlt := false
-	for !hlt {
-		hlt, err = v.Step()
-		if err != nil {
+	switch {
+	case v.stats != nil:
+		return vm.RunSteps(v.countStep)
+	case v.tracer != nil:
+		return vm.RunSteps(v.Step)
+	}
+	for {
+		hlt, err := v.step()
+		if hlt || err != nil {
 			return hlt, err
 		}
 	}
-	return hlt, err
 }
 
-func (v *VMStack) Mem() [memSize]int64 {
+func (v *VMStack) Mem() []int64 {
 	return v.mem
 }
 
-func (v *VMStack) LoadRoutine(routine []int64) {
-	copy(v.mem[:], routine)
+func (v *VMStack) LoadRoutine(r *vm.Routine) error {
+	if len(r.Data) > 0 {
+		return fmt.Errorf("routine has separate data, not supported")
+	}
+	if int64(len(r.Code)) > v.memSize {
+		return fmt.Errorf("routine too big for memory: %d", len(r.Code))
+	}
+	v.routine = r
+	v.names = asm.NewNames(r)
+	v.Reset()
+	return nil
 }
 
-func (v *VMStack) opcode2mnemonic(opcode int64) string {
-	for m, o := range instructions {
-		if o == opcode {
-			return m
-		}
+func (v *VMStack) Reset() {
+	for i := range v.mem {
+		v.mem[i] = 0
+	}
+	v.pc = 0
+	if v.routine != nil {
+		copy(v.mem[:], v.routine.Code)
+		v.pc = v.routine.Entry
+	}
+	v.dstack = NewLStack()
+	v.rstack = NewLStack()
+	v.hltVal = 0
+	if v.stats != nil {
+		v.stats = vm.NewStats()
+	}
+}
+
+func (v *VMStack) HltVal() *big.Int {
+	return big.NewInt(v.hltVal)
+}
+
+func (v *VMStack) PC() int64 {
+	return v.pc
+}
+
+func (v *VMStack) MemSize() int64 {
+	return v.memSize
+}
+
+func (v *VMStack) ReadMem(addr int64) (*big.Int, error) {
+	if addr < 0 || addr >= v.memSize {
+		return nil, fmt.Errorf("outside memory range: %d", addr)
+	}
+	return big.NewInt(v.mem[addr]), nil
+}
+
+func (v *VMStack) WriteMem(addr int64, n *big.Int) error {
+	if addr < 0 || addr >= v.memSize {
+		return fmt.Errorf("outside memory range: %d", addr)
+	}
+	if !n.IsInt64() {
+		return fmt.Errorf("value not int64: %s", n)
 	}
-	panic("opcode not found")
+	v.mem[addr] = v.word.Wrap(n.Int64())
+	return nil
 }
 
+// Step executes a single instruction
 // Returns: hlt, error
 func (v *VMStack) Step() (bool, error) {
-	if v.pc >= memSize {
-		return false, fmt.Errorf("outside memory range: %d", v.pc)
+	if v.stats != nil {
+		return v.countStep()
+	}
+	if v.tracer != nil {
+		return vm.TraceStep(v.tracer, v, v.step)
+	}
+	return v.step()
+}
+
+// SetTracer sets t to be called around each instruction, nil turns
+// tracing off
+func (v *VMStack) SetTracer(t vm.Tracer) {
+	v.tracer = t
+}
+
+// Decode returns the instruction at the PC and the effective addresses
+// of the memory it accesses
+func (v *VMStack) Decode() (string, []int64) {
+	instr := asm.DecodeAt(decoder{}, v.mem, v.pc, v.names)
+	if v.pc < 0 || v.pc >= v.memSize {
+		return instr, nil
 	}
 	ir := v.mem[v.pc]
 	opcode := (ir & 0xFF000000)
 	operand := (ir & 0x00FFFFFF)
 
-	//fmt.Printf("%6d: %5s %-7d   (%5s %5d -- ", v.pc, v.opcode2mnemonic(opcode), operand, v.dstack.nos(), v.dstack.peek())
+	// Take account of the operand being pushed on to the stack
+	nth := func(n int) int64 {
+		if operand > 0 {
+			if n == 0 {
+				return operand
+			}
+			n--
+		}
+		return v.dstack.nth(n)
+	}
+	switch opcode {
+	case 1 << 24, 2 << 24: // FETCH, STORE
+		return instr, []int64{nth(0)}
+	case 14 << 24, 15 << 24: // FETCHBI, ADDBI
+		return instr, []int64{nth(0) + nth(1)}
+	case 16 << 24: // FETCHI
+		addr := nth(0)
+		if n, err := v.ReadMem(addr); err == nil && n.IsInt64() {
+			return instr, []int64{addr, n.Int64()}
+		}
+		return instr, []int64{addr}
+	}
+	return instr, nil
+}
+
+// Registers returns the depth of the stacks and the top items of them
+func (v *VMStack) Registers() []vm.Register {
+	return []vm.Register{
+		{Name: "dsp", Value: big.NewInt(int64(v.dstack.depth()))},
+		{Name: "tos", Value: big.NewInt(v.dstack.nth(0))},
+		{Name: "nos", Value: big.NewInt(v.dstack.nth(1))},
+		{Name: "rsp", Value: big.NewInt(int64(v.rstack.depth()))},
+		{Name: "rtos", Value: big.NewInt(v.rstack.nth(0))},
+	}
+}
+
+// Stacks returns the contents of the data and return stacks
+func (v *VMStack) Stacks() []vm.Stack {
+	return []vm.Stack{
+		{Name: "data", Items: v.dstack.items()},
+		{Name: "return", Items: v.rstack.items()},
+	}
+}
+
+// step executes the instruction at the PC.  Stack faults are recorded by
+// the stacks as they happen and are only looked for once the instruction
+// has been executed, as checking after every stack operation would slow
+// execution too much.
+// Returns: hlt, error
+func (v *VMStack) step() (bool, error) {
+	mem := v.mem
+	pc := v.pc
+	if v.pc < 0 || v.pc >= int64(len(mem)) {
+		return false, &vm.MemoryFault{PC: v.pc, Addr: v.pc}
+	}
+	ir := mem[v.pc]
+	opcode := (ir & 0xFF000000)
+	operand := (ir & 0x00FFFFFF)
 
 	if operand > 0 {
 		v.dstack.push(operand)
@@ -76,42 +255,45 @@ func (v *VMStack) Step() (bool, error) {
 	switch opcode {
 	case 0 << 24: // HLT
 		v.hltVal = v.dstack.pop()
+		if v.dstack.fault != noFault {
+			return false, v.dstack.err(pc, "data")
+		}
 		return true, nil
 	case 1 << 24: // FETCH
 		addr := v.dstack.peek()
-		if addr >= memSize {
-			return false, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, addr)
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
-		v.dstack.replace(v.mem[addr])
+		v.dstack.replace(mem[addr])
 		v.pc++
 	case 2 << 24: // STORE (n addr --)
 		addr := v.dstack.pop()
-		if addr >= memSize {
-			return false, fmt.Errorf("PC: %d, outside memory range: %d", v.pc, addr)
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
 
-		v.mem[addr] = v.dstack.pop()
+		mem[addr] = v.dstack.pop()
 		v.pc++
 	case 3 << 24: // ADD
 		a := v.dstack.pop()
 		b := v.dstack.peek()
-		v.dstack.replace(a + b)
+		v.dstack.replace(v.word.Wrap(a + b))
 		v.pc++
 	case 4 << 24: // SUB (a b -- a-b)
 		b := v.dstack.pop()
 		a := v.dstack.peek()
-		v.dstack.replace(a - b)
+		v.dstack.replace(v.word.Wrap(a - b))
 		v.pc++
 	case 5 << 24: // AND
 		v.dstack.replace(v.dstack.pop() & v.dstack.peek())
 		v.pc++
 	case 6 << 24: // INC
-		v.dstack.replace(v.dstack.peek() + 1)
+		v.dstack.replace(v.word.Wrap(v.dstack.peek() + 1))
 		v.pc++
 	case 7 << 24: // JNZ (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val != 0 {
+		if v.word.Wrap(val) != 0 {
 			v.pc = addr
 		} else {
 			v.pc++
@@ -119,7 +301,7 @@ func (v *VMStack) Step() (bool, error) {
 	case 8 << 24: // DJNZ - (val addr -- val) - Decrement and Jump if not Zero
 		addr := v.dstack.pop()
 		val := v.dstack.peek()
-		val = val - 1
+		val = v.word.Wrap(val - 1)
 		v.dstack.replace(val)
 		if val != 0 {
 			v.pc = addr
@@ -129,7 +311,7 @@ func (v *VMStack) Step() (bool, error) {
 	case 9 << 24: // JMP
 		v.pc = v.dstack.pop()
 	case 10 << 24: // SHL
-		v.dstack.replace(v.dstack.peek() << 1)
+		v.dstack.replace(v.word.Wrap(v.dstack.peek() << 1))
 		v.pc++
 	case 11 << 24: // LIT - Put the 24-bit operand on the stack
 		if operand == 0 {
@@ -146,29 +328,29 @@ func (v *VMStack) Step() (bool, error) {
 		v.pc++
 	case 14 << 24: // FETCHBI - (base index -- n)
 		addr := v.dstack.pop() + v.dstack.peek()
-		if addr >= memSize {
-			return false, fmt.Errorf("outside memory range: %d", addr)
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
-		v.dstack.replace(v.mem[addr])
+		v.dstack.replace(mem[addr])
 		v.pc++
 	case 15 << 24: // ADDBI - (n base index -- n)
 		addr := v.dstack.pop() + v.dstack.pop()
-		if addr >= memSize {
-			return false, fmt.Errorf("outside memory range: %d", addr)
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
-		val := v.mem[addr] + v.dstack.peek()
+		val := v.word.Wrap(mem[addr] + v.dstack.peek())
 		v.dstack.replace(val)
 		v.pc++
 	case 16 << 24: // FETCHI
 		addr := v.dstack.peek()
-		if addr >= memSize {
-			return false, fmt.Errorf("outside memory range: %d", addr)
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
-		addr = v.mem[addr]
-		if addr >= memSize {
-			return false, fmt.Errorf("outside memory range: %d", addr)
+		addr = mem[addr]
+		if addr < 0 || addr >= int64(len(mem)) {
+			return false, &vm.MemoryFault{PC: v.pc, Addr: addr}
 		}
-		v.dstack.replace(v.mem[addr])
+		v.dstack.replace(mem[addr])
 		v.pc++
 	case 17 << 24: // JSR
 		v.rstack.push(v.pc + 1)
@@ -184,7 +366,7 @@ func (v *VMStack) Step() (bool, error) {
 	case 21 << 24: // JZ (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val == 0 {
+		if v.word.Wrap(val) == 0 {
 			v.pc = addr
 		} else {
 			v.pc++
@@ -192,7 +374,7 @@ func (v *VMStack) Step() (bool, error) {
 	case 22 << 24: // JGT (val addr --)
 		addr := v.dstack.pop()
 		val := v.dstack.pop()
-		if val > 0 {
+		if v.word.Wrap(val) > 0 {
 			v.pc = addr
 		} else {
 			v.pc++
@@ -203,8 +385,21 @@ func (v *VMStack) Step() (bool, error) {
 	case 24 << 24: // OVER (a b -- a b a)
 		v.dstack.over()
 		v.pc++
+	default:
+		return false, &vm.InvalidOpcode{PC: v.pc, Addr: v.pc, Opcode: opcode >> 24}
 	}
 
-	//fmt.Printf("%5s %-7d)\n", v.dstack.nos(), v.dstack.peek())
+	if v.dstack.fault != noFault || v.rstack.fault != noFault {
+		return false, v.stackErr(pc)
+	}
 	return false, nil
 }
+
+// stackErr returns the fault recorded by either stack as an error for the
+// instruction at pc
+func (v *VMStack) stackErr(pc int64) error {
+	if err := v.dstack.err(pc, "data"); err != nil {
+		return err
+	}
+	return v.rstack.err(pc, "return")
+}
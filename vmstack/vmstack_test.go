@@ -1,67 +1,286 @@
 package vmstack
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/lawrencewoodman/go-vmcomparison/vm"
 )
 
 var tests = []struct {
 	filename string
-	want     map[int64]int64 // [memloc]value
+	want     map[string]int64 // [symbol]value
 }{
-	{"add12_v1.asm", map[int64]int64{7: 4}},
-	{"and_v1.asm", map[int64]int64{11: 4499}},
-	{"tad_v1.asm", map[int64]int64{11: 32}},
-	{"tad_v2.asm", map[int64]int64{10: 32}},
-	{"isz_v1.asm", map[int64]int64{20: 9, 21: 24}},
-	{"isz_v2.asm", map[int64]int64{19: 9, 20: 24}},
-	{"isz_v3.asm", map[int64]int64{19: 9, 20: 24}},
-	{"jsr_v1.asm", map[int64]int64{5: 50}},
-	{"loopuntil_v1.asm", map[int64]int64{9: 5000}},
-	{"loopuntil_v2.asm", map[int64]int64{8: 5000}},
-	{"subleq_v1.asm", map[int64]int64{78: 5000}},
-	{"subleq_v2.asm", map[int64]int64{77: 5000}},
-	{"subleq_v3.asm", map[int64]int64{76: 5000}},
-	{"switch_v1.asm", map[int64]int64{44: 2255}},
-	{"switch_v2.asm", map[int64]int64{44: 2255}},
-	{"switch_v3.asm", map[int64]int64{51: 2255}},
+	{"add12_v1.asm", map[string]int64{"b": 4}},
+	{"and_v1.asm", map[string]int64{"lac": 4499}},
+	{"tad_v1.asm", map[string]int64{"lac": 32}},
+	{"tad_v2.asm", map[string]int64{"lac": 32}},
+	{"isz_v1.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"isz_v2.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"isz_v3.asm", map[string]int64{"pc": 9, "val": 24}},
+	{"jsr_v1.asm", map[string]int64{"val": 50}},
+	{"loopuntil_v1.asm", map[string]int64{"sum": 5000}},
+	{"loopuntil_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v1.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v2.asm", map[string]int64{"sum": 5000}},
+	{"subleq_v3.asm", map[string]int64{"sum": 5000}},
+	{"switch_v1.asm", map[string]int64{"lac": 2255}},
+	{"switch_v2.asm", map[string]int64{"lac": 2255}},
+	{"switch_v3.asm", map[string]int64{"lac": 2255}},
 }
 
+// maxTestSteps stops a fixture that doesn't halt from hanging the tests
+const maxTestSteps = 10000000
+
 func TestRun(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.filename, func(t *testing.T) {
-			routine, err := asm(filepath.Join("fixtures", test.filename))
+			routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 			if err != nil {
-				t.Fatalf("asm() err: %v", err)
+				t.Fatalf("AssembleFile() err: %v", err)
 			}
 			v := New()
-			v.LoadRoutine(routine)
-			_, err = v.Run()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = vm.RunLimit(context.Background(), v, maxTestSteps)
 			if err != nil {
-				t.Fatalf("Run() err: %v", err)
+				t.Fatalf("RunLimit() err: %v", err)
 			}
-			for memLoc, wantValue := range test.want {
-				if v.mem[memLoc] != wantValue {
-					t.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+			for symbol, wantValue := range test.want {
+				addr, err := routine.DataAddr(symbol)
+				if err != nil {
+					t.Fatalf("DataAddr() err: %v", err)
+				}
+				if v.mem[addr] != wantValue {
+					t.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 				}
 			}
 		})
 	}
 }
 
+func TestDisassemble(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			want, err := AssembleFile(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("AssembleFile() err: %v", err)
+			}
+			src := &strings.Builder{}
+			if err := Disassemble(src, want); err != nil {
+				t.Fatalf("Disassemble() err: %v", err)
+			}
+			got, err := AssembleString(src.String(), vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v\n%s", err, src)
+			}
+			if !reflect.DeepEqual(got.Code, want.Code) {
+				t.Errorf("Code got: %v, want: %v\n%s", got.Code, want.Code, src)
+			}
+			if !reflect.DeepEqual(got.CodeSymbols, want.CodeSymbols) {
+				t.Errorf("CodeSymbols got: %v, want: %v", got.CodeSymbols, want.CodeSymbols)
+			}
+		})
+	}
+}
+
+// recordTracer records the events passed to After
+type recordTracer struct {
+	before int
+	events []vm.TraceEvent
+}
+
+func (t *recordTracer) Before(e *vm.TraceEvent) { t.before++ }
+func (t *recordTracer) After(e *vm.TraceEvent)  { t.events = append(t.events, *e) }
+
+func TestTrace(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New()
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	tracer := &recordTracer{}
+	v.SetTracer(tracer)
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+
+	want := []struct {
+		pc    int64
+		instr string
+		regs  string
+		mem   string
+	}{
+		{0, "LIT     50", "[{dsp 0 1} {tos 0 50}]", "[]"},
+		{1, "JSR     setVal", "[{rsp 0 1} {rtos 0 2}]", "[]"},
+		{3, "STORE   val", "[{dsp 1 0} {tos 50 0}]", "[{5 0 50}]"},
+		{4, "RET", "[{rsp 1 0} {rtos 2 0}]", "[]"},
+		{2, "HLT     1", "[]", "[]"},
+	}
+	if tracer.before != len(want) || len(tracer.events) != len(want) {
+		t.Fatalf("events got: %d, %d, want: %d", tracer.before, len(tracer.events), len(want))
+	}
+	for i, w := range want {
+		e := tracer.events[i]
+		regs := fmt.Sprintf("%v", e.Regs)
+		mem := fmt.Sprintf("%v", e.Mem)
+		if e.PC != w.pc || e.Instr != w.instr || regs != w.regs || mem != w.mem {
+			t.Errorf("event[%d] got: %d %q %s %s, want: %d %q %s %s", i,
+				e.PC, e.Instr, regs, mem, w.pc, w.instr, w.regs, w.mem)
+		}
+	}
+	if !tracer.events[len(want)-1].Hlt {
+		t.Errorf("last event Hlt got: false, want: true")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want error
+	}{
+		{"data stack underflow", "DROP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack overflow", strings.Repeat("LIT 1\n", 8),
+			&vm.StackOverflow{PC: 7, Addr: 7, Stack: "data"}},
+		{"return stack underflow", "RET\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "return"}},
+		{"data stack underflow on peek", "FETCH\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack underflow on dup", "DUP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 0, Addr: 0, Stack: "data"}},
+		{"data stack underflow on swap", "LIT 1\nSWAP\nHLT 1\n",
+			&vm.StackUnderflow{PC: 1, Addr: 1, Stack: "data"}},
+		{"outside memory", "FETCH 40000\n",
+			&vm.MemoryFault{PC: 0, Addr: 40000}},
+		{"negative PC", "FETCH neg\nJMP\nneg: -5\n",
+			&vm.MemoryFault{PC: -5, Addr: -5}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			routine, err := AssembleString(c.src, vm.AsmOptions{})
+			if err != nil {
+				t.Fatalf("AssembleString() err: %v", err)
+			}
+			v := New()
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			_, err = v.Run()
+			if !reflect.DeepEqual(err, c.want) {
+				t.Errorf("Run() err got: %v, want: %v", err, c.want)
+			}
+		})
+	}
+
+	v := New()
+	if err := v.LoadRoutine(&vm.Routine{Code: []int64{99 << 24}}); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	want := &vm.InvalidOpcode{PC: 0, Addr: 0, Opcode: 99}
+	if _, err := v.Run(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Run() err got: %v, want: %v", err, want)
+	}
+}
+
+func TestWithWordSize(t *testing.T) {
+	// HLTs with 1 if neg > 0, otherwise 3 if a+1 > 0 or 2 if not.  neg
+	// is loaded as it is so is only negative once signed by JGT.
+	src := "        FETCH a\n" +
+		"        ADD 1\n" +
+		"        STORE sum\n" +
+		"        FETCH neg\n" +
+		"        JGT pos\n" +
+		"        FETCH sum\n" +
+		"        JGT pos2\n" +
+		"        HLT 2\n" +
+		"pos:    HLT 1\n" +
+		"pos2:   HLT 3\n" +
+		"a:      2047\n" +
+		"neg:    4095\n" +
+		"sum:    0\n"
+	routine, err := AssembleString(src, vm.AsmOptions{})
+	if err != nil {
+		t.Fatalf("AssembleString() err: %v", err)
+	}
+	cases := []struct {
+		bits    uint
+		wantSum int64
+		wantHlt int64
+	}{
+		{0, 2048, 1},
+		{12, -2048, 2},
+		{16, 2048, 1},
+	}
+	for _, c := range cases {
+		word := vm.MustWord(c.bits)
+		t.Run(word.String(), func(t *testing.T) {
+			v := New(WithWordSize(word))
+			if err := v.LoadRoutine(routine); err != nil {
+				t.Fatalf("LoadRoutine() err: %v", err)
+			}
+			if _, err := v.Run(); err != nil {
+				t.Fatalf("Run() err: %v", err)
+			}
+			sum := v.mem[routine.CodeSymbols["sum"]]
+			if sum != c.wantSum {
+				t.Errorf("sum got: %d, want: %d", sum, c.wantSum)
+			}
+			if got := v.HltVal().Int64(); got != c.wantHlt {
+				t.Errorf("HltVal() got: %d, want: %d", got, c.wantHlt)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	routine, err := AssembleFile(filepath.Join("fixtures", "jsr_v1.asm"))
+	if err != nil {
+		t.Fatalf("AssembleFile() err: %v", err)
+	}
+	v := New(WithStats())
+	if err := v.LoadRoutine(routine); err != nil {
+		t.Fatalf("LoadRoutine() err: %v", err)
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run() err: %v", err)
+	}
+	want := &vm.Stats{
+		Steps:          5,
+		Opcodes:        map[string]int64{"HLT": 1, "JSR": 1, "LIT": 1, "RET": 1, "STORE": 1},
+		Writes:         1,
+		Taken:          2,
+		StackHighWater: map[string]int64{"data": 2, "return": 1},
+	}
+	if got := v.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() got: %v, want: %v", got, want)
+	}
+}
+
 func BenchmarkRun(b *testing.B) {
 	for _, test := range tests {
-		routine, err := asm(filepath.Join("fixtures", test.filename))
+		routine, err := AssembleFile(filepath.Join("fixtures", test.filename))
 		if err != nil {
-			b.Fatalf("asm() err: %v", err)
+			b.Fatalf("AssembleFile() err: %v", err)
 		}
 		b.Run(test.filename, func(b *testing.B) {
+			b.ReportAllocs()
 			b.StopTimer()
 
 			for n := 0; n < b.N; n++ {
 				v := New()
-				v.LoadRoutine(routine)
+				if err := v.LoadRoutine(routine); err != nil {
+					b.Fatalf("LoadRoutine() err: %v", err)
+				}
 
 				b.StartTimer()
 				_, err = v.Run()
@@ -70,13 +289,27 @@ func BenchmarkRun(b *testing.B) {
 				if err != nil {
 					b.Errorf("Run() err: %v", err)
 				}
-				for memLoc, wantValue := range test.want {
-					if v.mem[memLoc] != wantValue {
-						b.Errorf("mem[%d] got: %d, want: %d", memLoc, v.mem[memLoc], wantValue)
+				for symbol, wantValue := range test.want {
+					addr, err := routine.DataAddr(symbol)
+					if err != nil {
+						b.Fatalf("DataAddr() err: %v", err)
+					}
+					if v.mem[addr] != wantValue {
+						b.Errorf("%s got: %d, want: %d", symbol, v.mem[addr], wantValue)
 					}
 				}
 			}
 		})
-		fmt.Printf("Routine: %s size: %d\n", test.filename, len(routine))
+		fmt.Printf("Routine: %s size: %d\n", test.filename, routine.Size())
+
+		// Run again counting what is executed to help explain the timing
+		v := New(WithStats())
+		if err := v.LoadRoutine(routine); err != nil {
+			b.Fatalf("LoadRoutine() err: %v", err)
+		}
+		if _, err := vm.RunLimit(context.Background(), v, maxTestSteps); err != nil {
+			b.Errorf("RunLimit() err: %v", err)
+		}
+		fmt.Printf("Stats: %s %s\n", test.filename, v.Stats())
 	}
 }